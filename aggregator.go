@@ -0,0 +1,215 @@
+package main
+
+import "sync/atomic"
+
+// aggregator folds the packets of one shard of buckets into its own metrics on
+// its own goroutine.
+type aggregator struct {
+	in chan *Packet
+	// swap - buffered, flush hands a request to every shard before waiting
+	// for any of them
+	swap chan swapRequest
+	quit chan struct{}
+	cur  *metrics
+}
+
+// swapRequest hands a fresh metrics to an aggregator, which replies with the
+// one it was filling.
+type swapRequest struct {
+	next  *metrics
+	reply chan *metrics
+}
+
+// aggregatorPool shards buckets by hash over 'aggregators' goroutines, so the
+// aggregation is not capped by a single monitor goroutine. Every bucket is
+// always aggregated by the same shard, which keeps relative gauges in order.
+type aggregatorPool struct {
+	shards []*aggregator
+	quit   chan struct{}
+	// limiter - cardinality limiter of the current interval, nil without
+	// limits. Points are admitted before they are sharded, so points folded
+	// into an overflow bucket go to the shard of that bucket.
+	limiter atomic.Pointer[cardinalityLimiter]
+}
+
+// shards - nil with one aggregator, packets then go through In to monitor
+var shards *aggregatorPool
+
+func newAggregatorPool(n int) *aggregatorPool {
+	p := &aggregatorPool{shards: make([]*aggregator, n), quit: make(chan struct{})}
+	p.limiter.Store(newCardinalityLimiter(Config.CfgCardinality))
+	cur := p.newMetrics()
+	for i := range p.shards {
+		p.shards[i] = &aggregator{
+			in:   make(chan *Packet, maxUnprocessedPackets/n),
+			swap: make(chan swapRequest, 1),
+			quit: p.quit,
+			cur:  cur[i],
+		}
+	}
+	return p
+}
+
+// newMetrics returns a metrics per shard, without limiters: the pool admits
+// the points, limits apply to all buckets not to the buckets of a shard.
+func (p *aggregatorPool) newMetrics() []*metrics {
+	ms := make([]*metrics, len(p.shards))
+	for i := range ms {
+		ms[i] = newMetrics()
+		ms[i].limiter = nil
+	}
+	return ms
+}
+
+func (p *aggregatorPool) start() {
+	for _, a := range p.shards {
+		go a.run()
+	}
+}
+
+// stop ends the aggregator goroutines, packets still queued are dropped.
+func (p *aggregatorPool) stop() {
+	close(p.quit)
+}
+
+func (a *aggregator) run() {
+	for {
+		select {
+		case s := <-a.in:
+			a.cur.handlePacket(s)
+		case req := <-a.swap:
+			// packets queued before the flush belong to this interval
+			for n := len(a.in); n > 0; n-- {
+				a.cur.handlePacket(<-a.in)
+			}
+			old := a.cur
+			a.cur = req.next
+			req.reply <- old
+		case <-a.quit:
+			return
+		}
+	}
+}
+
+// deliver sends a packet to the shard of its bucket, the overflow bucket
+// for points over a cardinality limit.
+func (p *aggregatorPool) deliver(s *Packet) {
+	if l := p.limiter.Load(); l != nil {
+		bucket, ok := l.admit(s.Bucket)
+		if !ok {
+			// counted like the points handlePacket drops
+			Stat.PointsReceivedInc()
+			return
+		}
+		s.Bucket = bucket
+	}
+	p.shards[bucketShard(s.Bucket, len(p.shards))].in <- s
+}
+
+// flush swaps fresh metrics into all shards and merges the previous ones into
+// a single metrics for submit. The requests go out to all shards first, so
+// they drain their queues and swap at the same time.
+func (p *aggregatorPool) flush() *metrics {
+	limiter := p.limiter.Swap(newCardinalityLimiter(Config.CfgCardinality))
+	next := p.newMetrics()
+	replies := make([]chan *metrics, len(p.shards))
+	for i, a := range p.shards {
+		replies[i] = make(chan *metrics, 1)
+		// never blocks, flush is the only sender and waits for the reply
+		a.swap <- swapRequest{next: next[i], reply: replies[i]}
+	}
+	mx := <-replies[0]
+	for _, r := range replies[1:] {
+		mx.merge(<-r)
+	}
+	mx.limiter = limiter
+	return mx
+}
+
+// queueLen - the longest of the shard queues
+func (p *aggregatorPool) queueLen() int {
+	n := 0
+	for _, a := range p.shards {
+		n = max(n, len(a.in))
+	}
+	return n
+}
+
+// bucketShard - FNV-1a of the bucket name modulo n
+func bucketShard(bucket string, n int) int {
+	h := uint32(2166136261)
+	for i := 0; i < len(bucket); i++ {
+		h ^= uint32(bucket[i])
+		h *= 16777619
+	}
+	return int(h % uint32(n))
+}
+
+// deliverPacket - where listeners send parsed packets
+func deliverPacket(s *Packet) {
+	if shards != nil {
+		shards.deliver(s)
+		return
+	}
+	In <- s
+}
+
+// merge adds the metrics of o, of another shard. Shards hold distinct buckets,
+// overflow buckets included as the pool folds points before sharding them, so
+// no gauge is set by two shards.
+func (mx *metrics) merge(o *metrics) {
+	for k, v := range o.counters {
+		mx.counters[k] += v
+	}
+	for k, v := range o.gauges {
+		mx.gauges[k] = v
+	}
+	for k, v := range o.timers {
+		mx.timers[k] = append(mx.timers[k], v...)
+	}
+	for k, v := range o.timerSketches {
+		if sk, ok := mx.timerSketches[k]; ok {
+			sk.Merge(v)
+		} else {
+			mx.timerSketches[k] = v
+		}
+	}
+	for k, v := range o.histograms {
+		mx.histograms[k] = append(mx.histograms[k], v...)
+	}
+	for k, v := range o.distributions {
+		if sk, ok := mx.distributions[k]; ok {
+			sk.Merge(v)
+		} else {
+			mx.distributions[k] = v
+		}
+	}
+	for k, v := range o.sets {
+		if set, ok := mx.sets[k]; ok {
+			set.Merge(v)
+		} else {
+			mx.sets[k] = v
+		}
+	}
+	for k, v := range o.keys {
+		mx.keys[k] = append(mx.keys[k], v...)
+	}
+	for ts, counters := range o.timedCounters {
+		if mx.timedCounters[ts] == nil {
+			mx.timedCounters[ts] = counters
+			continue
+		}
+		for k, v := range counters {
+			mx.timedCounters[ts][k] += v
+		}
+	}
+	for ts, gauges := range o.timedGauges {
+		if mx.timedGauges[ts] == nil {
+			mx.timedGauges[ts] = gauges
+			continue
+		}
+		for k, v := range gauges {
+			mx.timedGauges[ts][k] = v
+		}
+	}
+}
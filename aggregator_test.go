@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestAggregatorPool(t *testing.T) {
+	p := newAggregatorPool(4)
+	p.start()
+	defer p.stop()
+
+	for i := 0; i < 100; i++ {
+		bucket := fmt.Sprintf("pool.c%d", i%10)
+		p.deliver(&Packet{Bucket: bucket, Value: int64(1), Modifier: "c", Sampling: 1})
+		p.deliver(&Packet{Bucket: "pool.timer", Value: float64(i), Modifier: "ms", Sampling: 1})
+		p.deliver(&Packet{Bucket: "pool.set", Value: fmt.Sprint(i % 7), Modifier: "s", Sampling: 1})
+		p.deliver(&Packet{Bucket: "pool.gauge", Value: GaugeData{true, false, 1}, Modifier: "g", Sampling: 1})
+	}
+
+	mx := p.flush()
+	assert.Equal(t, len(mx.counters), 10)
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, mx.counters[fmt.Sprintf("pool.c%d", i)], int64(10))
+	}
+	assert.Equal(t, len(mx.timers["pool.timer"]), 100)
+	assert.Equal(t, mx.sets["pool.set"].Count(), uint64(7))
+	assert.Equal(t, mx.gauges["pool.gauge"], float64(100))
+
+	// the next interval starts empty
+	p.deliver(&Packet{Bucket: "pool.c0", Value: int64(5), Modifier: "c", Sampling: 1})
+	mx = p.flush()
+	assert.Equal(t, len(mx.counters), 1)
+	assert.Equal(t, mx.counters["pool.c0"], int64(5))
+}
+
+func TestAggregatorPoolCardinality(t *testing.T) {
+	saved := Config.CfgCardinality
+	defer func() { Config.CfgCardinality = saved }()
+	Config.CfgCardinality = ConfigCardinality{MaxBuckets: 5, Overflow: true}
+
+	p := newAggregatorPool(4)
+	p.start()
+	defer p.stop()
+	for i := 0; i < 20; i++ {
+		p.deliver(&Packet{Bucket: fmt.Sprintf("card.c%d", i), Value: int64(1), Modifier: "c", Sampling: 1})
+	}
+	mx := p.flush()
+
+	// the limit is shared by all shards, folded points all go to the shard
+	// of the overflow bucket
+	assert.Equal(t, len(mx.counters), 6)
+	assert.Equal(t, mx.counters[cardinalityOverflow], int64(15))
+
+	// relative gauges folded from buckets of different shards add up in one
+	for i := 0; i < 20; i++ {
+		p.deliver(&Packet{Bucket: fmt.Sprintf("card.g%d", i), Value: GaugeData{true, false, 1}, Modifier: "g", Sampling: 1})
+	}
+	mx = p.flush()
+	assert.Equal(t, mx.gauges[cardinalityOverflow], float64(15))
+}
+
+func TestMetricsMerge(t *testing.T) {
+	a, b := newMetrics(), newMetrics()
+	a.counters["c"] = 1
+	b.counters["c"] = 2
+	b.gauges["g"] = 3
+	a.timers["t"] = Float64Slice{1}
+	b.timers["t"] = Float64Slice{2, 3}
+	a.distributions["d"] = newDDSketch(0.01)
+	a.distributions["d"].Add(1)
+	b.distributions["d"] = newDDSketch(0.01)
+	b.distributions["d"].Add(2)
+	b.keys["k"] = []string{"v"}
+
+	a.merge(b)
+	assert.Equal(t, a.counters["c"], int64(3))
+	assert.Equal(t, a.gauges["g"], float64(3))
+	assert.Equal(t, len(a.timers["t"]), 3)
+	assert.Equal(t, a.distributions["d"].count, uint64(2))
+	assert.Equal(t, a.keys["k"], []string{"v"})
+}
+
+// benchPackets - counters, sets with distinct members and distributions over
+// many buckets, so aggregating a packet costs more than queueing it
+func benchPackets() []*Packet {
+	packets := make([]*Packet, 10000)
+	for i := range packets {
+		switch i % 3 {
+		case 0:
+			packets[i] = &Packet{Bucket: fmt.Sprintf("bench.counter.%d", i%1000), Value: int64(1), Modifier: "c", Sampling: 1}
+		case 1:
+			packets[i] = &Packet{Bucket: fmt.Sprintf("bench.set.%d", i%100), Value: fmt.Sprint(i), Modifier: "s", Sampling: 1}
+		default:
+			packets[i] = &Packet{Bucket: fmt.Sprintf("bench.dist.%d", i%1000), Value: float64(i), Modifier: "d", Sampling: 1}
+		}
+	}
+	return packets
+}
+
+// benchConfig sets the config the benchmark packets need.
+func benchConfig(b *testing.B) {
+	saved := Config
+	Config.SketchAccuracy = 0.01
+	Config.SetPrecision = 14
+	b.Cleanup(func() { Config = saved })
+}
+
+// BenchmarkAggregateMonitor - parallel listeners feeding the single monitor
+// goroutine through one channel. The time includes aggregating every packet.
+func BenchmarkAggregateMonitor(b *testing.B) {
+	benchConfig(b)
+	packets := benchPackets()
+	in := make(chan *Packet, maxUnprocessedPackets)
+	done := make(chan struct{})
+	mx := newMetrics()
+	go func() {
+		for s := range in {
+			mx.handlePacket(s)
+		}
+		close(done)
+	}()
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			in <- packets[i%len(packets)]
+			i++
+		}
+	})
+	close(in)
+	<-done
+}
+
+// BenchmarkAggregateShards - parallel listeners feeding sharded aggregators.
+// The flush waits until every queued packet is aggregated, so the time is
+// bound by the aggregation and drops with more shards, up to GOMAXPROCS.
+func BenchmarkAggregateShards(b *testing.B) {
+	benchConfig(b)
+	packets := benchPackets()
+	for _, n := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("aggregators=%d", n), func(b *testing.B) {
+			p := newAggregatorPool(n)
+			p.start()
+			defer p.stop()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					p.deliver(packets[i%len(packets)])
+					i++
+				}
+			})
+			p.flush()
+		})
+	}
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"fmt"
+	"net/http"
 	"os"
 	"time"
 )
@@ -25,16 +26,21 @@ func (b extCmdBackend) Send(buf *bytes.Buffer, _ time.Time) error {
 	return sendDataExtCmd(b.cmd, buf)
 }
 
-type graphiteBackend struct{ cfg ConfigApp }
+// graphiteBackend keeps its relay connections open across flushes. It speaks
+// either the plaintext or the pickle protocol.
+type graphiteBackend struct{ client *graphiteClient }
 
 func (b graphiteBackend) Send(buf *bytes.Buffer, deadline time.Time) error {
-	return graphite(b.cfg, deadline, buf)
+	return b.client.Send(buf, deadline)
 }
 
-type opentsdbBackend struct{ cfg ConfigApp }
+type opentsdbBackend struct {
+	cfg    ConfigApp
+	client *http.Client
+}
 
-func (b opentsdbBackend) Send(buf *bytes.Buffer, _ time.Time) error {
-	return openTSDB(b.cfg, buf)
+func (b opentsdbBackend) Send(buf *bytes.Buffer, deadline time.Time) error {
+	return openTSDB(b.cfg, b.client, buf, deadline)
 }
 
 type fileBackend struct{ f *os.File }
@@ -43,24 +49,110 @@ func (b fileBackend) Send(buf *bytes.Buffer, _ time.Time) error {
 	return sendDataToFile(b.f, buf)
 }
 
+// namedBackend is one entry of the configured backend list together with the
+// output format its batches are serialized in.
+type namedBackend struct {
+	Name    string
+	Format  string
+	Backend Backend
+	// spool is nil when the retry spool is disabled
+	spool *backendSpool
+}
+
+// validBackend reports whether name is a known backend type.
+func validBackend(name string) bool {
+	switch name {
+	case "external", "graphite", "graphite-pickle", "opentsdb", "influxdb", "prometheus", "file", "dummy":
+		return true
+	}
+	return false
+}
+
+// backendFormat returns the output format used for the backend name. Backends
+// sharing a format share one serialized buffer per flush.
+func backendFormat(cfg ConfigApp, name string) string {
+	switch name {
+	case "graphite":
+		return graphiteFormat(cfg.CfgGraphiteBackend)
+	case "graphite-pickle":
+		return graphiteFormat(cfg.CfgGraphitePickleBackend)
+	case "influxdb":
+		return "influxdb"
+	case "opentsdb":
+		if cfg.CfgOpenTSDBBackend.Transport == opentsdbTransportTelnet {
+			return "opentsdb-telnet"
+		}
+		return "opentsdb"
+	case "prometheus":
+		return "typed"
+	default:
+		return "external"
+	}
+}
+
+// graphiteFormat - tags in the metric path or as Graphite 1.1 tagged series
+func graphiteFormat(gcfg ConfigGraphiteBackend) string {
+	if gcfg.TagFormat == graphiteTagFormatNative {
+		return "graphite-tagged"
+	}
+	return "graphite"
+}
+
 // selectBackend returns the Backend for the configured backend-type.
 // A nil Backend with a nil error means the no-op ("dummy") backend.
 func selectBackend(cfg ConfigApp) (Backend, error) {
-	switch cfg.BackendType {
+	return newBackend(cfg, cfg.BackendType)
+}
+
+// newBackend instantiates the backend called name.
+// A nil Backend with a nil error means the no-op ("dummy") backend.
+func newBackend(cfg ConfigApp, name string) (Backend, error) {
+	switch name {
 	case "external":
 		if cfg.PostFlushCmd != "stdout" {
 			return extCmdBackend{cmd: cfg.ParsedPostFlushCmd}, nil
 		}
 		return stdoutBackend{}, nil
 	case "graphite":
-		return graphiteBackend{cfg: cfg}, nil
+		return graphiteBackend{client: newGraphiteClient(cfg.GraphiteAddress, cfg.CfgGraphiteBackend, false)}, nil
+	case "graphite-pickle":
+		return graphiteBackend{client: newGraphiteClient(cfg.GraphitePickleAddress, cfg.CfgGraphitePickleBackend, true)}, nil
 	case "opentsdb":
-		return opentsdbBackend{cfg: cfg}, nil
+		if cfg.CfgOpenTSDBBackend.Transport == opentsdbTransportTelnet {
+			return newOpenTSDBTelnetBackend(cfg.OpenTSDBAddress, cfg.CfgOpenTSDBBackend), nil
+		}
+		return opentsdbBackend{cfg: cfg, client: &http.Client{}}, nil
+	case "influxdb":
+		return newInfluxDBBackend(cfg.CfgInfluxDBBackend), nil
+	case "prometheus":
+		return newPrometheusBackend(cfg.CfgPrometheusBackend, cfg.ResetCounters), nil
 	case "file":
 		return fileBackend{f: cfg.CfgFileBackend.LogFile}, nil
 	case "dummy":
 		return nil, nil
 	default:
-		return nil, fmt.Errorf("invalid backend `%s`", cfg.BackendType)
+		return nil, fmt.Errorf("invalid backend `%s`", name)
+	}
+}
+
+// selectBackends instantiates every backend from the configured backend list
+// (or the single backend-type when the list is empty). Dummy backends are
+// skipped, so the result may be empty.
+func selectBackends(cfg ConfigApp) ([]namedBackend, error) {
+	var out []namedBackend
+	for _, name := range cfg.backendNames() {
+		b, err := newBackend(cfg, name)
+		if err != nil {
+			return nil, err
+		}
+		if b == nil { // dummy
+			continue
+		}
+		nb := namedBackend{Name: name, Format: backendFormat(cfg, name), Backend: b}
+		if cfg.CfgSpool.Enabled {
+			nb.spool = newBackendSpool(name)
+		}
+		out = append(out, nb)
 	}
+	return out, nil
 }
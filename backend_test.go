@@ -1,8 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestSelectBackend(t *testing.T) {
@@ -15,7 +19,10 @@ func TestSelectBackend(t *testing.T) {
 		{name: "stdout", cfg: ConfigApp{BackendType: "external", PostFlushCmd: "stdout"}, wantType: "main.stdoutBackend"},
 		{name: "extcmd", cfg: ConfigApp{BackendType: "external", PostFlushCmd: "/bin/cat"}, wantType: "main.extCmdBackend"},
 		{name: "graphite", cfg: ConfigApp{BackendType: "graphite"}, wantType: "main.graphiteBackend"},
+		{name: "graphite-pickle", cfg: ConfigApp{BackendType: "graphite-pickle"}, wantType: "main.graphiteBackend"},
 		{name: "opentsdb", cfg: ConfigApp{BackendType: "opentsdb"}, wantType: "main.opentsdbBackend"},
+		{name: "opentsdb-telnet", cfg: ConfigApp{BackendType: "opentsdb", CfgOpenTSDBBackend: ConfigOpenTSDBBackend{Transport: "telnet"}}, wantType: "*main.opentsdbTelnetBackend"},
+		{name: "prometheus", cfg: ConfigApp{BackendType: "prometheus"}, wantType: "*main.prometheusBackend"},
 		{name: "file", cfg: ConfigApp{BackendType: "file"}, wantType: "main.fileBackend"},
 		{name: "dummy", cfg: ConfigApp{BackendType: "dummy"}, wantType: "<nil>"},
 		{name: "invalid", cfg: ConfigApp{BackendType: "nope"}, wantErr: true},
@@ -38,3 +45,103 @@ func TestSelectBackend(t *testing.T) {
 		})
 	}
 }
+
+func TestSelectBackends(t *testing.T) {
+	cfg := ConfigApp{BackendType: "graphite", Backends: []string{"graphite", "dummy", "opentsdb"}}
+	got, err := selectBackends(cfg)
+	if err != nil {
+		t.Fatalf("selectBackends unexpected error: %v", err)
+	}
+	// dummy is a no-op and must be skipped
+	if len(got) != 2 {
+		t.Fatalf("selectBackends returned %d backends, want 2", len(got))
+	}
+	if got[0].Name != "graphite" || got[0].Format != "graphite" {
+		t.Errorf("backend[0] = %s/%s, want graphite/graphite", got[0].Name, got[0].Format)
+	}
+	if got[1].Name != "opentsdb" || got[1].Format != "opentsdb" {
+		t.Errorf("backend[1] = %s/%s, want opentsdb/opentsdb", got[1].Name, got[1].Format)
+	}
+
+	// empty list falls back to backend-type
+	got, err = selectBackends(ConfigApp{BackendType: "file"})
+	if err != nil || len(got) != 1 || got[0].Name != "file" {
+		t.Errorf("selectBackends(backend-type only) = %v, %v; want single file backend", got, err)
+	}
+
+	if _, err := selectBackends(ConfigApp{Backends: []string{"graphite", "nope"}}); err == nil {
+		t.Error("selectBackends with invalid entry expected error")
+	}
+}
+
+// recordBackend remembers the last batch it was sent and optionally fails.
+type recordBackend struct {
+	mu   sync.Mutex
+	got  string
+	fail bool
+}
+
+func (b *recordBackend) Send(buf *bytes.Buffer, _ time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.got = buf.String()
+	if b.fail {
+		return errors.New("backend down")
+	}
+	return nil
+}
+
+func TestSendToBackendsIndependent(t *testing.T) {
+	Config.ExtraTagsHash = map[string]string{}
+	failing := &recordBackend{fail: true}
+	plain := &recordBackend{}
+	graphiteFmt := &recordBackend{}
+	backends := []namedBackend{
+		{Name: "file", Format: "external", Backend: failing},
+		{Name: "opentsdb", Format: "external", Backend: plain},
+		{Name: "graphite", Format: "graphite", Backend: graphiteFmt},
+	}
+
+	Stat.ProcessStats(packetCache, nameCache) // drain counters from other tests
+	out := flushOutput{{Kind: kindCounter, Name: "m.count", Tags: map[string]string{"host": "web1"}, Value: int64(5), When: 1700000000}}
+	sendToBackends(backends, out, time.Now().Add(time.Second))
+
+	if plain.got != "m.count 5 1700000000 host=web1\n" {
+		t.Errorf("external backend got %q", plain.got)
+	}
+	if graphiteFmt.got != "m.count._t_.host.web1 5 1700000000\n" {
+		t.Errorf("graphite backend got %q", graphiteFmt.got)
+	}
+
+	Stat.ProcessStats(packetCache, nameCache)
+	if s := Stat.savedBackendStat["file"]; s.BatchesTransmitFail != 1 || s.BatchesTransmitted != 0 {
+		t.Errorf("file backend stat = %+v, want 1 failure", s)
+	}
+	for _, name := range []string{"opentsdb", "graphite"} {
+		if s := Stat.savedBackendStat[name]; s.BatchesTransmitted != 1 || s.BatchesTransmitFail != 0 {
+			t.Errorf("%s backend stat = %+v, want 1 transmitted", name, s)
+		}
+	}
+	if Stat.savedStat.BatchesTransmitted != 2 || Stat.savedStat.BatchesTransmitFail != 1 {
+		t.Errorf("global batch stats = %d/%d, want 2/1", Stat.savedStat.BatchesTransmitted, Stat.savedStat.BatchesTransmitFail)
+	}
+}
+
+func TestBackendFormat(t *testing.T) {
+	cfg := ConfigApp{}
+	cfg.CfgGraphiteBackend.TagFormat = graphiteTagFormatNative
+	cfg.CfgGraphitePickleBackend.TagFormat = graphiteTagFormatPath
+
+	tests := map[string]string{
+		"graphite":        "graphite-tagged",
+		"graphite-pickle": "graphite",
+		"file":            "external",
+		"opentsdb":        "opentsdb",
+		"prometheus":      "typed",
+	}
+	for name, want := range tests {
+		if got := backendFormat(cfg, name); got != want {
+			t.Errorf("backendFormat(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
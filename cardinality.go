@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// series over a cardinality limit are folded into buckets (or tag values)
+// with this name when overflow is enabled
+const cardinalityOverflow = "__overflow__"
+
+// at most this many offenders are tracked per flush interval
+const maxCardinalityOffenders = 1000
+
+const defaultCardinalityTopOffenders = 10
+
+// ConfigCardinality - limits of distinct buckets in one flush interval. New
+// buckets over a limit are dropped or, with Overflow, folded into
+// __overflow__. 0 - no limit.
+type ConfigCardinality struct {
+	// MaxBuckets - distinct buckets of all metrics
+	MaxBuckets int `yaml:"max-buckets"`
+	// Prefixes - distinct buckets starting with a prefix (the first matching
+	// one, the bucket name includes the global prefix)
+	Prefixes []ConfigCardinalityPrefix `yaml:"prefixes"`
+	// TagKeys - distinct values of a tag, eg. to stop request ids in tags
+	TagKeys []ConfigCardinalityTag `yaml:"tag-keys"`
+	// Overflow - over the limit buckets are folded into <prefix>.__overflow__
+	// (or __overflow__ for max-buckets) without tags, values of tags into
+	// <key>=__overflow__, instead of being dropped
+	Overflow bool `yaml:"overflow"`
+	// TopOffenders - number of names logged at flush with the most points
+	// over a limit
+	TopOffenders int `yaml:"top-offenders"`
+}
+
+// ConfigCardinalityPrefix - limit of distinct buckets starting with Prefix.
+type ConfigCardinalityPrefix struct {
+	Prefix     string `yaml:"prefix"`
+	MaxBuckets int    `yaml:"max-buckets"`
+}
+
+// ConfigCardinalityTag - limit of distinct values of the tag Key.
+type ConfigCardinalityTag struct {
+	Key       string `yaml:"key"`
+	MaxValues int    `yaml:"max-values"`
+}
+
+// enabled reports whether any limit is set.
+func (c ConfigCardinality) enabled() bool {
+	if c.MaxBuckets > 0 {
+		return true
+	}
+	for _, p := range c.Prefixes {
+		if p.MaxBuckets > 0 {
+			return true
+		}
+	}
+	for _, t := range c.TagKeys {
+		if t.MaxValues > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func validateCardinality(c ConfigCardinality) error {
+	if c.MaxBuckets < 0 || c.TopOffenders < 0 {
+		return fmt.Errorf("Parameter error: cardinality limits can't be negative")
+	}
+	for _, p := range c.Prefixes {
+		if len(p.Prefix) == 0 || p.MaxBuckets < 0 {
+			return fmt.Errorf("Parameter error: cardinality prefixes need a prefix and a non negative max-buckets")
+		}
+	}
+	for _, t := range c.TagKeys {
+		if len(t.Key) == 0 || t.MaxValues < 0 {
+			return fmt.Errorf("Parameter error: cardinality tag-keys need a key and a non negative max-values")
+		}
+	}
+	return nil
+}
+
+// cardinalityLimiter admits the buckets of one flush interval. Only admitted
+// buckets are remembered, so series over a limit cost a parse per point but no
+// memory. The aggregator shards share one limiter, points of admitted buckets
+// don't take its lock.
+type cardinalityLimiter struct {
+	// seen - admitted buckets, with the (folded) bucket to aggregate in; read
+	// without mu, stored with it
+	seen sync.Map
+
+	mu            sync.Mutex
+	cfg           ConfigCardinality
+	buckets       int
+	prefixBuckets map[string]int
+	tagValues     map[string]map[string]struct{}
+	// offenders - points over a limit by name
+	offenders map[string]int64
+}
+
+// newCardinalityLimiter returns nil when no limit is set.
+func newCardinalityLimiter(cfg ConfigCardinality) *cardinalityLimiter {
+	if !cfg.enabled() {
+		return nil
+	}
+	return &cardinalityLimiter{
+		cfg:           cfg,
+		prefixBuckets: make(map[string]int),
+		tagValues:     make(map[string]map[string]struct{}),
+		offenders:     make(map[string]int64),
+	}
+}
+
+// admit returns the bucket a point of bucket is aggregated in, false when the
+// point is dropped.
+func (l *cardinalityLimiter) admit(bucket string) (string, bool) {
+	if b, ok := l.seen.Load(bucket); ok {
+		return b.(string), true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// admitted by another shard meanwhile
+	if b, ok := l.seen.Load(bucket); ok {
+		return b.(string), true
+	}
+
+	name, tags, err := parseBucketAndTags(bucket)
+	if err != nil {
+		// already reported when the packet was parsed
+		return bucket, true
+	}
+
+	final := bucket
+	folded := false
+	var offender string
+
+	// tag values
+	for _, t := range l.cfg.TagKeys {
+		v, ok := tags[t.Key]
+		if !ok || t.MaxValues <= 0 {
+			continue
+		}
+		if _, ok := l.tagValues[t.Key][v]; ok || len(l.tagValues[t.Key]) < t.MaxValues {
+			continue
+		}
+		offender = name + " " + t.Key
+		if !l.cfg.Overflow {
+			return l.reject(offender)
+		}
+		tags[t.Key] = cardinalityOverflow
+		folded = true
+	}
+	if folded {
+		final = makeBucket(name, tags)
+		if b, ok := l.seen.Load(final); ok {
+			return l.fold(b.(string), offender)
+		}
+	}
+
+	// buckets by prefix, then of all metrics
+	if !folded {
+		offender = offenderName(name)
+	}
+	var prefix *ConfigCardinalityPrefix
+	for i, p := range l.cfg.Prefixes {
+		if strings.HasPrefix(name, p.Prefix) {
+			prefix = &l.cfg.Prefixes[i]
+			break
+		}
+	}
+	if prefix != nil && prefix.MaxBuckets > 0 && l.prefixBuckets[prefix.Prefix] >= prefix.MaxBuckets {
+		if !l.cfg.Overflow {
+			return l.reject(offender)
+		}
+		return l.fold(makeBucket(strings.TrimSuffix(prefix.Prefix, ".")+"."+cardinalityOverflow, Config.ExtraTagsHash), offender)
+	}
+	if l.cfg.MaxBuckets > 0 && l.buckets >= l.cfg.MaxBuckets {
+		if !l.cfg.Overflow {
+			return l.reject(offender)
+		}
+		return l.fold(makeBucket(cardinalityOverflow, Config.ExtraTagsHash), offender)
+	}
+	if prefix != nil {
+		l.prefixBuckets[prefix.Prefix]++
+	}
+	l.buckets++
+
+	for _, t := range l.cfg.TagKeys {
+		if v, ok := tags[t.Key]; ok && v != cardinalityOverflow {
+			if l.tagValues[t.Key] == nil {
+				l.tagValues[t.Key] = make(map[string]struct{})
+			}
+			l.tagValues[t.Key][v] = struct{}{}
+		}
+	}
+	l.seen.Store(final, final)
+	if !folded {
+		l.seen.Store(bucket, final)
+	}
+	if folded {
+		Stat.CardinalityOverflowedInc()
+		l.offend(offender)
+	}
+	return final, true
+}
+
+// reject drops a point over a limit.
+func (l *cardinalityLimiter) reject(offender string) (string, bool) {
+	Stat.CardinalityDroppedInc()
+	l.offend(offender)
+	return "", false
+}
+
+// fold aggregates a point over a limit in the overflow bucket, which is never
+// limited itself.
+func (l *cardinalityLimiter) fold(bucket, offender string) (string, bool) {
+	l.seen.Store(bucket, bucket)
+	Stat.CardinalityOverflowedInc()
+	l.offend(offender)
+	return bucket, true
+}
+
+func (l *cardinalityLimiter) offend(offender string) {
+	if _, ok := l.offenders[offender]; ok || len(l.offenders) < maxCardinalityOffenders {
+		l.offenders[offender]++
+	}
+}
+
+// logOffenders logs the names with the most points over a limit in this
+// interval.
+func (l *cardinalityLimiter) logOffenders() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.offenders) == 0 || l.cfg.TopOffenders == 0 {
+		return
+	}
+	names := make([]string, 0, len(l.offenders))
+	var total int64
+	for name, n := range l.offenders {
+		names = append(names, name)
+		total += n
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if l.offenders[names[i]] != l.offenders[names[j]] {
+			return l.offenders[names[i]] > l.offenders[names[j]]
+		}
+		return names[i] < names[j]
+	})
+	if len(names) > l.cfg.TopOffenders {
+		names = names[:l.cfg.TopOffenders]
+	}
+	top := make([]string, len(names))
+	for i, name := range names {
+		top[i] = fmt.Sprintf("%s (%d)", name, l.offenders[name])
+	}
+	log.WithFields(log.Fields{
+		"in": "cardinalityLimiter",
+	}).Warnf("%d points over cardinality limits, top offenders: %s", total, strings.Join(top, ", "))
+}
+
+// offenderName - the first two segments of a bucket name, series over a limit
+// usually differ in later ones (eg. api.req.<request id>.time)
+func offenderName(name string) string {
+	if i := strings.IndexByte(name, '.'); i >= 0 {
+		if j := strings.IndexByte(name[i+1:], '.'); j >= 0 {
+			return name[:i+1+j]
+		}
+	}
+	return name
+}
+
+// makeBucket joins a bucket name and tags as parseLine does.
+func makeBucket(name string, tags map[string]string) string {
+	if len(tags) == 0 {
+		return name
+	}
+	firstDelim, _, _ := tagsDelims(tfDefault)
+	return name + firstDelim + normalizeTags(tags, tfDefault)
+}
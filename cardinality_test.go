@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestCardinalityLimiter(t *testing.T) {
+	Config.ExtraTagsHash = map[string]string{}
+	cfg := ConfigCardinality{
+		MaxBuckets: 6,
+		Prefixes:   []ConfigCardinalityPrefix{{Prefix: "api.", MaxBuckets: 2}},
+		TagKeys:    []ConfigCardinalityTag{{Key: "req", MaxValues: 1}},
+	}
+
+	tests := []struct {
+		bucket string
+		want   string // "" - dropped
+		folded string // with overflow
+	}{
+		{"api.a", "api.a", "api.a"},
+		{"api.b", "api.b", "api.b"},
+		{"api.a", "api.a", "api.a"},
+		{"api.c", "", "api.__overflow__"},
+		{"db.q.^req=1", "db.q.^req=1", "db.q.^req=1"},
+		{"db.q.^req=2", "", "db.q.^req=__overflow__"},
+		{"db.q.^req=3", "", "db.q.^req=__overflow__"},
+		{"web.1", "web.1", "web.1"},
+		{"web.2", "web.2", "web.2"},
+		// db.q.^req=__overflow__ took a bucket in the overflow run
+		{"web.3", "web.3", "__overflow__"},
+		{"web.4", "", "__overflow__"},
+		{"web.1", "web.1", "web.1"},
+	}
+	for _, overflow := range []bool{false, true} {
+		cfg.Overflow = overflow
+		l := newCardinalityLimiter(cfg)
+		Stat.ProcessStats(packetCache, nameCache) // drain counters from other tests
+		for _, tt := range tests {
+			want := tt.want
+			if overflow {
+				want = tt.folded
+			}
+			got, ok := l.admit(tt.bucket)
+			assert.Equal(t, want != "", ok, tt.bucket)
+			if ok {
+				assert.Equal(t, want, got, tt.bucket)
+			}
+		}
+		Stat.ProcessStats(packetCache, nameCache)
+		if overflow {
+			assert.Equal(t, int64(0), Stat.savedStat.CardinalityDropped)
+			assert.Equal(t, int64(5), Stat.savedStat.CardinalityOverflowed)
+		} else {
+			assert.Equal(t, int64(4), Stat.savedStat.CardinalityDropped)
+			assert.Equal(t, int64(0), Stat.savedStat.CardinalityOverflowed)
+		}
+		assert.Equal(t, int64(1), l.offenders["api.c"])
+	}
+}
+
+func TestCardinalityLimiterDisabled(t *testing.T) {
+	assert.Equal(t, (*cardinalityLimiter)(nil), newCardinalityLimiter(ConfigCardinality{TopOffenders: 10}))
+	// no limiter, no offenders to log
+	var l *cardinalityLimiter
+	l.logOffenders()
+}
+
+func TestHandlePacketCardinality(t *testing.T) {
+	Config.CfgCardinality = ConfigCardinality{MaxBuckets: 10, Overflow: true}
+	defer func() { Config.CfgCardinality = ConfigCardinality{} }()
+
+	mx := newMetrics()
+	for i := 0; i < 100; i++ {
+		mx.handlePacket(&Packet{Bucket: fmt.Sprintf("req.%d.calls", i), Value: int64(1), Modifier: "c", Sampling: 1})
+	}
+	assert.Equal(t, 11, len(mx.counters))
+	assert.Equal(t, int64(90), mx.counters["__overflow__"])
+	assert.Equal(t, 90, len(mx.limiter.offenders))
+	assert.Equal(t, int64(1), mx.limiter.offenders["req.99"])
+}
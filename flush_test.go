@@ -22,11 +22,11 @@ func TestFlushHandoffRace(t *testing.T) {
 			var buf bytes.Buffer
 			now := job.deadline.Unix()
 			// reset=true + nil db: persistence path is skipped in reset mode.
-			job.m.processCounters(&buf, now, true, "dummy", nil)
-			job.m.processGauges(&buf, now, "dummy")
-			job.m.processTimers(&buf, now, Percentiles{}, "dummy")
-			job.m.processSets(&buf, now, "dummy")
-			job.m.processKeyValue(&buf, now, "dummy")
+			job.m.processCounters(textWriter{&buf, "dummy"}, now, true, nil)
+			job.m.processGauges(textWriter{&buf, "dummy"}, now)
+			job.m.processTimers(textWriter{&buf, "dummy"}, now, Percentiles{})
+			job.m.processSets(textWriter{&buf, "dummy"}, now)
+			job.m.processKeyValue(textWriter{&buf, "dummy"}, now)
 		}
 		close(done)
 	}()
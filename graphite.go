@@ -2,27 +2,292 @@ package main
 
 import (
 	"bytes"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"net"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
+
+	log "github.com/sirupsen/logrus"
 )
 
-func graphite(config ConfigApp, deadline time.Time, buffer *bytes.Buffer) error {
-	client, err := net.Dial("tcp", config.GraphiteAddress)
-	if err != nil {
-		return fmt.Errorf("dialing %s failed - %s", config.GraphiteAddress, err)
+// graphite relay selection modes
+const (
+	graphiteModeFailover = "failover"
+	graphiteModeHash     = "hash"
+)
+
+// graphite tag formats
+const (
+	graphiteTagFormatPath   = "path"   // cpu.load._t_.host.h1
+	graphiteTagFormatNative = "native" // cpu.load;host=h1 (Graphite >= 1.1)
+)
+
+// number of points every relay gets on the consistent-hash ring
+const graphiteHashReplicas = 100
+
+// ConfigGraphiteBackend - graphite backend config.
+type ConfigGraphiteBackend struct {
+	// Relays - carbon relays; when empty the 'graphite' address is used
+	Relays []string `yaml:"relays"`
+	// Mode - failover (first healthy relay gets everything) or hash
+	// (metrics are sharded between relays by consistent hashing of the path,
+	// the shard of a relay that is down goes to the next healthy one)
+	Mode string `yaml:"mode"`
+	// ChunkSize - max bytes per write, chunks are split on line boundaries
+	// (plaintext protocol)
+	ChunkSize int `yaml:"chunk-size"`
+	// MaxBatchSize - max datapoints per pickled message (pickle protocol)
+	MaxBatchSize int `yaml:"max-batch-size"`
+	// TagFormat - path (tags encoded in the metric path) or native
+	// (Graphite 1.1 tagged series: name;tag=value)
+	TagFormat string `yaml:"tag-format"`
+	// reconnect backoff in seconds, doubled after each failed dial
+	ReconnectBackoff    int64 `yaml:"reconnect-backoff"`
+	MaxReconnectBackoff int64 `yaml:"max-reconnect-backoff"`
+}
+
+// graphiteConn is a long-lived connection to a single carbon relay.
+type graphiteConn struct {
+	addr       string
+	conn       net.Conn
+	backoff    time.Duration
+	nextDial   time.Time
+	minBackoff time.Duration
+	maxBackoff time.Duration
+}
+
+// graphiteClient keeps connections to carbon relays open across flushes.
+// Batches are written as units: line-aligned chunks for the plaintext
+// protocol or length-prefixed pickle messages for the pickle protocol.
+type graphiteClient struct {
+	mu           sync.Mutex
+	mode         string
+	pickle       bool
+	chunkSize    int
+	maxBatchSize int
+	relays       []*graphiteConn
+	ring         []graphiteRingPoint
+}
+
+type graphiteRingPoint struct {
+	hash  uint32
+	relay int
+}
+
+// newGraphiteClient creates a client for the relays in gcfg, or address when
+// no relays are configured.
+func newGraphiteClient(address string, gcfg ConfigGraphiteBackend, pickle bool) *graphiteClient {
+	addrs := gcfg.Relays
+	if len(addrs) == 0 {
+		addrs = []string{address}
 	}
-	defer client.Close()
 
-	err = client.SetDeadline(deadline)
-	if err != nil {
-		return err
+	c := &graphiteClient{mode: gcfg.Mode, pickle: pickle, chunkSize: gcfg.ChunkSize, maxBatchSize: gcfg.MaxBatchSize}
+	if c.mode == "" {
+		c.mode = graphiteModeFailover
+	}
+	if c.chunkSize <= 0 {
+		c.chunkSize = defaultGraphiteChunkSize
+	}
+	if c.maxBatchSize <= 0 {
+		c.maxBatchSize = defaultGraphitePickleMaxBatchSize
+	}
+	for i, addr := range addrs {
+		c.relays = append(c.relays, &graphiteConn{
+			addr:       addr,
+			minBackoff: time.Duration(gcfg.ReconnectBackoff) * time.Second,
+			maxBackoff: time.Duration(gcfg.MaxReconnectBackoff) * time.Second,
+		})
+		for r := 0; r < graphiteHashReplicas; r++ {
+			c.ring = append(c.ring, graphiteRingPoint{hash: crc32.ChecksumIEEE([]byte(addr + ":" + strconv.Itoa(r))), relay: i})
+		}
+	}
+	sort.Slice(c.ring, func(i, j int) bool { return c.ring[i].hash < c.ring[j].hash })
+	return c
+}
+
+// Send writes the batch (graphite plaintext lines) to the relays according
+// to the configured mode. In hash mode the shard of a relay that is down is
+// failed over to the following relays, so the batch fails only when a shard
+// could not be written anywhere.
+func (c *graphiteClient) Send(buffer *bytes.Buffer, deadline time.Time) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.mode == graphiteModeHash && len(c.relays) > 1 {
+		var errs []error
+		for i, shard := range c.shard(buffer.Bytes()) {
+			if len(shard) == 0 {
+				continue
+			}
+			if err := c.sendFrom(i, c.units(shard), deadline); err != nil {
+				errs = append(errs, err)
+			}
+		}
+		return errors.Join(errs...)
 	}
 
-	_, err = client.Write(buffer.Bytes())
+	return c.sendFrom(0, c.units(buffer.Bytes()), deadline)
+}
+
+// sendFrom tries the relays in order starting at first (wrapping around),
+// continuing from the first unsent unit on the next relay after a failure.
+func (c *graphiteClient) sendFrom(first int, units [][]byte, deadline time.Time) error {
+	var errs []error
+	for n := range c.relays {
+		r := c.relays[(first+n)%len(c.relays)]
+		sent, err := r.write(units, deadline)
+		if err == nil {
+			return nil
+		}
+		errs = append(errs, err)
+		units = units[sent:]
+	}
+	return fmt.Errorf("all graphite relays failed: %w", errors.Join(errs...))
+}
+
+// units splits plaintext lines into the pieces written to a relay.
+func (c *graphiteClient) units(data []byte) [][]byte {
+	if c.pickle {
+		return pickleMessages(data, c.maxBatchSize)
+	}
+	return lineChunks(data, c.chunkSize)
+}
+
+// lineChunks splits data into chunks of at most size bytes on line
+// boundaries (a single longer line makes its own chunk).
+func lineChunks(data []byte, size int) [][]byte {
+	var chunks [][]byte
+	for len(data) > 0 {
+		end := size
+		if end >= len(data) {
+			end = len(data)
+		} else if i := bytes.LastIndexByte(data[:end], '\n'); i >= 0 {
+			end = i + 1
+		} else if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			end = i + 1
+		} else {
+			end = len(data)
+		}
+		chunks = append(chunks, data[:end])
+		data = data[end:]
+	}
+	return chunks
+}
+
+// shard splits lines between relays using the consistent-hash ring.
+func (c *graphiteClient) shard(data []byte) [][]byte {
+	shards := make([][]byte, len(c.relays))
+	for len(data) > 0 {
+		line := data
+		if i := bytes.IndexByte(data, '\n'); i >= 0 {
+			line = data[:i+1]
+		}
+		data = data[len(line):]
+
+		path := line
+		if i := bytes.IndexByte(line, ' '); i >= 0 {
+			path = line[:i]
+		}
+		relay := c.relayFor(path)
+		shards[relay] = append(shards[relay], line...)
+	}
+	return shards
+}
+
+func (c *graphiteClient) relayFor(path []byte) int {
+	h := crc32.ChecksumIEEE(path)
+	i := sort.Search(len(c.ring), func(i int) bool { return c.ring[i].hash >= h })
+	if i == len(c.ring) {
+		i = 0
+	}
+	return c.ring[i].relay
+}
+
+// write sends units to the relay and returns how many were written in full,
+// so a caller can continue on another relay without resending them. A unit
+// cut by a partial write is counted as unsent and resent in full.
+func (r *graphiteConn) write(units [][]byte, deadline time.Time) (int, error) {
+	if err := r.connect(deadline); err != nil {
+		return 0, err
+	}
+	if err := r.conn.SetWriteDeadline(deadline); err != nil {
+		r.close()
+		return 0, err
+	}
+
+	for sent, unit := range units {
+		if _, err := r.conn.Write(unit); err != nil {
+			r.close()
+			Stat.GraphiteWriteFailInc()
+			return sent, fmt.Errorf("failed to write stats to graphite %s: %s", r.addr, err)
+		}
+	}
+	return len(units), nil
+}
+
+// connect makes sure the relay has an open connection, dialing it unless a
+// previous failure put it in backoff.
+func (r *graphiteConn) connect(deadline time.Time) error {
+	if r.conn != nil {
+		if r.alive() {
+			return nil
+		}
+		r.close()
+	}
+
+	now := time.Now()
+	if now.Before(r.nextDial) {
+		return fmt.Errorf("graphite %s in reconnect backoff until %s", r.addr, r.nextDial.Format(time.RFC3339))
+	}
+
+	conn, err := net.DialTimeout("tcp", r.addr, deadline.Sub(now))
 	if err != nil {
-		return fmt.Errorf("failed to write stats to graphite: %s", err)
+		if r.backoff == 0 {
+			r.backoff = r.minBackoff
+		} else {
+			r.backoff *= 2
+		}
+		if r.maxBackoff > 0 && r.backoff > r.maxBackoff {
+			r.backoff = r.maxBackoff
+		}
+		r.nextDial = now.Add(r.backoff)
+		Stat.GraphiteConnectFailInc()
+		return fmt.Errorf("dialing %s failed - %s", r.addr, err)
 	}
 
+	log.WithFields(log.Fields{
+		"in": "graphiteConn",
+	}).Infof("connected to %s", r.addr)
+	r.conn = conn
+	r.backoff = 0
+	r.nextDial = time.Time{}
+	Stat.GraphiteConnectsInc()
+	Stat.GraphiteConnectedAdd(1)
 	return nil
 }
+
+// alive detects connections closed by the relay: carbon never writes back,
+// so a short read either times out (alive) or returns EOF/error (closed).
+func (r *graphiteConn) alive() bool {
+	if err := r.conn.SetReadDeadline(time.Now().Add(time.Millisecond)); err != nil {
+		return false
+	}
+	var one [1]byte
+	_, err := r.conn.Read(one[:])
+	return err == nil || errors.Is(err, os.ErrDeadlineExceeded)
+}
+
+func (r *graphiteConn) close() {
+	if r.conn == nil {
+		return
+	}
+	r.conn.Close()
+	r.conn = nil
+	Stat.GraphiteConnectedAdd(-1)
+}
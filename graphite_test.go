@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// carbonStub is a minimal line receiver counting accepted connections.
+type carbonStub struct {
+	ln     net.Listener
+	mu     sync.Mutex
+	lines  []string
+	conns  int
+	active []net.Conn
+}
+
+func newCarbonStub(t *testing.T) *carbonStub {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &carbonStub{ln: ln}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.conns++
+			s.active = append(s.active, conn)
+			s.mu.Unlock()
+			go func(c net.Conn) {
+				defer c.Close()
+				sc := bufio.NewScanner(c)
+				for sc.Scan() {
+					s.mu.Lock()
+					s.lines = append(s.lines, sc.Text())
+					s.mu.Unlock()
+				}
+			}(conn)
+		}
+	}()
+	return s
+}
+
+func (s *carbonStub) addr() string { return s.ln.Addr().String() }
+
+// dropAll closes every accepted connection from the relay side.
+func (s *carbonStub) dropAll() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.active {
+		c.Close()
+	}
+	s.active = nil
+}
+
+// waitLines waits until n lines were received and returns them.
+func (s *carbonStub) waitLines(t *testing.T, n int) []string {
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		s.mu.Lock()
+		if len(s.lines) >= n {
+			out := append([]string{}, s.lines...)
+			s.mu.Unlock()
+			return out
+		}
+		s.mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t.Fatalf("received %d lines, want %d", len(s.lines), n)
+	return nil
+}
+
+func graphiteTestConfig(relays ...string) ConfigGraphiteBackend {
+	return ConfigGraphiteBackend{
+		Relays:              relays,
+		Mode:                graphiteModeFailover,
+		ChunkSize:           16,
+		ReconnectBackoff:    1,
+		MaxReconnectBackoff: 1,
+	}
+}
+
+func TestGraphiteClientReusesConnection(t *testing.T) {
+	stub := newCarbonStub(t)
+	defer stub.ln.Close()
+
+	c := newGraphiteClient("", graphiteTestConfig(stub.addr()), false)
+	deadline := time.Now().Add(time.Second)
+	for i := 0; i < 3; i++ {
+		if err := c.Send(bytes.NewBufferString("a.b 1 1700000000\nc.d 2 1700000000\n"), deadline); err != nil {
+			t.Fatalf("Send #%d: %v", i, err)
+		}
+	}
+	lines := stub.waitLines(t, 6)
+	if lines[0] != "a.b 1 1700000000" || lines[5] != "c.d 2 1700000000" {
+		t.Errorf("unexpected lines %q (chunked writes must keep lines whole)", lines)
+	}
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if stub.conns != 1 {
+		t.Errorf("relay saw %d connections, want 1", stub.conns)
+	}
+}
+
+func TestGraphiteClientFailover(t *testing.T) {
+	stub := newCarbonStub(t)
+	defer stub.ln.Close()
+
+	// grab a free port and close it so the first relay refuses connections
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	c := newGraphiteClient("", graphiteTestConfig(deadAddr, stub.addr()), false)
+	if err := c.Send(bytes.NewBufferString("x.y 1 1700000000\n"), time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("Send with one healthy relay: %v", err)
+	}
+	stub.waitLines(t, 1)
+
+	if c.relays[0].nextDial.IsZero() {
+		t.Error("dead relay should be put in reconnect backoff")
+	}
+}
+
+func TestGraphiteClientHashSharding(t *testing.T) {
+	c := newGraphiteClient("", ConfigGraphiteBackend{
+		Relays: []string{"10.0.0.1:2003", "10.0.0.2:2003", "10.0.0.3:2003"},
+		Mode:   graphiteModeHash,
+	}, false)
+
+	var data bytes.Buffer
+	for _, m := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "a"} {
+		data.WriteString("metric." + m + " 1 1700000000\n")
+	}
+	shards := c.shard(data.Bytes())
+
+	total := 0
+	seen := map[string]int{}
+	for i, shard := range shards {
+		for _, line := range strings.Split(strings.TrimSpace(string(shard)), "\n") {
+			if line == "" {
+				continue
+			}
+			total++
+			path := strings.Fields(line)[0]
+			if prev, ok := seen[path]; ok && prev != i {
+				t.Errorf("%s sent to relays %d and %d", path, prev, i)
+			}
+			seen[path] = i
+		}
+	}
+	if total != 9 {
+		t.Errorf("sharded %d lines, want 9", total)
+	}
+}
+
+func TestGraphiteClientHashFailover(t *testing.T) {
+	stub := newCarbonStub(t)
+	defer stub.ln.Close()
+
+	dead, _ := net.Listen("tcp", "127.0.0.1:0")
+	deadAddr := dead.Addr().String()
+	dead.Close()
+
+	gcfg := graphiteTestConfig(deadAddr, stub.addr())
+	gcfg.Mode = graphiteModeHash
+	c := newGraphiteClient("", gcfg, false)
+
+	var data bytes.Buffer
+	for _, m := range []string{"a", "b", "c", "d", "e", "f", "g", "h"} {
+		data.WriteString("metric." + m + " 1 1700000000\n")
+	}
+	if len(c.shard(data.Bytes())[0]) == 0 {
+		t.Fatal("test batch has no lines for the dead relay")
+	}
+	if err := c.Send(&data, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("Send with one healthy relay: %v", err)
+	}
+	// the shard of the dead relay is written to the healthy one
+	stub.waitLines(t, 8)
+}
+
+func TestGraphiteClientReconnects(t *testing.T) {
+	stub := newCarbonStub(t)
+	defer stub.ln.Close()
+
+	c := newGraphiteClient("", graphiteTestConfig(stub.addr()), false)
+	deadline := time.Now().Add(time.Second)
+	if err := c.Send(bytes.NewBufferString("a 1 1\n"), deadline); err != nil {
+		t.Fatal(err)
+	}
+	stub.waitLines(t, 1)
+
+	// relay drops the connection; the client must notice and redial
+	stub.dropAll()
+	time.Sleep(20 * time.Millisecond)
+
+	if err := c.Send(bytes.NewBufferString("b 2 2\n"), deadline); err != nil {
+		t.Fatalf("Send after drop: %v", err)
+	}
+	stub.waitLines(t, 2)
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if stub.conns != 2 {
+		t.Errorf("relay saw %d connections, want 2", stub.conns)
+	}
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// largest pickle message accepted, bigger ones close the connection
+const maxGraphitePickleMessage = 16 * 1024 * 1024
+
+// ConfigGraphiteInput - carbon compatible listeners. Points are passed through
+// to the backends with their timestamps, not aggregated (the last value of a
+// path and timestamp in a flush interval wins).
+type ConfigGraphiteInput struct {
+	// Addr - plaintext 'path value timestamp' lines over TCP and UDP, empty -
+	// disabled
+	Addr string `yaml:"addr"`
+	// PickleAddr - pickle protocol over TCP, empty - disabled
+	PickleAddr string `yaml:"pickle-addr"`
+	// Prefix and ExtraTags - apply 'prefix' and 'extra-tags' to the points
+	Prefix    bool `yaml:"prefix"`
+	ExtraTags bool `yaml:"extra-tags"`
+}
+
+// graphitePacket returns the packet of a graphite point, nil when the path is
+// empty. Graphite tags (path;tag=value) become tags.
+func graphitePacket(path string, value float64, ts int64, cfg ConfigGraphiteInput) *Packet {
+	name, tagged, _ := strings.Cut(path, ";")
+	name = sanitizeBucket(name)
+	if len(name) == 0 {
+		return nil
+	}
+	tags := make(map[string]string)
+	if len(tagged) > 0 {
+		for _, tag := range strings.Split(tagged, ";") {
+			k, v, _ := strings.Cut(tag, "=")
+			k, v = sanitizeBucket(k), sanitizeBucket(v)
+			if len(k) > 0 && len(v) > 0 {
+				tags[k] = v
+			}
+		}
+	}
+	if cfg.ExtraTags {
+		tags = addTags(tags, Config.ExtraTagsHash)
+	}
+	if cfg.Prefix {
+		name = Config.Prefix + name
+	}
+	if ts <= 0 {
+		ts = time.Now().Unix()
+	}
+	return &Packet{
+		Bucket:    makeBucket(name, tags),
+		Value:     GaugeData{false, false, value},
+		Modifier:  "g",
+		Sampling:  1,
+		Timestamp: ts,
+	}
+}
+
+// parseGraphiteLine parses 'path value [timestamp]'; a missing or -1
+// timestamp means now.
+func parseGraphiteLine(line []byte, cfg ConfigGraphiteInput) *Packet {
+	logCtx := log.WithFields(log.Fields{
+		"in": "parseGraphiteLine",
+	})
+
+	fields := bytes.Fields(line)
+	if len(fields) == 0 {
+		return nil
+	}
+	if len(fields) < 2 || len(fields) > 3 {
+		logCtx.Errorf("Expected \"path value timestamp\". Got \"%s\"", line)
+		Stat.PointsParseFailInc()
+		return nil
+	}
+	value, err := strconv.ParseFloat(string(fields[1]), 64)
+	if err != nil || math.IsNaN(value) || math.IsInf(value, 0) {
+		logCtx.Errorf("Only float/integer values allowed. Got: %s in line \"%s\"", fields[1], line)
+		Stat.PointsParseFailInc()
+		return nil
+	}
+	var ts int64
+	if len(fields) == 3 {
+		f, err := strconv.ParseFloat(string(fields[2]), 64)
+		if err != nil {
+			logCtx.Errorf("Timestamp expected. Got: %s in line \"%s\"", fields[2], line)
+			Stat.PointsParseFailInc()
+			return nil
+		}
+		ts = int64(f)
+	}
+	return graphitePacket(string(fields[0]), value, ts, cfg)
+}
+
+// graphitePicklePackets returns the packets of an unpickled
+// [(path, (timestamp, value)), ...] message. Malformed datapoints are skipped.
+func graphitePicklePackets(data []byte, cfg ConfigGraphiteInput) ([]*Packet, error) {
+	v, err := unpickle(data)
+	if err != nil {
+		return nil, err
+	}
+	list, ok := v.(*[]any)
+	if !ok {
+		return nil, fmt.Errorf("pickle: expected a list, got %T", v)
+	}
+	packets := make([]*Packet, 0, len(*list))
+	for _, item := range *list {
+		dp, ok := item.([]any)
+		if !ok || len(dp) != 2 {
+			Stat.PointsParseFailInc()
+			continue
+		}
+		path, ok := dp[0].(string)
+		point, ok2 := dp[1].([]any)
+		if !ok || !ok2 || len(point) != 2 {
+			Stat.PointsParseFailInc()
+			continue
+		}
+		ts, ok := pickleNumber(point[0])
+		value, ok2 := pickleNumber(point[1])
+		if !ok || !ok2 || math.IsNaN(value) || math.IsInf(value, 0) {
+			Stat.PointsParseFailInc()
+			continue
+		}
+		if p := graphitePacket(path, value, int64(ts), cfg); p != nil {
+			packets = append(packets, p)
+		}
+	}
+	return packets, nil
+}
+
+// pickleNumber - a number or a numeric string, as carbon accepts
+func pickleNumber(v any) (float64, bool) {
+	switch n := v.(type) {
+	case int64:
+		return float64(n), true
+	case float64:
+		return n, true
+	case string:
+		f, err := strconv.ParseFloat(n, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// readGraphiteLines delivers the points of plaintext lines read from conn.
+func readGraphiteLines(conn io.ReadCloser, cfg ConfigGraphiteInput) {
+	defer conn.Close()
+
+	scanner := bufio.NewScanner(conn)
+	for scanner.Scan() {
+		Stat.BytesReceivedInc(int64(len(scanner.Bytes()) + 1))
+		if p := parseGraphiteLine(scanner.Bytes(), cfg); p != nil {
+			Stat.PointTypeInc(p)
+			deliverPacket(p)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.WithField("in", "readGraphiteLines").Errorf("%s", err)
+		Stat.ReadFailInc()
+	}
+}
+
+// readGraphitePickle delivers the points of length-prefixed pickle messages
+// read from conn.
+func readGraphitePickle(conn io.ReadCloser, cfg ConfigGraphiteInput) {
+	logCtx := log.WithFields(log.Fields{
+		"in": "readGraphitePickle",
+	})
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	var header [4]byte
+	for {
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err != io.EOF {
+				logCtx.Errorf("%s", err)
+				Stat.ReadFailInc()
+			}
+			return
+		}
+		size := binary.BigEndian.Uint32(header[:])
+		if size > maxGraphitePickleMessage {
+			logCtx.Errorf("Pickle message of %d bytes is too big", size)
+			Stat.ReadFailInc()
+			return
+		}
+		data := make([]byte, size)
+		if _, err := io.ReadFull(r, data); err != nil {
+			logCtx.Errorf("%s", err)
+			Stat.ReadFailInc()
+			return
+		}
+		Stat.BytesReceivedInc(int64(size) + 4)
+
+		packets, err := graphitePicklePackets(data, cfg)
+		if err != nil {
+			logCtx.Errorf("%s", err)
+			Stat.PointsParseFailInc()
+			continue
+		}
+		for _, p := range packets {
+			Stat.PointTypeInc(p)
+			deliverPacket(p)
+		}
+	}
+}
+
+// graphiteInputListener accepts plaintext lines over TCP and UDP.
+func graphiteInputListener() {
+	logCtx := log.WithFields(log.Fields{
+		"in": "graphiteInputListener",
+	})
+	cfg := Config.CfgGraphiteInput
+
+	udpConn, err := net.ListenPacket("udp", cfg.Addr)
+	if err != nil {
+		fmt.Printf("Error in ListenPacket: %v\n", err)
+		logCtx.Fatalf("%s", err)
+	}
+	// ends the UDP reader when the listener returns
+	defer udpConn.Close()
+	go func() {
+		buf := make([]byte, Config.MaxUDPPacketSize)
+		for {
+			n, _, err := udpConn.ReadFrom(buf)
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				logCtx.Errorf("%s", err)
+				Stat.ReadFailInc()
+				continue
+			}
+			Stat.BytesReceivedInc(int64(n))
+			for _, line := range bytes.Split(buf[:n], []byte("\n")) {
+				if p := parseGraphiteLine(line, cfg); p != nil {
+					Stat.PointTypeInc(p)
+					deliverPacket(p)
+				}
+			}
+		}
+	}()
+
+	listener, err := net.Listen("tcp", cfg.Addr)
+	if err != nil {
+		fmt.Printf("Error in Listen: %v\n", err)
+		logCtx.Fatalf("%s", err)
+	}
+	logCtx.Infof("listening on %s", cfg.Addr)
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Printf("Error in Accept: %v\n", err)
+			logCtx.Fatalf("%s", err)
+		}
+		go readGraphiteLines(conn, cfg)
+	}
+}
+
+// graphitePickleListener accepts pickle messages over TCP.
+func graphitePickleListener() {
+	logCtx := log.WithFields(log.Fields{
+		"in": "graphitePickleListener",
+	})
+	cfg := Config.CfgGraphiteInput
+
+	listener, err := net.Listen("tcp", cfg.PickleAddr)
+	if err != nil {
+		fmt.Printf("Error in Listen: %v\n", err)
+		logCtx.Fatalf("%s", err)
+	}
+	logCtx.Infof("listening on %s", cfg.PickleAddr)
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			fmt.Printf("Error in Accept: %v\n", err)
+			logCtx.Fatalf("%s", err)
+		}
+		go readGraphitePickle(conn, cfg)
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestParseGraphiteLine(t *testing.T) {
+	savedPrefix, savedTags := Config.Prefix, Config.ExtraTagsHash
+	defer func() { Config.Prefix, Config.ExtraTagsHash = savedPrefix, savedTags }()
+	Config.Prefix = "relay."
+	Config.ExtraTagsHash = map[string]string{"dc": "west"}
+
+	tests := []struct {
+		line   string
+		cfg    ConfigGraphiteInput
+		bucket string
+		value  float64
+		ts     int64
+	}{
+		{"servers.a.load 1.5 1700000000", ConfigGraphiteInput{}, "servers.a.load", 1.5, 1700000000},
+		{"servers.a.load 2 1700000000.7", ConfigGraphiteInput{Prefix: true}, "relay.servers.a.load", 2, 1700000000},
+		{"servers.a.load 3 1700000000", ConfigGraphiteInput{ExtraTags: true}, "servers.a.load.^dc=west", 3, 1700000000},
+		{"servers.a.load;dc=east;role=db -4 1700000000", ConfigGraphiteInput{ExtraTags: true}, "servers.a.load.^dc=east.^role=db", -4, 1700000000},
+	}
+	for _, tt := range tests {
+		p := parseGraphiteLine([]byte(tt.line), tt.cfg)
+		assert.NotEqual(t, p, nil)
+		assert.Equal(t, tt.bucket, p.Bucket)
+		assert.Equal(t, GaugeData{false, false, tt.value}, p.Value)
+		assert.Equal(t, "g", p.Modifier)
+		assert.Equal(t, tt.ts, p.Timestamp)
+	}
+
+	// no timestamp or -1 - now
+	for _, line := range []string{"servers.a.load 1", "servers.a.load 1 -1"} {
+		p := parseGraphiteLine([]byte(line), ConfigGraphiteInput{})
+		assert.NotEqual(t, p, nil)
+		assert.T(t, time.Now().Unix()-p.Timestamp < 5)
+	}
+
+	for _, line := range []string{"", "servers.a.load", "servers.a.load x 1700000000", "servers.a.load nan 1700000000", "servers.a.load 1 now", "a 1 2 3"} {
+		assert.Equal(t, parseGraphiteLine([]byte(line), ConfigGraphiteInput{}), (*Packet)(nil))
+	}
+}
+
+func TestGraphitePicklePackets(t *testing.T) {
+	// pickle.dumps([("a.b;dc=x", (1700000000, 1.5)), ("c", (1700000001, "2"))], protocol=p)
+	messages := [][]byte{
+		[]byte("(lp0\n(Va.b;dc=x\np1\n(I1700000000\nF1.5\ntp2\ntp3\na(Vc\np4\n(I1700000001\nV2\np5\ntp6\ntp7\na."),
+		[]byte("\x80\x02]q\x00(X\x08\x00\x00\x00a.b;dc=xq\x01J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86q\x02\x86q\x03X\x01\x00\x00\x00cq\x04J\x01\xf1SeX\x01\x00\x00\x002q\x05\x86q\x06\x86q\x07e."),
+		[]byte("\x80\x04\x953\x00\x00\x00\x00\x00\x00\x00]\x94(\x8c\x08a.b;dc=x\x94J\x00\xf1SeG?\xf8\x00\x00\x00\x00\x00\x00\x86\x94\x86\x94\x8c\x01c\x94J\x01\xf1Se\x8c\x012\x94\x86\x94\x86\x94e."),
+	}
+	for _, msg := range messages {
+		packets, err := graphitePicklePackets(msg, ConfigGraphiteInput{})
+		assert.Equal(t, err, nil)
+		assert.Equal(t, len(packets), 2)
+		assert.Equal(t, "a.b.^dc=x", packets[0].Bucket)
+		assert.Equal(t, GaugeData{false, false, 1.5}, packets[0].Value)
+		assert.Equal(t, int64(1700000000), packets[0].Timestamp)
+		assert.Equal(t, "c", packets[1].Bucket)
+		assert.Equal(t, GaugeData{false, false, 2}, packets[1].Value)
+		assert.Equal(t, int64(1700000001), packets[1].Timestamp)
+	}
+
+	// the pickle output of the graphite-pickle backend
+	out := pickleMessages([]byte("x.y 3 1700000000\nx.z -1.25 4000000000\n"), 500)
+	assert.Equal(t, len(out), 1)
+	packets, err := graphitePicklePackets(out[0][4:], ConfigGraphiteInput{})
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(packets), 2)
+	assert.Equal(t, GaugeData{false, false, -1.25}, packets[1].Value)
+	assert.Equal(t, int64(4000000000), packets[1].Timestamp)
+
+	for _, msg := range []string{"", "\x80\x02]q\x00(X\xff\x00\x00\x00a", "\x80\x02K\x01.", "\x80\x02\xff."} {
+		_, err := graphitePicklePackets([]byte(msg), ConfigGraphiteInput{})
+		assert.NotEqual(t, err, nil)
+	}
+}
+
+func TestReadGraphitePickle(t *testing.T) {
+	client, server := net.Pipe()
+	saved := In
+	defer func() { In = saved }()
+	In = make(chan *Packet, 10)
+	Stat.ProcessStats(packetCache, nameCache)
+
+	done := make(chan struct{})
+	go func() {
+		readGraphitePickle(server, ConfigGraphiteInput{})
+		close(done)
+	}()
+	for _, msg := range pickleMessages([]byte("p.a 1 1700000000\np.b 2 1700000000\n"), 1) {
+		client.Write(msg)
+	}
+	var header [4]byte
+	binary.BigEndian.PutUint32(header[:], maxGraphitePickleMessage+1)
+	client.Write(header[:])
+	<-done
+	client.Close()
+
+	Stat.ProcessStats(packetCache, nameCache)
+	assert.Equal(t, Stat.savedStat.PointsReceivedGauge, int64(2))
+	assert.Equal(t, len(In), 2)
+	assert.Equal(t, "p.a", (<-In).Bucket)
+	assert.Equal(t, "p.b", (<-In).Bucket)
+}
+
+func TestReadGraphiteLines(t *testing.T) {
+	saved := In
+	defer func() { In = saved }()
+	In = make(chan *Packet, 10)
+
+	Stat.ProcessStats(packetCache, nameCache)
+	readGraphiteLines(nopCloser{bytes.NewBufferString("l.a 1 1700000000\nbad\nl.b 2 1700000000")}, ConfigGraphiteInput{})
+	Stat.ProcessStats(packetCache, nameCache)
+	assert.Equal(t, Stat.savedStat.PointsReceivedGauge, int64(2))
+	assert.Equal(t, len(In), 2)
+	assert.Equal(t, "l.a", (<-In).Bucket)
+	assert.Equal(t, "l.b", (<-In).Bucket)
+}
+
+type nopCloser struct {
+	*bytes.Buffer
+}
+
+func (nopCloser) Close() error { return nil }
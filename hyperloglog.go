@@ -0,0 +1,160 @@
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"math/bits"
+)
+
+// defaults of set counting: HyperLogLog precision (2^14 registers, 16 KiB per
+// set, ~0.8% standard error) and the number of members counted exactly
+const (
+	defaultSetPrecision  = 14
+	defaultSetExactLimit = 1000
+	minSetPrecision      = 4
+	maxSetPrecision      = 18
+)
+
+// setCounter counts the distinct members of a set. Members are kept exactly
+// until there are more than exactLimit of them, then only a HyperLogLog is
+// kept, so memory per set is bounded by 2^precision bytes.
+type setCounter struct {
+	precision  uint8
+	exactLimit int
+	exact      map[string]struct{}
+	hll        *hyperLogLog
+}
+
+func newSetCounter(precision uint8, exactLimit int) *setCounter {
+	s := &setCounter{precision: precision, exactLimit: exactLimit}
+	if exactLimit > 0 {
+		s.exact = make(map[string]struct{})
+	} else {
+		s.hll = newHyperLogLog(precision)
+	}
+	return s
+}
+
+// Add counts member.
+func (s *setCounter) Add(member string) {
+	if s.hll != nil {
+		s.hll.Add(member)
+		return
+	}
+	s.exact[member] = struct{}{}
+	if len(s.exact) > s.exactLimit {
+		s.toHLL()
+	}
+}
+
+// Count returns the number of distinct members, exact below exactLimit.
+func (s *setCounter) Count() uint64 {
+	if s.hll != nil {
+		return s.hll.Count()
+	}
+	return uint64(len(s.exact))
+}
+
+// Merge adds the members counted by o, which must have the same precision.
+func (s *setCounter) Merge(o *setCounter) {
+	if o.hll == nil {
+		for m := range o.exact {
+			s.Add(m)
+		}
+		return
+	}
+	if s.hll == nil {
+		s.toHLL()
+	}
+	s.hll.Merge(o.hll)
+}
+
+// toHLL switches to HyperLogLog counting.
+func (s *setCounter) toHLL() {
+	s.hll = newHyperLogLog(s.precision)
+	for m := range s.exact {
+		s.hll.Add(m)
+	}
+	s.exact = nil
+}
+
+// hyperLogLog (Flajolet et al., 2007) with 64 bit hashes, so no large range
+// correction is needed. Sketches with the same precision merge exactly by
+// taking the register maximums.
+type hyperLogLog struct {
+	p         uint8
+	registers []uint8
+}
+
+func newHyperLogLog(p uint8) *hyperLogLog {
+	if p < minSetPrecision || p > maxSetPrecision {
+		p = defaultSetPrecision
+	}
+	return &hyperLogLog{p: p, registers: make([]uint8, 1<<p)}
+}
+
+// Add counts member.
+func (h *hyperLogLog) Add(member string) {
+	x := hllHash(member)
+	idx := x >> (64 - h.p)
+	// the stop bit caps the rank at 64-p+1
+	w := x<<h.p | 1<<(h.p-1)
+	rank := uint8(bits.LeadingZeros64(w) + 1)
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+// Merge adds the members counted by o, which must have the same precision.
+func (h *hyperLogLog) Merge(o *hyperLogLog) {
+	for i, r := range o.registers {
+		if r > h.registers[i] {
+			h.registers[i] = r
+		}
+	}
+}
+
+// Count returns the estimated number of distinct members.
+func (h *hyperLogLog) Count() uint64 {
+	m := float64(len(h.registers))
+	var sum float64
+	zeros := 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	var alpha float64
+	switch len(h.registers) {
+	case 16:
+		alpha = 0.673
+	case 32:
+		alpha = 0.697
+	case 64:
+		alpha = 0.709
+	default:
+		alpha = 0.7213 / (1 + 1.079/m)
+	}
+	estimate := alpha * m * m / sum
+	// small range correction: linear counting
+	if estimate <= 2.5*m && zeros > 0 {
+		estimate = m * math.Log(m/float64(zeros))
+	}
+	return uint64(estimate + 0.5)
+}
+
+// hllHash - FNV-1a finalized with the splitmix64 mixer, as FNV alone leaves
+// the high bits (the register index) poorly distributed for short strings.
+// It is stable, so sketches from other processes can be merged.
+func hllHash(s string) uint64 {
+	f := fnv.New64a()
+	f.Write([]byte(s))
+	x := f.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"testing"
+)
+
+func TestHyperLogLogAccuracy(t *testing.T) {
+	for _, p := range []uint8{10, 14} {
+		// 3 standard errors
+		bound := 3 * 1.04 / math.Sqrt(float64(uint64(1)<<p))
+		for _, n := range []int{10, 1000, 100000} {
+			h := newHyperLogLog(p)
+			for i := 0; i < n; i++ {
+				h.Add("user-" + strconv.Itoa(i))
+				h.Add("user-" + strconv.Itoa(i))
+			}
+			got := float64(h.Count())
+			if math.Abs(got-float64(n)) > bound*float64(n)+1 {
+				t.Errorf("p=%d: Count() = %v, want %d within %v", p, got, n, bound)
+			}
+		}
+	}
+}
+
+func TestSetCounterExact(t *testing.T) {
+	s := newSetCounter(defaultSetPrecision, 100)
+	for i := 0; i < 100; i++ {
+		s.Add(strconv.Itoa(i % 60))
+	}
+	if s.hll != nil || s.Count() != 60 {
+		t.Errorf("exact set: hll %v, Count() = %d, want 60", s.hll != nil, s.Count())
+	}
+	for i := 0; i < 200; i++ {
+		s.Add(strconv.Itoa(i))
+	}
+	if s.exact != nil || s.hll == nil {
+		t.Errorf("set over the exact limit not switched to HyperLogLog")
+	}
+	if c := s.Count(); c < 190 || c > 210 {
+		t.Errorf("Count() = %d, want ~200", c)
+	}
+}
+
+func TestSetCounterMerge(t *testing.T) {
+	// exact + exact, exact + hll, hll + exact
+	for _, limits := range [][2]int{{10000, 10000}, {10000, 0}, {0, 10000}, {100, 100}} {
+		a := newSetCounter(12, limits[0])
+		b := newSetCounter(12, limits[1])
+		all := newHyperLogLog(12)
+		for i := 0; i < 5000; i++ {
+			m := strconv.Itoa(i)
+			all.Add(m)
+			if i < 3000 {
+				a.Add(m)
+			}
+			if i >= 2000 {
+				b.Add(m)
+			}
+		}
+		a.Merge(b)
+		want := uint64(5000)
+		if a.hll != nil {
+			// merging is exact, the estimate is that of one sketch of all
+			want = all.Count()
+		}
+		if a.Count() != want {
+			t.Errorf("limits %v: merged Count() = %d, want %d", limits, a.Count(), want)
+		}
+	}
+}
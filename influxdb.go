@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// influxdb transports
+const (
+	influxTransportHTTP = "http"
+	influxTransportUDP  = "udp"
+)
+
+// ConfigInfluxDBBackend - influxdb backend config.
+type ConfigInfluxDBBackend struct {
+	// Transport - http (/write endpoint) or udp
+	Transport string `yaml:"transport"`
+	// URL - base url of the HTTP API, eg. http://127.0.0.1:8086
+	URL             string `yaml:"url"`
+	Database        string `yaml:"database"`
+	RetentionPolicy string `yaml:"retention-policy"`
+	Username        string `yaml:"username"`
+	Password        string `yaml:"password"`
+	// Token - sent as "Authorization: Token <token>" instead of basic auth
+	Token string `yaml:"token"`
+	Gzip  bool   `yaml:"gzip"`
+	// UDPAddress - host:port of the UDP listener
+	UDPAddress string `yaml:"udp-address"`
+	// UDPPayloadSize - max bytes per UDP packet, packets are split on lines
+	UDPPayloadSize int `yaml:"udp-payload-size"`
+}
+
+type influxdbBackend struct {
+	cfg    ConfigInfluxDBBackend
+	client *http.Client
+}
+
+func newInfluxDBBackend(cfg ConfigInfluxDBBackend) influxdbBackend {
+	return influxdbBackend{cfg: cfg, client: &http.Client{}}
+}
+
+// Send ships a batch already in line protocol.
+func (b influxdbBackend) Send(buf *bytes.Buffer, deadline time.Time) error {
+	if buf.Len() == 0 {
+		return nil
+	}
+	if b.cfg.Transport == influxTransportUDP {
+		return b.sendUDP(buf.Bytes(), deadline)
+	}
+	return b.sendHTTP(buf.Bytes(), deadline)
+}
+
+func (b influxdbBackend) sendHTTP(data []byte, deadline time.Time) error {
+	params := url.Values{}
+	params.Set("db", b.cfg.Database)
+	params.Set("precision", "s")
+	if b.cfg.RetentionPolicy != "" {
+		params.Set("rp", b.cfg.RetentionPolicy)
+	}
+	writeURL := strings.TrimRight(b.cfg.URL, "/") + "/write?" + params.Encode()
+
+	body := data
+	if b.cfg.Gzip {
+		var zbuf bytes.Buffer
+		zw := gzip.NewWriter(&zbuf)
+		if _, err := zw.Write(data); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		body = zbuf.Bytes()
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, writeURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if b.cfg.Gzip {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+	switch {
+	case b.cfg.Token != "":
+		req.Header.Set("Authorization", "Token "+b.cfg.Token)
+	case b.cfg.Username != "":
+		req.SetBasicAuth(b.cfg.Username, b.cfg.Password)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("influxdb write to %s failed - %s", b.cfg.URL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("influxdb write to %s failed - %s: %s", b.cfg.URL, resp.Status, strings.TrimSpace(string(msg)))
+	}
+	return nil
+}
+
+func (b influxdbBackend) sendUDP(data []byte, deadline time.Time) error {
+	conn, err := net.Dial("udp", b.cfg.UDPAddress)
+	if err != nil {
+		return fmt.Errorf("dialing %s failed - %s", b.cfg.UDPAddress, err)
+	}
+	defer conn.Close()
+	if err := conn.SetWriteDeadline(deadline); err != nil {
+		return err
+	}
+	for _, packet := range lineChunks(data, b.cfg.UDPPayloadSize) {
+		if _, err := conn.Write(packet); err != nil {
+			return fmt.Errorf("failed to write stats to influxdb %s: %s", b.cfg.UDPAddress, err)
+		}
+	}
+	return nil
+}
+
+// influxSeries - one line protocol point: measurement, tags and timestamp
+// with all its fields.
+type influxSeries struct {
+	measurement string
+	tags        map[string]string
+	when        int64
+	fields      map[string]string
+}
+
+// renderInflux converts the flush output into line protocol. Statistics of
+// timers, histograms and distributions (cpu.time mean, upper_90, ...) become
+// fields of a single cpu.time measurement; points of other kinds get a single
+// "value" field, whatever their name ends with. Tags are the bucket tags
+// (which include extra-tags).
+func renderInflux(points []outputPoint) *bytes.Buffer {
+	series := make(map[string]*influxSeries)
+	var order []string
+
+	for _, p := range points {
+		measurement, field := p.Name, "value"
+		switch p.Kind {
+		case kindTimer, kindHistogram, kindDistribution:
+			field = p.Stat
+		}
+
+		key := measurement + tfCaretFirstDelim + normalizeTags(p.Tags, tfCaret) + " " + strconv.FormatInt(p.When, 10)
+		s, ok := series[key]
+		if !ok {
+			s = &influxSeries{measurement: measurement, tags: p.Tags, when: p.When, fields: make(map[string]string)}
+			series[key] = s
+			order = append(order, key)
+		}
+		s.fields[field] = influxFieldValue(p.Value)
+	}
+
+	var out bytes.Buffer
+	for _, key := range order {
+		s := series[key]
+		out.WriteString(influxEscape(s.measurement, ", "))
+		for _, t := range tagsToSortedSlice(s.tags) {
+			fmt.Fprintf(&out, ",%s=%s", influxEscape(t.Key, ",= "), influxEscape(t.Val, ",= "))
+		}
+		names := make([]string, 0, len(s.fields))
+		for name := range s.fields {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for i, name := range names {
+			sep := ","
+			if i == 0 {
+				sep = " "
+			}
+			fmt.Fprintf(&out, "%s%s=%s", sep, influxEscape(name, ",= "), s.fields[name])
+		}
+		fmt.Fprintf(&out, " %d\n", s.when)
+	}
+	return &out
+}
+
+// influxFieldValue - integers get the "i" suffix, floats are written with
+// full precision and key/value strings become string fields.
+func influxFieldValue(value any) string {
+	switch v := value.(type) {
+	case int, int64:
+		return fmt.Sprintf("%di", v)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(fmt.Sprint(value)) + `"`
+}
+
+// influxEscape backslash-escapes the given characters.
+func influxEscape(s string, chars string) string {
+	if !strings.ContainsAny(s, chars) {
+		return s
+	}
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(chars, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRenderInflux(t *testing.T) {
+	web1 := map[string]string{"env": "prod", "host": "web1"}
+	points := []outputPoint{
+		{Kind: kindTimer, Name: "api.time", Stat: "upper_90", Tags: web1, Value: 30.0, When: 1700000000},
+		{Kind: kindTimer, Name: "api.time", Stat: "mean", Tags: web1, Value: 20.5, When: 1700000000},
+		{Kind: kindTimer, Name: "api.time", Stat: "count", Tags: web1, Value: 3, When: 1700000000},
+		{Kind: kindTimer, Name: "api.time", Stat: "mean", Tags: map[string]string{"env": "prod", "host": "web2"}, Value: 5.0, When: 1700000000},
+		{Kind: kindCounter, Name: "hits", Value: int64(7), When: 1700000000},
+		{Kind: kindCounter, Name: "jobs.count", Value: int64(4), When: 1700000000},
+		{Kind: kindGauge, Name: "disk.max", Value: 0.75, When: 1700000000},
+		{Kind: kindGauge, Name: "cpu.load", Tags: map[string]string{"host": "web"}, Value: 0.5, When: 1700000000},
+		{Kind: kindKeyValue, Name: "release", Value: `v1 "2"`, When: 1700000000},
+	}
+
+	got := renderInflux(points).String()
+	want := strings.Join([]string{
+		"api.time,env=prod,host=web1 count=3i,mean=20.5,upper_90=30 1700000000",
+		"api.time,env=prod,host=web2 mean=5 1700000000",
+		"hits value=7i 1700000000",
+		"jobs.count value=4i 1700000000",
+		"disk.max value=0.75 1700000000",
+		"cpu.load,host=web value=0.5 1700000000",
+		`release value="v1 \"2\"" 1700000000`,
+	}, "\n") + "\n"
+	if got != want {
+		t.Errorf("renderInflux =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestInfluxEscape(t *testing.T) {
+	if got := influxEscape("a b,c=d", ",= "); got != `a\ b\,c\=d` {
+		t.Errorf("influxEscape = %q", got)
+	}
+}
+
+func TestInfluxDBBackendHTTP(t *testing.T) {
+	var gotQuery, gotAuth, gotBody string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.RawQuery
+		gotAuth = r.Header.Get("Authorization")
+		body := io.Reader(r.Body)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			zr, err := gzip.NewReader(r.Body)
+			if err != nil {
+				t.Errorf("gzip reader: %v", err)
+				return
+			}
+			body = zr
+		}
+		b, _ := io.ReadAll(body)
+		gotBody = string(b)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	b := newInfluxDBBackend(ConfigInfluxDBBackend{
+		Transport:       influxTransportHTTP,
+		URL:             srv.URL,
+		Database:        "statsd",
+		RetentionPolicy: "week",
+		Token:           "secret",
+		Gzip:            true,
+	})
+	if err := b.Send(bytes.NewBufferString("hits value=7i 1700000000\n"), time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if gotQuery != "db=statsd&precision=s&rp=week" {
+		t.Errorf("query = %q", gotQuery)
+	}
+	if gotAuth != "Token secret" {
+		t.Errorf("Authorization = %q", gotAuth)
+	}
+	if gotBody != "hits value=7i 1700000000\n" {
+		t.Errorf("body = %q", gotBody)
+	}
+}
+
+func TestInfluxDBBackendHTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"error":"database not found"}`, http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	b := newInfluxDBBackend(ConfigInfluxDBBackend{Transport: influxTransportHTTP, URL: srv.URL, Database: "nope"})
+	err := b.Send(bytes.NewBufferString("hits value=7i 1700000000\n"), time.Now().Add(time.Second))
+	if err == nil || !strings.Contains(err.Error(), "database not found") {
+		t.Errorf("Send error = %v, want database not found", err)
+	}
+}
+
+func TestInfluxDBBackendUDP(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	b := newInfluxDBBackend(ConfigInfluxDBBackend{Transport: influxTransportUDP, UDPAddress: pc.LocalAddr().String(), UDPPayloadSize: 30})
+	data := "a value=1i 1700000000\nb value=2i 1700000000\n"
+	if err := b.Send(bytes.NewBufferString(data), time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+
+	var got []string
+	buf := make([]byte, 1500)
+	pc.SetReadDeadline(time.Now().Add(time.Second))
+	for len(got) < 2 {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("ReadFrom: %v", err)
+		}
+		got = append(got, string(buf[:n]))
+	}
+	// payload size forces one line per packet
+	if got[0] != "a value=1i 1700000000\n" || got[1] != "b value=2i 1700000000\n" {
+		t.Errorf("packets = %q", got)
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// types of the points of influx-input rules
+const (
+	influxInputGauge   = "gauge"
+	influxInputCounter = "counter"
+)
+
+// largest HTTP body accepted by the influx-input listener
+const maxInfluxInputBody = 32 * 1024 * 1024
+
+const defaultInfluxInputSeparator = "."
+
+// ConfigInfluxInput - InfluxDB line protocol listeners. Every numeric field of
+// a line is a point of bucket <measurement><separator><field> with the tags of
+// the line, aggregated as a gauge or a counter like statsd points (line
+// timestamps are ignored).
+type ConfigInfluxInput struct {
+	// UDPAddr - lines in datagrams, empty - disabled
+	UDPAddr string `yaml:"udp-addr"`
+	// HTTPAddr - POST /write and /api/v2/write, empty - disabled
+	HTTPAddr  string `yaml:"http-addr"`
+	Separator string `yaml:"separator"`
+	// Rules - the type of buckets starting with a prefix (the first matching
+	// rule), others are of DefaultType
+	Rules       []ConfigInfluxInputRule `yaml:"rules"`
+	DefaultType string                  `yaml:"default-type"`
+	// Prefix and ExtraTags - apply 'prefix' and 'extra-tags' to the points
+	Prefix    bool `yaml:"prefix"`
+	ExtraTags bool `yaml:"extra-tags"`
+}
+
+// ConfigInfluxInputRule - buckets starting with Prefix are of Type, gauge or
+// counter (values added in a flush interval).
+type ConfigInfluxInputRule struct {
+	Prefix string `yaml:"prefix"`
+	Type   string `yaml:"type"`
+}
+
+func validInfluxInputType(t string) bool {
+	return t == influxInputGauge || t == influxInputCounter
+}
+
+func validateInfluxInput(c ConfigInfluxInput) error {
+	if !validInfluxInputType(c.DefaultType) {
+		return fmt.Errorf("Parameter error: influx-input default-type must be %s or %s", influxInputGauge, influxInputCounter)
+	}
+	for _, r := range c.Rules {
+		if len(r.Prefix) == 0 || !validInfluxInputType(r.Type) {
+			return fmt.Errorf("Parameter error: influx-input rules need a prefix and a type %s or %s", influxInputGauge, influxInputCounter)
+		}
+	}
+	return nil
+}
+
+// typeFor returns the type of bucket name.
+func (c ConfigInfluxInput) typeFor(name string) string {
+	for _, r := range c.Rules {
+		if strings.HasPrefix(name, r.Prefix) {
+			return r.Type
+		}
+	}
+	return c.DefaultType
+}
+
+// splitLineProtocol splits s on sep, skipping characters escaped with a
+// backslash and, with quotes (in the field set, where string values are
+// quoted), separators inside double quotes. With n > 0 at most n parts are
+// returned.
+func splitLineProtocol(s string, sep byte, n int, quotes bool) []string {
+	var parts []string
+	quoted := false
+	start := 0
+	for i := 0; i < len(s); i++ {
+		switch {
+		case s[i] == '\\':
+			i++
+		case s[i] == '"' && quotes:
+			quoted = !quoted
+		case s[i] == sep && !quoted:
+			if n > 0 && len(parts) == n-1 {
+				return append(parts, s[start:])
+			}
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	return append(parts, s[start:])
+}
+
+// unescapeLineProtocol removes backslashes before commas, equal signs and
+// spaces.
+func unescapeLineProtocol(s string) string {
+	if strings.IndexByte(s, '\\') < 0 {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) && (s[i+1] == ',' || s[i+1] == '=' || s[i+1] == ' ') {
+			i++
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
+
+// parseInfluxFieldValue parses a numeric or boolean (1 or 0) field value,
+// false for strings.
+func parseInfluxFieldValue(v string) (float64, bool, error) {
+	if len(v) == 0 {
+		return 0, false, fmt.Errorf("empty field value")
+	}
+	switch v {
+	case "t", "T", "true", "True", "TRUE":
+		return 1, true, nil
+	case "f", "F", "false", "False", "FALSE":
+		return 0, true, nil
+	}
+	if v[0] == '"' {
+		return 0, false, nil
+	}
+	switch v[len(v)-1] {
+	case 'i':
+		n, err := strconv.ParseInt(v[:len(v)-1], 10, 64)
+		return float64(n), true, err
+	case 'u':
+		n, err := strconv.ParseUint(v[:len(v)-1], 10, 64)
+		return float64(n), true, err
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err == nil && (math.IsNaN(f) || math.IsInf(f, 0)) {
+		err = fmt.Errorf("invalid field value %s", v)
+	}
+	return f, true, err
+}
+
+// parseInfluxLine returns the packets of the numeric fields of a line, none for
+// empty lines and comments.
+func parseInfluxLine(line string, cfg ConfigInfluxInput) ([]*Packet, error) {
+	line = strings.TrimSpace(line)
+	if len(line) == 0 || line[0] == '#' {
+		return nil, nil
+	}
+	// quotes are literal in the measurement and tags
+	sections := splitLineProtocol(line, ' ', 2, false)
+	if len(sections) < 2 {
+		return nil, fmt.Errorf("no fields in line %q", line)
+	}
+	fieldSet := splitLineProtocol(sections[1], ' ', 2, true)[0]
+
+	key := splitLineProtocol(sections[0], ',', 0, false)
+	measurement := unescapeLineProtocol(key[0])
+	tags := make(map[string]string)
+	for _, tag := range key[1:] {
+		kv := splitLineProtocol(tag, '=', 2, false)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid tag %q in line %q", tag, line)
+		}
+		k, v := sanitizeBucket(unescapeLineProtocol(kv[0])), sanitizeBucket(unescapeLineProtocol(kv[1]))
+		if len(k) > 0 && len(v) > 0 {
+			tags[k] = v
+		}
+	}
+	if cfg.ExtraTags {
+		tags = addTags(tags, Config.ExtraTagsHash)
+	}
+
+	var packets []*Packet
+	for _, field := range splitLineProtocol(fieldSet, ',', 0, true) {
+		kv := splitLineProtocol(field, '=', 2, false)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("invalid field %q in line %q", field, line)
+		}
+		value, numeric, err := parseInfluxFieldValue(kv[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s in line %q", err, line)
+		}
+		if !numeric {
+			continue
+		}
+
+		name := sanitizeBucket(measurement + cfg.Separator + unescapeLineProtocol(kv[0]))
+		if len(name) == 0 {
+			return nil, fmt.Errorf("empty bucket name in line %q", line)
+		}
+		p := &Packet{Sampling: 1}
+		if cfg.typeFor(name) == influxInputCounter {
+			p.Modifier = "c"
+			p.Value = int64(math.Round(value))
+		} else {
+			p.Modifier = "g"
+			p.Value = GaugeData{false, false, value}
+		}
+		if cfg.Prefix {
+			name = Config.Prefix + name
+		}
+		p.Bucket = makeBucket(name, tags)
+		packets = append(packets, p)
+	}
+	return packets, nil
+}
+
+// handleInfluxLines delivers the points of lines in data and returns the
+// number of lines that failed to parse and the first error.
+func handleInfluxLines(data []byte, cfg ConfigInfluxInput) (int, error) {
+	var (
+		failed   int
+		firstErr error
+	)
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		packets, err := parseInfluxLine(string(line), cfg)
+		if err != nil {
+			Stat.PointsParseFailInc()
+			if failed == 0 {
+				firstErr = err
+			}
+			failed++
+			continue
+		}
+		for _, p := range packets {
+			Stat.PointTypeInc(p)
+			deliverPacket(p)
+		}
+	}
+	return failed, firstErr
+}
+
+// influxWriteHandler serves the /write endpoints: 204 when all lines were
+// accepted, 400 with the first error otherwise.
+func influxWriteHandler(cfg ConfigInfluxInput) http.HandlerFunc {
+	logCtx := log.WithFields(log.Fields{
+		"in": "influxWriteHandler",
+	})
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var body io.Reader = http.MaxBytesReader(w, r.Body, maxInfluxInputBody)
+		if r.Header.Get("Content-Encoding") == "gzip" {
+			gz, err := gzip.NewReader(body)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			defer gz.Close()
+			// one byte over the limit tells a cut body from a full one
+			body = io.LimitReader(gz, maxInfluxInputBody+1)
+		}
+		data, err := io.ReadAll(body)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) || len(data) > maxInfluxInputBody {
+			Stat.ReadFailInc()
+			http.Error(w, fmt.Sprintf("body larger than %d bytes", maxInfluxInputBody), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			Stat.ReadFailInc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		Stat.BytesReceivedInc(int64(len(data)))
+
+		if failed, err := handleInfluxLines(data, cfg); failed > 0 {
+			logCtx.Errorf("%d lines failed to parse, first: %s", failed, err)
+			http.Error(w, fmt.Sprintf("partial write: %d lines failed to parse, first: %s", failed, err), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// influxInputHTTPListener serves /write, /api/v2/write and /ping.
+func influxInputHTTPListener() {
+	logCtx := log.WithFields(log.Fields{
+		"in": "influxInputHTTPListener",
+	})
+	cfg := Config.CfgInfluxInput
+
+	mux := http.NewServeMux()
+	mux.Handle("/write", influxWriteHandler(cfg))
+	mux.Handle("/api/v2/write", influxWriteHandler(cfg))
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	logCtx.Infof("listening on %s", cfg.HTTPAddr)
+	if err := http.ListenAndServe(cfg.HTTPAddr, mux); err != nil {
+		fmt.Printf("Error in ListenAndServe: %v\n", err)
+		logCtx.Fatalf("%s", err)
+	}
+}
+
+// influxInputUDPListener reads datagrams of one or more lines.
+func influxInputUDPListener() {
+	logCtx := log.WithFields(log.Fields{
+		"in": "influxInputUDPListener",
+	})
+	cfg := Config.CfgInfluxInput
+
+	conn, err := net.ListenPacket("udp", cfg.UDPAddr)
+	if err != nil {
+		fmt.Printf("Error in ListenPacket: %v\n", err)
+		logCtx.Fatalf("%s", err)
+	}
+	logCtx.Infof("listening on %s", cfg.UDPAddr)
+	defer conn.Close()
+
+	// influx UDP clients send up to 64 KB datagrams
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if errors.Is(err, net.ErrClosed) {
+			logCtx.Errorf("%s", err)
+			return
+		}
+		if err != nil {
+			logCtx.Errorf("%s", err)
+			Stat.ReadFailInc()
+			continue
+		}
+		Stat.BytesReceivedInc(int64(n))
+		if failed, err := handleInfluxLines(buf[:n], cfg); failed > 0 {
+			logCtx.Errorf("%d lines failed to parse, first: %s", failed, err)
+		}
+	}
+}
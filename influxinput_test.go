@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func testInfluxInputConfig() ConfigInfluxInput {
+	return ConfigInfluxInput{
+		Separator:   defaultInfluxInputSeparator,
+		DefaultType: influxInputGauge,
+		Rules: []ConfigInfluxInputRule{
+			{Prefix: "http.requests", Type: influxInputCounter},
+		},
+	}
+}
+
+func TestParseInfluxLine(t *testing.T) {
+	cfg := testInfluxInputConfig()
+
+	packets, err := parseInfluxLine(`cpu,host=web\ 1,region=us-west usage_idle=92.5,usage_user=3i,busy=t,state="ok" 1700000000000000000`, cfg)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(packets), 3)
+	assert.Equal(t, "cpu.usage_idle.^host=web_1.^region=us-west", packets[0].Bucket)
+	assert.Equal(t, "g", packets[0].Modifier)
+	assert.Equal(t, GaugeData{false, false, 92.5}, packets[0].Value)
+	assert.Equal(t, "cpu.usage_user.^host=web_1.^region=us-west", packets[1].Bucket)
+	assert.Equal(t, GaugeData{false, false, 3}, packets[1].Value)
+	assert.Equal(t, "cpu.busy.^host=web_1.^region=us-west", packets[2].Bucket)
+	assert.Equal(t, GaugeData{false, false, 1}, packets[2].Value)
+
+	packets, err = parseInfluxLine("http,path=/api requests=5i,latency=0.25", cfg)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(packets), 2)
+	assert.Equal(t, "http.requests.^path=-api", packets[0].Bucket)
+	assert.Equal(t, "c", packets[0].Modifier)
+	assert.Equal(t, int64(5), packets[0].Value)
+	assert.Equal(t, "g", packets[1].Modifier)
+
+	// escaped measurement, field key and a string with separators
+	packets, err = parseInfluxLine(`disk\,io read\ ops=7u,msg="a b,c=d"`, cfg)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(packets), 1)
+	assert.Equal(t, "diskio.read_ops", packets[0].Bucket)
+
+	// quotes are literal in tags
+	packets, err = parseInfluxLine(`m,t="a f=1,s="x y" 1700000000`, cfg)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(packets), 1)
+	assert.Equal(t, "m.f.^t=a", packets[0].Bucket)
+	assert.Equal(t, GaugeData{false, false, 1}, packets[0].Value)
+
+	packets, err = parseInfluxLine("# comment", cfg)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(packets), 0)
+
+	for _, line := range []string{"cpu", "cpu,host value=1", "cpu value", "cpu value=abc", "cpu value=1x"} {
+		_, err := parseInfluxLine(line, cfg)
+		assert.NotEqual(t, err, nil)
+	}
+}
+
+func TestParseInfluxLinePrefixExtraTags(t *testing.T) {
+	savedPrefix, savedTags := Config.Prefix, Config.ExtraTagsHash
+	defer func() { Config.Prefix, Config.ExtraTagsHash = savedPrefix, savedTags }()
+	Config.Prefix = "telegraf."
+	Config.ExtraTagsHash = map[string]string{"dc": "west", "host": "relay"}
+
+	cfg := testInfluxInputConfig()
+	cfg.Prefix = true
+	cfg.ExtraTags = true
+	cfg.Separator = "_"
+
+	// rules match the name without the global prefix, line tags win
+	packets, err := parseInfluxLine("http,host=a requests=1", cfg)
+	assert.Equal(t, err, nil)
+	assert.Equal(t, len(packets), 1)
+	assert.Equal(t, "telegraf.http_requests.^dc=west.^host=a", packets[0].Bucket)
+	assert.Equal(t, "g", packets[0].Modifier)
+}
+
+func TestInfluxWriteHandler(t *testing.T) {
+	saved := In
+	defer func() { In = saved }()
+	In = make(chan *Packet, 10)
+
+	handler := influxWriteHandler(testInfluxInputConfig())
+
+	req := httptest.NewRequest(http.MethodPost, "/write", bytes.NewBufferString("m a=1\nm b=2\n"))
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	assert.Equal(t, rec.Code, http.StatusNoContent)
+	assert.Equal(t, len(In), 2)
+	assert.Equal(t, "m.a", (<-In).Bucket)
+	assert.Equal(t, "m.b", (<-In).Bucket)
+
+	var gz bytes.Buffer
+	w := gzip.NewWriter(&gz)
+	w.Write([]byte("m c=3\nbad\n"))
+	w.Close()
+	req = httptest.NewRequest(http.MethodPost, "/api/v2/write", &gz)
+	req.Header.Set("Content-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	assert.Equal(t, rec.Code, http.StatusBadRequest)
+	assert.Equal(t, len(In), 1)
+	assert.Equal(t, "m.c", (<-In).Bucket)
+
+	rec = httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, "/write", nil))
+	assert.Equal(t, rec.Code, http.StatusMethodNotAllowed)
+
+	// decompressed over the limit: rejected, not cut in the middle of a line
+	gz.Reset()
+	w = gzip.NewWriter(&gz)
+	w.Write(bytes.Repeat([]byte("m a=1\n"), maxInfluxInputBody/6))
+	w.Write([]byte("m value=12345\n"))
+	w.Close()
+	req = httptest.NewRequest(http.MethodPost, "/write", &gz)
+	req.Header.Set("Content-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	handler(rec, req)
+	assert.Equal(t, rec.Code, http.StatusRequestEntityTooLarge)
+	assert.Equal(t, len(In), 0)
+}
+
+func TestValidateInfluxInput(t *testing.T) {
+	cfg := testInfluxInputConfig()
+	assert.Equal(t, validateInfluxInput(cfg), nil)
+
+	cfg.DefaultType = "timer"
+	assert.NotEqual(t, validateInfluxInput(cfg), nil)
+
+	cfg = testInfluxInputConfig()
+	cfg.Rules = append(cfg.Rules, ConfigInfluxInputRule{Prefix: "", Type: influxInputGauge})
+	assert.NotEqual(t, validateInfluxInput(cfg), nil)
+}
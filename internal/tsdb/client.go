@@ -2,6 +2,8 @@ package tsdb
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -58,28 +60,62 @@ func (t *TSDB) Query(req Request) (*Response, error) {
 	return resp, nil
 }
 
+// Put sends dataPoints to /api/put with details of failed points.
 func (t *TSDB) Put(dataPoints []DataPoint) (*PutResponse, error) {
+	return t.PutContext(context.Background(), http.DefaultClient, dataPoints, false)
+}
+
+// PutContext sends dataPoints to /api/put?details using client, cancelled
+// with ctx and optionally with a gzip compressed body. A 400 response is not
+// an error: it means some points failed and the response lists them.
+func (t *TSDB) PutContext(ctx context.Context, client *http.Client, dataPoints []DataPoint, compress bool) (*PutResponse, error) {
 	host := t.Servers[0].HostPort()
 	APIURL := "http://" + host + "/api/put?details"
 
 	reqJSON, err := json.Marshal(dataPoints)
-
 	if err != nil {
 		return &PutResponse{}, err
 	}
 
-	reqReader := bytes.NewReader(reqJSON)
+	if compress {
+		var zbuf bytes.Buffer
+		zw := gzip.NewWriter(&zbuf)
+		if _, err := zw.Write(reqJSON); err != nil {
+			return &PutResponse{}, err
+		}
+		if err := zw.Close(); err != nil {
+			return &PutResponse{}, err
+		}
+		reqJSON = zbuf.Bytes()
+	}
 
-	respHTTP, err := http.Post(APIURL, "application/json", reqReader)
+	req, err := http.NewRequestWithContext(ctx, "POST", APIURL, bytes.NewReader(reqJSON))
+	if err != nil {
+		return &PutResponse{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if compress {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
+
+	respHTTP, err := client.Do(req)
 	if err != nil {
 		return &PutResponse{}, err
 	}
+	defer respHTTP.Body.Close()
 
 	respJSON, err := io.ReadAll(respHTTP.Body)
 	if err != nil {
 		return &PutResponse{}, err
 	}
 
+	if respHTTP.StatusCode == http.StatusNoContent {
+		return &PutResponse{Success: len(dataPoints)}, nil
+	}
+	if respHTTP.StatusCode != http.StatusOK && respHTTP.StatusCode != http.StatusBadRequest {
+		return &PutResponse{}, fmt.Errorf("%s returned %s: %s", APIURL, respHTTP.Status, bytes.TrimSpace(respJSON))
+	}
+
 	resp := new(PutResponse)
 	err = json.Unmarshal(respJSON, &resp)
 	if err != nil {
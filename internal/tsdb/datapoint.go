@@ -175,8 +175,19 @@ func (v *Value) Set(quantity interface{}) error {
 	}
 }
 
+// UnmarshalJSON accepts numbers and numbers in strings, as echoed back by
+// OpenTSDB in put errors.
 func (v *Value) UnmarshalJSON(inJSON []byte) error {
-	v.Set(inJSON)
+	s := strings.Trim(string(inJSON), `"`)
+	if intv, err := strconv.ParseInt(s, 10, 64); err == nil {
+		v.int64 = intv
+		return nil
+	}
+	floatv, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return err
+	}
+	v.float64 = floatv
 	return nil
 }
 
@@ -217,6 +228,10 @@ func (t *Tags) Remove(key string) {
 	delete(t.tags, key)
 }
 
+func (t *Tags) UnmarshalJSON(inJSON []byte) error {
+	return json.Unmarshal(inJSON, &t.tags)
+}
+
 func (t *Tags) MarshalJSON() ([]byte, error) {
 	// TODO: Check for empty metric?
 	return json.Marshal(t.tags)
@@ -1,6 +1,9 @@
 package tsdb
 
-import "testing"
+import (
+	"encoding/json"
+	"testing"
+)
 
 func TestValueSet(t *testing.T) {
 	var vf Value
@@ -77,3 +80,18 @@ func TestTimeParseUnix(t *testing.T) {
 		t.Error("Parse(invalid) expected error, got nil")
 	}
 }
+
+func TestPutResponseUnmarshal(t *testing.T) {
+	in := `{"success":1,"failed":1,"errors":[{"datapoint":{"metric":"sys.cpu","timestamp":1700000000,"value":"42.5","tags":{"host":"web1"}},"error":"Unable to write"}]}`
+	var resp PutResponse
+	if err := json.Unmarshal([]byte(in), &resp); err != nil {
+		t.Fatalf("Unmarshal: %v", err)
+	}
+	if len(resp.Errors) != 1 {
+		t.Fatalf("Errors = %d, want 1", len(resp.Errors))
+	}
+	dp := resp.Errors[0].DataPoint
+	if dp.Metric.Get() != "sys.cpu" || dp.Timestamp.Time().Unix() != 1700000000 || dp.Value.GetFloat() != 42.5 || dp.Tags.Get("host") != "web1" {
+		t.Errorf("datapoint = %s %d %v %q", dp.Metric.Get(), dp.Timestamp.Time().Unix(), dp.Value.GetFloat(), dp.Tags.Get("host"))
+	}
+}
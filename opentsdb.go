@@ -3,11 +3,16 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 	"github.com/wojtekzw/statsdaemon/internal/tsdb"
@@ -16,134 +21,303 @@ import (
 const (
 	//environment variable SD_OTSDB_MAXMETRICS can be used to change max metrics to OpenTSDB
 	SD_OTSDB_MAXMETRICS = 10
+	// envOpenTSDBMaxMetrics - name of the variable, it overrides 'batch-size'
+	envOpenTSDBMaxMetrics = "SD_OTSDB_MAXMETRICS"
 )
 
+// opentsdb transports
+const (
+	opentsdbTransportHTTP   = "http"
+	opentsdbTransportTelnet = "telnet"
+)
+
+// ConfigOpenTSDBBackend - opentsdb backend config.
+type ConfigOpenTSDBBackend struct {
+	// Transport - http (/api/put) or telnet ("put" lines over a persistent
+	// TCP connection)
+	Transport string `yaml:"transport"`
+	// DefaultTags - tags of points without any, OpenTSDB needs at least one;
+	// without them such points are skipped
+	DefaultTags map[string]string `yaml:"default-tags"`
+	// BatchSize - max datapoints in one /api/put request
+	BatchSize int `yaml:"batch-size"`
+	// Workers - max concurrent /api/put requests
+	Workers int  `yaml:"workers"`
+	Gzip    bool `yaml:"gzip"`
+	// Retries - how many times datapoints failed in a request are resent
+	// (only the failed ones, as listed in the ?details response)
+	Retries int `yaml:"retries"`
+	// RetryBackoff - milliseconds to wait before the first retry, doubled
+	// after each one
+	RetryBackoff int64 `yaml:"retry-backoff"`
+	// ErrorReadTimeout - milliseconds to wait for error responses after a
+	// telnet batch; OpenTSDB answers only when a put fails
+	ErrorReadTimeout int64 `yaml:"error-read-timeout"`
+	// reconnect backoff in seconds, doubled after each failed dial
+	ReconnectBackoff    int64 `yaml:"reconnect-backoff"`
+	MaxReconnectBackoff int64 `yaml:"max-reconnect-backoff"`
+}
+
 // StructPrettyPrint - JSON like
 func StructPrettyPrint(s any) string {
 	bytesStruct, _ := json.MarshalIndent(s, "", "  ")
 	return string(bytesStruct)
 }
 
-func openTSDB(config ConfigApp, buffer *bytes.Buffer) error {
+// openTSDB sends the batch to /api/put in requests of 'batch-size' points,
+// up to 'workers' of them at once. Points rejected by OpenTSDB are retried and
+// then counted as rejected; only requests that failed as a whole (network,
+// server errors, deadline) make the batch fail.
+func openTSDB(config ConfigApp, client *http.Client, buffer *bytes.Buffer, deadline time.Time) error {
 
 	logCtx := log.WithFields(log.Fields{
 		"in": "openTSDB",
 	})
 
-	maxMetrics := SD_OTSDB_MAXMETRICS
-	if i, err := strconv.Atoi(os.Getenv("SD_OTSDB_MAXMETRICS")); err == nil && i > 0 {
-		maxMetrics = i
+	if config.OpenTSDBAddress == "-" || config.OpenTSDBAddress == "" {
+		return fmt.Errorf("No valid OpenTSDB address: %s", config.OpenTSDBAddress)
+	}
+
+	ocfg := config.CfgOpenTSDBBackend
+	batchSize := ocfg.BatchSize
+	if i, err := strconv.Atoi(os.Getenv(envOpenTSDBMaxMetrics)); err == nil && i > 0 {
+		batchSize = i
+	}
+	if batchSize <= 0 {
+		batchSize = SD_OTSDB_MAXMETRICS
+	}
+	workers := ocfg.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	TSDB := tsdb.TSDB{}
+	server := tsdb.Server{}
+	serverAdress := strings.Split(config.OpenTSDBAddress, ":")
+	if len(serverAdress) != 2 {
+		return fmt.Errorf("Incorrect OpenTSDB server address %v", serverAdress)
+	}
+	port, err := strconv.ParseUint(serverAdress[1], 10, 32)
+	if err != nil {
+		return err
+	}
+	server.Host = serverAdress[0]
+	server.Port = uint(port)
+	TSDB.Servers = append(TSDB.Servers, server)
+
+	datapoints, err := tsdbDataPoints(buffer)
+	if err != nil {
+		return err
+	}
+	if len(datapoints) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithDeadline(context.Background(), deadline)
+	defer cancel()
+
+	batches := make(chan []tsdb.DataPoint)
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		errs   []error
+		failed int
+	)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for batch := range batches {
+				if err := putWithRetry(ctx, &TSDB, client, batch, ocfg); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					failed++
+					mu.Unlock()
+				}
+			}
+		}()
 	}
+	for start := 0; start < len(datapoints); start += batchSize {
+		end := min(start+batchSize, len(datapoints))
+		batches <- datapoints[start:end]
+	}
+	close(batches)
+	wg.Wait()
+
+	numBatches := (len(datapoints) + batchSize - 1) / batchSize
+	if failed > 0 {
+		return fmt.Errorf("%d of %d OpenTSDB requests failed: %w", failed, numBatches, errors.Join(errs...))
+	}
+
+	logCtx.Infof("sent %d stats to %s", len(datapoints), config.OpenTSDBAddress)
+	return nil
+}
+
+// putWithRetry sends one request, resending the points listed as failed in
+// the response up to 'retries' times. A request failing as a whole is
+// retried too. Retries wait 'retry-backoff', doubled each time.
+func putWithRetry(ctx context.Context, t *tsdb.TSDB, client *http.Client, batch []tsdb.DataPoint, ocfg ConfigOpenTSDBBackend) error {
+	logCtx := log.WithFields(log.Fields{
+		"in": "putWithRetry",
+	})
 
-	if config.OpenTSDBAddress != "-" && config.OpenTSDBAddress != "" {
-		datapoints := []tsdb.DataPoint{}
-		TSDB := tsdb.TSDB{}
-		server := tsdb.Server{}
-		serverAdress := strings.Split(config.OpenTSDBAddress, ":")
-		if len(serverAdress) != 2 {
-			return fmt.Errorf("Incorrect OpenTSDB server address %v", serverAdress)
+	pending := batch
+	backoff := time.Duration(ocfg.RetryBackoff) * time.Millisecond
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			if err := sleepContext(ctx, backoff); err != nil {
+				return err
+			}
+			backoff *= 2
 		}
-		port, err := strconv.ParseUint(serverAdress[1], 10, 32)
+		out, err := t.PutContext(ctx, client, pending, ocfg.Gzip)
 		if err != nil {
+			if attempt < ocfg.Retries && ctx.Err() == nil {
+				continue
+			}
 			return err
 		}
-		server.Host = serverAdress[0]
-		server.Port = uint(port)
-		TSDB.Servers = append(TSDB.Servers, server)
-
-		metrics := strings.Split(buffer.String(), "\n")
-		metrics = removeEmptyLines(metrics)
-		num := len(metrics)
-		currentMetricsNum := 0
-		for idx, mtr := range metrics {
-			// target format: cpu.load 12.50 112345566 host=dev,zone=west
-			data := strings.Split(mtr, " ")
-			if len(data) >= 3 {
-				metric := tsdb.Metric{}
-				value := tsdb.Value{}
-				tags := tsdb.Tags{}
-				timestamp := tsdb.Time{}
-				datapoint := tsdb.DataPoint{}
-
-				// parse value
-				// K/V values NOT allowed for OpenTSDB as metric
-				// TODO - consider setting them as tags
-				val, err := strconv.ParseFloat(data[1], 64)
-				if err != nil {
-					// continue on error in one metric
-					logCtx.Errorf("Only float/integer values allowed. Got: %s in line \"%s\". Error: %s", data[1], data, err)
-					Stat.OtherErrorsInc()
-					continue
-				}
-				value.Set(val)
-
-				// parse timestamp
-				err = timestamp.Parse(data[2])
-				if err != nil {
-					logCtx.Errorf("Timestamp expected. Got: %s in line \"%s\". Error: %s", data[2], data, err)
-					Stat.OtherErrorsInc()
-					continue
-				}
+		Stat.OpenTSDBAcceptedInc(int64(out.Success))
+		if out.Failed == 0 {
+			return nil
+		}
 
-				// parse metric/bucket
-				metricName := data[0]
-				err = metric.Set(metricName)
-				if err != nil {
-					logCtx.Errorf("Metric name expected. Got: %s in line \"%s\". Error: %s", data[0], data, err)
-					Stat.OtherErrorsInc()
-					continue
-				}
+		retry := failedDataPoints(pending, out.Errors)
+		if attempt >= ocfg.Retries || len(retry) == 0 || ctx.Err() != nil {
+			sout := []string{}
+			for _, elem := range out.Errors {
+				sout = append(sout, elem.Error)
+			}
+			logCtx.Errorf("OpenTSDB rejected %d of %d points: %s", out.Failed, len(pending), strings.Join(sout, "; "))
+			Stat.OpenTSDBRejectedInc(int64(out.Failed))
+			return nil
+		}
+		pending = retry
+	}
+}
 
-				if len(data) == 4 {
-					combinedTagsSlice := strings.Split(data[3], ",")
-					if len(combinedTagsSlice) > 0 {
-						for _, e := range combinedTagsSlice {
-							strSlice := strings.Split(e, "=")
-							if len(strSlice) == 2 {
-								if strSlice[0] == "" || strSlice[1] == "" {
-									logCtx.Errorf("Tag  expected. Got: %s in line \"%s\"", e, data)
-									Stat.OtherErrorsInc()
-									continue
-								}
-								tags.Set(strSlice[0], strSlice[1])
-							}
-						}
-					}
-				}
+// sleepContext waits d or until ctx is done.
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
-				datapoint.Value = &value
-				datapoint.Metric = &metric
-				datapoint.Tags = &tags
-				datapoint.Timestamp = &timestamp
-				datapoints = append(datapoints, datapoint)
-				currentMetricsNum++
-				// FIXME - heuristic that 10 is low enough to be accepted by OpenTSDB or env variable STATSDAEMON_MAXMETRICS
-				if (currentMetricsNum%maxMetrics == 0) || idx == num-1 {
-					out, err := TSDB.Put(datapoints)
-					if len(out.Errors) > 0 || err != nil {
-						sout := []string{}
-						for _, elem := range out.Errors {
-							sout = append(sout, elem.Error)
-						}
-						logCtx.Errorf("OpenTSDB.Put return: %s, error: %s", strings.Join(sout, "; "), err)
-					}
-					if err != nil {
-						return err
-					}
-					datapoints = []tsdb.DataPoint{}
-				}
-			} else {
-				logCtx.Errorf("Buffer format. Expected \"metric value timestamp\". Got \"%s\"", mtr)
-				Stat.OtherErrorsInc()
-			}
+// failedDataPoints picks the points listed in put errors out of sent.
+func failedDataPoints(sent []tsdb.DataPoint, putErrors []tsdb.PutError) []tsdb.DataPoint {
+	failed := make(map[string]bool, len(putErrors))
+	for _, e := range putErrors {
+		if e.DataPoint != nil {
+			failed[tsdbPointKey(*e.DataPoint)] = true
+		}
+	}
+	var out []tsdb.DataPoint
+	for _, dp := range sent {
+		if failed[tsdbPointKey(dp)] {
+			out = append(out, dp)
+		}
+	}
+	return out
+}
+
+// tsdbPointKey identifies a datapoint by metric, timestamp and tags.
+func tsdbPointKey(dp tsdb.DataPoint) string {
+	var metric, tags string
+	var ts int64
+	if dp.Metric != nil {
+		metric = dp.Metric.Get()
+	}
+	if dp.Timestamp != nil {
+		ts = dp.Timestamp.Time().Unix()
+	}
+	if dp.Tags != nil {
+		if b, err := dp.Tags.MarshalJSON(); err == nil && string(b) != "null" && string(b) != "{}" {
+			tags = string(b)
+		}
+	}
+	return fmt.Sprintf("%s %d %s", metric, ts, tags)
+}
 
+// renderOpenTSDB writes the points as /api/put datapoints, one JSON object
+// per line. Key/value points have no numeric value and are skipped, points
+// without tags get default-tags.
+func renderOpenTSDB(points []outputPoint) *bytes.Buffer {
+	logCtx := log.WithFields(log.Fields{
+		"in": "renderOpenTSDB",
+	})
+
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	for _, p := range points {
+		if p.Kind == kindKeyValue {
+			continue
 		}
+		metric := tsdb.Metric{}
+		value := tsdb.Value{}
+		tags := tsdb.Tags{}
+		timestamp := tsdb.Time{}
 
-		logCtx.Infof("sent %d stats to %s", currentMetricsNum, config.OpenTSDBAddress)
+		pointTags, ok := tsdbTags(p)
+		if !ok {
+			continue
+		}
+		if err := value.Set(p.Value); err != nil {
+			logCtx.Errorf("Only float/integer values allowed. Got: %v of %s", p.Value, p.metric())
+			Stat.OtherErrorsInc()
+			continue
+		}
+		if err := timestamp.Parse(strconv.FormatInt(p.When, 10)); err != nil {
+			logCtx.Errorf("Invalid timestamp %d of %s: %s", p.When, p.metric(), err)
+			Stat.OtherErrorsInc()
+			continue
+		}
+		metric.Set(p.metric())
+		for k, v := range pointTags {
+			tags.Set(k, v)
+		}
 
-		return nil
+		if err := enc.Encode(tsdb.DataPoint{Timestamp: &timestamp, Metric: &metric, Value: &value, Tags: &tags}); err != nil {
+			logCtx.Errorf("Encoding %s failed: %s", p.metric(), err)
+			Stat.OtherErrorsInc()
+		}
+	}
+	return &out
+}
 
+// tsdbTags returns the tags of a point, default-tags when it has none. Points
+// left without tags are refused by OpenTSDB, they are logged and counted.
+func tsdbTags(p outputPoint) (map[string]string, bool) {
+	if len(p.Tags) > 0 {
+		return p.Tags, true
 	}
-	return fmt.Errorf("No valid OpenTSDB address: %s", config.OpenTSDBAddress)
+	if tags := Config.CfgOpenTSDBBackend.DefaultTags; len(tags) > 0 {
+		return tags, true
+	}
+	log.WithFields(log.Fields{
+		"in": "tsdbTags",
+	}).Debugf("%s has no tags and opentsdb-backend default-tags is empty, skipped", p.metric())
+	Stat.OpenTSDBTaglessInc()
+	return nil, false
+}
 
+// tsdbDataPoints reads the datapoints written by renderOpenTSDB.
+func tsdbDataPoints(buffer *bytes.Buffer) ([]tsdb.DataPoint, error) {
+	datapoints := []tsdb.DataPoint{}
+	dec := json.NewDecoder(bytes.NewReader(buffer.Bytes()))
+	for dec.More() {
+		var dp tsdb.DataPoint
+		if err := dec.Decode(&dp); err != nil {
+			return datapoints, fmt.Errorf("invalid datapoint: %s", err)
+		}
+		datapoints = append(datapoints, dp)
+	}
+	return datapoints, nil
 }
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// opentsdbTelnetBackend streams "put" lines to OpenTSDB (or a tcollector
+// style relay) keeping the connection open across flushes.
+type opentsdbTelnetBackend struct {
+	mu          sync.Mutex
+	addr        string
+	readTimeout time.Duration
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+
+	conn     net.Conn
+	reader   *bufio.Reader
+	backoff  time.Duration
+	nextDial time.Time
+}
+
+func newOpenTSDBTelnetBackend(addr string, ocfg ConfigOpenTSDBBackend) *opentsdbTelnetBackend {
+	return &opentsdbTelnetBackend{
+		addr:        addr,
+		readTimeout: time.Duration(ocfg.ErrorReadTimeout) * time.Millisecond,
+		minBackoff:  time.Duration(ocfg.ReconnectBackoff) * time.Second,
+		maxBackoff:  time.Duration(ocfg.MaxReconnectBackoff) * time.Second,
+	}
+}
+
+// Send writes the batch of put lines and reads back error responses. A
+// rejected put is logged and counted but does not fail the batch, resending
+// it would be refused again.
+func (b *opentsdbTelnetBackend) Send(buf *bytes.Buffer, deadline time.Time) error {
+	logCtx := log.WithFields(log.Fields{
+		"in": "opentsdbTelnetBackend Send",
+	})
+
+	data := buf.Bytes()
+	num := bytes.Count(data, []byte("\n"))
+	if num == 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if err := b.connect(deadline); err != nil {
+		return err
+	}
+	if err := b.conn.SetWriteDeadline(deadline); err != nil {
+		b.close()
+		return err
+	}
+	if _, err := b.conn.Write(data); err != nil {
+		b.close()
+		return fmt.Errorf("failed to write stats to opentsdb %s: %s", b.addr, err)
+	}
+
+	wait := b.readTimeout
+	if left := time.Until(deadline); left < wait {
+		wait = left
+	}
+	responses, err := b.drain(wait)
+	if len(responses) > 0 {
+		logCtx.Errorf("OpenTSDB %s rejected %d of %d points: %s", b.addr, len(responses), num, strings.Join(responses, "; "))
+		Stat.OpenTSDBRejectedInc(int64(len(responses)))
+	}
+	Stat.OpenTSDBAcceptedInc(int64(num - len(responses)))
+	if err != nil {
+		// written, but the server hung up - reconnect on the next flush
+		b.close()
+	}
+
+	logCtx.Infof("sent %d stats to %s", num, b.addr)
+	return nil
+}
+
+// putLines writes the points as telnet put lines:
+//
+//	put cpu.load 1700000000 12.5 host=h1 zone=west
+//
+// Key/value points have no numeric value and are skipped, points without tags
+// get default-tags.
+func putLines(points []outputPoint) *bytes.Buffer {
+	var out bytes.Buffer
+	for _, p := range points {
+		if p.Kind == kindKeyValue {
+			continue
+		}
+		tags, ok := tsdbTags(p)
+		if !ok {
+			continue
+		}
+		fmt.Fprintf(&out, "put %s %d %s", p.metric(), p.When, pointValue(p.Value))
+		for _, t := range tagsToSortedSlice(tags) {
+			fmt.Fprintf(&out, " %s=%s", t.Key, t.Val)
+		}
+		out.WriteByte('\n')
+	}
+	return &out
+}
+
+// drain reads the error lines OpenTSDB sent within wait. A non-nil error
+// means the connection is closed.
+func (b *opentsdbTelnetBackend) drain(wait time.Duration) ([]string, error) {
+	if err := b.conn.SetReadDeadline(time.Now().Add(wait)); err != nil {
+		return nil, err
+	}
+	var lines []string
+	for {
+		line, err := b.reader.ReadString('\n')
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			return lines, nil
+		}
+		if err != nil {
+			return lines, err
+		}
+	}
+}
+
+// connect makes sure the connection is open, dialing it unless a previous
+// failure put it in backoff.
+func (b *opentsdbTelnetBackend) connect(deadline time.Time) error {
+	if b.conn != nil {
+		// leftovers from an earlier batch are rejections too
+		responses, err := b.drain(time.Millisecond)
+		if len(responses) > 0 {
+			Stat.OpenTSDBRejectedInc(int64(len(responses)))
+		}
+		if err == nil {
+			return nil
+		}
+		b.close()
+	}
+
+	now := time.Now()
+	if now.Before(b.nextDial) {
+		return fmt.Errorf("opentsdb %s in reconnect backoff until %s", b.addr, b.nextDial.Format(time.RFC3339))
+	}
+
+	conn, err := net.DialTimeout("tcp", b.addr, deadline.Sub(now))
+	if err != nil {
+		if b.backoff == 0 {
+			b.backoff = b.minBackoff
+		} else {
+			b.backoff *= 2
+		}
+		if b.maxBackoff > 0 && b.backoff > b.maxBackoff {
+			b.backoff = b.maxBackoff
+		}
+		b.nextDial = now.Add(b.backoff)
+		Stat.OpenTSDBConnectFailInc()
+		return fmt.Errorf("dialing %s failed - %s", b.addr, err)
+	}
+
+	log.WithFields(log.Fields{
+		"in": "opentsdbTelnetBackend",
+	}).Infof("connected to %s", b.addr)
+	b.conn = conn
+	b.reader = bufio.NewReader(conn)
+	b.backoff = 0
+	b.nextDial = time.Time{}
+	return nil
+}
+
+func (b *opentsdbTelnetBackend) close() {
+	if b.conn == nil {
+		return
+	}
+	b.conn.Close()
+	b.conn = nil
+	b.reader = nil
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// tsdbTelnetStub answers puts of metrics starting with "bad" with an error
+// line, like OpenTSDB does for rejected points.
+func newTSDBTelnetStub(t *testing.T) (net.Listener, *int64) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var conns int64
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt64(&conns, 1)
+			go func(c net.Conn) {
+				defer c.Close()
+				sc := bufio.NewScanner(c)
+				for sc.Scan() {
+					if strings.HasPrefix(sc.Text(), "put bad") {
+						c.Write([]byte("put: illegal argument: Need at least one tag\n"))
+					}
+				}
+			}(conn)
+		}
+	}()
+	return ln, &conns
+}
+
+func TestPutLines(t *testing.T) {
+	points := []outputPoint{
+		{Kind: kindGauge, Name: "cpu.load", Tags: map[string]string{"zone": "west", "host": "h1"}, Value: 12.5, When: 1700000000},
+		{Kind: kindKeyValue, Name: "kv.build", Value: "abc", When: 1700000000},
+		{Kind: kindTimer, Name: "api.time", Stat: "upper_90", Tags: map[string]string{"host": "h1"}, Value: 30.0, When: 1700000000},
+		{Kind: kindCounter, Name: "calls", Value: int64(5), When: 1700000000},
+	}
+	want := "put cpu.load 1700000000 12.5 host=h1 zone=west\n" +
+		"put api.time.upper_90 1700000000 30 host=h1\n"
+
+	// OpenTSDB refuses points without tags
+	Stat.ProcessStats(packetCache, nameCache)
+	if got := putLines(points).String(); got != want {
+		t.Errorf("putLines = %q, want %q", got, want)
+	}
+	Stat.ProcessStats(packetCache, nameCache)
+	if got := Stat.savedStat.OpenTSDBTagless; got != 1 {
+		t.Errorf("OpenTSDBTagless = %d, want 1", got)
+	}
+
+	Config.CfgOpenTSDBBackend.DefaultTags = map[string]string{"host": "statsd"}
+	defer func() { Config.CfgOpenTSDBBackend.DefaultTags = nil }()
+	want += "put calls 1700000000 5 host=statsd\n"
+	if got := putLines(points).String(); got != want {
+		t.Errorf("putLines with default-tags = %q, want %q", got, want)
+	}
+}
+
+func TestOpenTSDBTelnetBackend(t *testing.T) {
+	ln, conns := newTSDBTelnetStub(t)
+	defer ln.Close()
+
+	b := newOpenTSDBTelnetBackend(ln.Addr().String(), ConfigOpenTSDBBackend{ErrorReadTimeout: 100})
+	Stat.ProcessStats(packetCache, nameCache)
+
+	batch := "put good 1700000000 1 host=h1\nput bad.one 1700000000 1\nput bad.two 1700000000 2\n"
+	for i := 0; i < 2; i++ {
+		if err := b.Send(bytes.NewBufferString(batch), time.Now().Add(time.Second)); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+
+	if n := atomic.LoadInt64(conns); n != 1 {
+		t.Errorf("connections = %d, want 1 (connection should be kept open)", n)
+	}
+	Stat.ProcessStats(packetCache, nameCache)
+	if got := Stat.savedStat.OpenTSDBRejected; got != 4 {
+		t.Errorf("OpenTSDBRejected = %d, want 4", got)
+	}
+}
+
+func TestOpenTSDBTelnetReconnect(t *testing.T) {
+	b := newOpenTSDBTelnetBackend("127.0.0.1:1", ConfigOpenTSDBBackend{ReconnectBackoff: 60})
+	if err := b.Send(bytes.NewBufferString("put m 1700000000 1 host=h1\n"), time.Now().Add(time.Second)); err == nil {
+		t.Fatal("expected dial error")
+	}
+	err := b.Send(bytes.NewBufferString("put m 1700000000 1 host=h1\n"), time.Now().Add(time.Second))
+	if err == nil || !strings.Contains(err.Error(), "backoff") {
+		t.Errorf("expected backoff error, got %v", err)
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// tsdbPutStub fakes /api/put?details: points of "bad.*" metrics are always
+// rejected, "flaky.*" ones only the first time they are seen.
+type tsdbPutStub struct {
+	mu       sync.Mutex
+	requests int
+	seen     map[string]bool
+	delay    time.Duration
+}
+
+func (s *tsdbPutStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	time.Sleep(s.delay)
+	var body io.Reader = r.Body
+	if r.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		body = zr
+	}
+	var points []map[string]any
+	if err := json.NewDecoder(body).Decode(&points); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests++
+	type putError struct {
+		Datapoint map[string]any `json:"datapoint"`
+		Error     string         `json:"error"`
+	}
+	resp := struct {
+		Success int        `json:"success"`
+		Failed  int        `json:"failed"`
+		Errors  []putError `json:"errors"`
+	}{Errors: []putError{}}
+	for _, p := range points {
+		metric := p["metric"].(string)
+		key := fmt.Sprint(p)
+		if strings.HasPrefix(metric, "bad.") || (strings.HasPrefix(metric, "flaky.") && !s.seen[key]) {
+			s.seen[key] = true
+			resp.Failed++
+			resp.Errors = append(resp.Errors, putError{Datapoint: p, Error: "Unable to write"})
+			continue
+		}
+		resp.Success++
+	}
+	if resp.Failed > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	json.NewEncoder(w).Encode(resp)
+}
+
+func tsdbTestConfig(addr string) ConfigApp {
+	cfg := ConfigApp{OpenTSDBAddress: strings.TrimPrefix(addr, "http://")}
+	cfg.CfgOpenTSDBBackend = ConfigOpenTSDBBackend{BatchSize: 2, Workers: 3, Gzip: true, Retries: 1}
+	return cfg
+}
+
+// tsdbTestBatch - a single ok.a point
+func tsdbTestBatch() *bytes.Buffer {
+	return renderOpenTSDB([]outputPoint{{Kind: kindCounter, Name: "ok.a", Tags: map[string]string{"host": "h1"}, Value: int64(1), When: 1700000000}})
+}
+
+func TestOpenTSDBHTTP(t *testing.T) {
+	stub := &tsdbPutStub{seen: map[string]bool{}}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	b := opentsdbBackend{cfg: tsdbTestConfig(srv.URL), client: &http.Client{}}
+	h1 := map[string]string{"host": "h1"}
+	batch := renderOpenTSDB([]outputPoint{
+		{Kind: kindCounter, Name: "ok.a", Tags: h1, Value: int64(1), When: 1700000000},
+		{Kind: kindGauge, Name: "ok.b", Tags: h1, Value: 2.5, When: 1700000000},
+		{Kind: kindCounter, Name: "flaky.a", Tags: h1, Value: int64(3), When: 1700000000},
+		{Kind: kindCounter, Name: "bad.a", Tags: h1, Value: int64(4), When: 1700000000},
+		{Kind: kindKeyValue, Name: "kv.build", Value: "abc", When: 1700000000},
+	})
+
+	Stat.ProcessStats(packetCache, nameCache)
+	if err := b.Send(batch, time.Now().Add(2*time.Second)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	Stat.ProcessStats(packetCache, nameCache)
+
+	if got := Stat.savedStat.OpenTSDBAccepted; got != 3 {
+		t.Errorf("OpenTSDBAccepted = %d, want 3", got)
+	}
+	if got := Stat.savedStat.OpenTSDBRejected; got != 1 {
+		t.Errorf("OpenTSDBRejected = %d, want 1", got)
+	}
+	// 2 batches plus one retry of the 2 failed points
+	if stub.requests != 3 {
+		t.Errorf("requests = %d, want 3", stub.requests)
+	}
+}
+
+func TestOpenTSDBHTTPDeadline(t *testing.T) {
+	stub := &tsdbPutStub{seen: map[string]bool{}, delay: 300 * time.Millisecond}
+	srv := httptest.NewServer(stub)
+	defer srv.Close()
+
+	b := opentsdbBackend{cfg: tsdbTestConfig(srv.URL), client: &http.Client{}}
+	start := time.Now()
+	err := b.Send(tsdbTestBatch(), time.Now().Add(50*time.Millisecond))
+	if err == nil {
+		t.Fatal("expected deadline error")
+	}
+	if time.Since(start) > 250*time.Millisecond {
+		t.Errorf("Send took %s, deadline not honored", time.Since(start))
+	}
+}
+
+func TestOpenTSDBHTTPRetryBackoff(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests []time.Time
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, time.Now())
+		if len(requests) < 3 {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"success":1,"failed":0,"errors":[]}`)
+	}))
+	defer srv.Close()
+
+	cfg := tsdbTestConfig(srv.URL)
+	cfg.CfgOpenTSDBBackend.Retries = 2
+	cfg.CfgOpenTSDBBackend.RetryBackoff = 50
+	b := opentsdbBackend{cfg: cfg, client: &http.Client{}}
+	if err := b.Send(tsdbTestBatch(), time.Now().Add(2*time.Second)); err != nil {
+		t.Fatalf("Send: %v", err)
+	}
+	if len(requests) != 3 {
+		t.Fatalf("requests = %d, want 3", len(requests))
+	}
+	// 50ms, then 100ms
+	if d := requests[1].Sub(requests[0]); d < 50*time.Millisecond {
+		t.Errorf("first retry after %s, want >= 50ms", d)
+	}
+	if d := requests[2].Sub(requests[1]); d < 100*time.Millisecond {
+		t.Errorf("second retry after %s, want >= 100ms", d)
+	}
+}
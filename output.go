@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Metric kinds of the flush output points.
+const (
+	kindCounter      = "counter"
+	kindGauge        = "gauge"
+	kindTimer        = "timer"
+	kindHistogram    = "histogram"
+	kindDistribution = "distribution"
+	kindSet          = "set"
+	kindKeyValue     = "kv"
+)
+
+// outputPoint is one point of the flush output, as written by the process*
+// functions. Every backend format is rendered from these, so names, tags and
+// values never have to be parsed back from text.
+type outputPoint struct {
+	Kind string
+	// Name - metric name without tags and, for timers, histograms and
+	// distributions, without the statistic
+	Name string
+	// Stat - statistic of a timer, histogram or distribution, eg. upper_90 or
+	// histogram.bin_100; empty for other kinds
+	Stat string
+	// Tags - bucket tags, with extra-tags
+	Tags map[string]string
+	// Value - int, int64, float64 or, for key/value, string
+	Value any
+	When  int64
+	// Timed - When is a client timestamp (|T), the value is not aggregated
+	// with the points of the flush time
+	Timed bool
+	// TypedOnly - written only in the "typed" format: count and sum of
+	// timers and distributions Prometheus needs for _count and _sum even when
+	// they are not selected in timer-stats
+	TypedOnly bool
+}
+
+// metric returns the full metric name, eg. api.time.upper_90.
+func (p outputPoint) metric() string {
+	if p.Stat == "" {
+		return p.Name
+	}
+	return p.Name + "." + p.Stat
+}
+
+// newPoint returns a point of kind for a bucket with tags in tfCaret form.
+func newPoint(kind, bucket string, value any, when int64) outputPoint {
+	name, tags, err := parseBucketAndTags(bucket)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"in": "newPoint",
+		}).Errorf("parseBucketAndTags error: %s", err)
+		Stat.PointsParseFailInc()
+	}
+	return outputPoint{Kind: kind, Name: name, Tags: tags, Value: value, When: when}
+}
+
+// pointWriter receives the points of a flush.
+type pointWriter interface {
+	writePoint(p outputPoint)
+}
+
+// textWriter formats points as lines of one of the text formats
+// formatMetricOutput knows.
+type textWriter struct {
+	buf    *bytes.Buffer
+	format string
+}
+
+func (w textWriter) writePoint(p outputPoint) {
+	if p.TypedOnly {
+		return
+	}
+	fmt.Fprintf(w.buf, "%s\n", formatPoint(p.metric(), p.Tags, p.Value, p.When, w.format))
+}
+
+// flushOutput collects the points of one flush in the order they are written.
+type flushOutput []outputPoint
+
+func (o *flushOutput) writePoint(p outputPoint) {
+	*o = append(*o, p)
+}
+
+// render serializes the points in the given backend format.
+func (o flushOutput) render(format string) *bytes.Buffer {
+	if format == "typed" {
+		return renderTyped(o)
+	}
+	var points flushOutput
+	for _, p := range o {
+		if !p.TypedOnly {
+			points = append(points, p)
+		}
+	}
+	o = points
+
+	switch format {
+	case "influxdb":
+		return renderInflux(o)
+	case "opentsdb":
+		return renderOpenTSDB(o)
+	case "opentsdb-telnet":
+		return putLines(o)
+	}
+	var out bytes.Buffer
+	w := textWriter{buf: &out, format: format}
+	for _, p := range o {
+		w.writePoint(p)
+	}
+	return &out
+}
+
+// typedPoint is a point in the "typed" format, one JSON object per line:
+//
+//	{"kind":"timer","name":"api.time","stat":"upper_90","tags":{"host":"h1"},"value":"30","when":1700000000}
+type typedPoint struct {
+	Kind  string            `json:"kind"`
+	Name  string            `json:"name"`
+	Stat  string            `json:"stat,omitempty"`
+	Tags  map[string]string `json:"tags,omitempty"`
+	Value string            `json:"value"`
+	When  int64             `json:"when"`
+	Timed bool              `json:"timed,omitempty"`
+}
+
+// renderTyped writes the points in the "typed" format. Values are strings, so
+// integers stay integers and infinities survive the encoding.
+func renderTyped(points []outputPoint) *bytes.Buffer {
+	var out bytes.Buffer
+	enc := json.NewEncoder(&out)
+	for _, p := range points {
+		// a plain struct of strings always encodes
+		enc.Encode(typedPoint{Kind: p.Kind, Name: p.Name, Stat: p.Stat, Tags: p.Tags, Value: pointValue(p.Value), When: p.When, Timed: p.Timed})
+	}
+	return &out
+}
+
+// parseTyped reads points written by renderTyped. Values are float64, or
+// strings for key/value points.
+func parseTyped(data []byte) ([]outputPoint, error) {
+	var points []outputPoint
+	dec := json.NewDecoder(bytes.NewReader(data))
+	for dec.More() {
+		var t typedPoint
+		if err := dec.Decode(&t); err != nil {
+			return points, fmt.Errorf("invalid typed point: %s", err)
+		}
+		p := outputPoint{Kind: t.Kind, Name: t.Name, Stat: t.Stat, Tags: t.Tags, Value: t.Value, When: t.When, Timed: t.Timed}
+		if t.Kind != kindKeyValue {
+			v, err := strconv.ParseFloat(t.Value, 64)
+			if err != nil {
+				return points, fmt.Errorf("invalid value %q of %s", t.Value, p.metric())
+			}
+			p.Value = v
+		}
+		points = append(points, p)
+	}
+	return points, nil
+}
+
+// pointValue formats a value with full precision.
+func pointValue(value any) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case int:
+		return strconv.Itoa(v)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// pointFloat returns the value of a numeric point.
+func pointFloat(value any) (float64, bool) {
+	switch v := value.(type) {
+	case int:
+		return float64(v), true
+	case int64:
+		return float64(v), true
+	case float64:
+		return v, true
+	}
+	return 0, false
+}
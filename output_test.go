@@ -0,0 +1,44 @@
+package main
+
+import (
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestFlushOutputRender(t *testing.T) {
+	Config.ExtraTagsHash = map[string]string{}
+	var out flushOutput
+	out.writePoint(outputPoint{Kind: kindCounter, Name: "a.b", Value: int64(1), When: 1700000000})
+	out.writePoint(outputPoint{Kind: kindTimer, Name: "c.d", Stat: "mean", Tags: map[string]string{"env": "prod", "host": "web1"}, Value: 2.0, When: 1700000000})
+
+	tests := map[string]string{
+		"external": "a.b 1 1700000000\nc.d.mean 2.000000 1700000000 env=prod,host=web1\n",
+		"graphite": "a.b 1 1700000000\nc.d.mean._t_.env.prod.host.web1 2.000000 1700000000\n",
+	}
+	for format, want := range tests {
+		if got := out.render(format).String(); got != want {
+			t.Errorf("render(%s) = %q, want %q", format, got, want)
+		}
+	}
+}
+
+func TestRenderTyped(t *testing.T) {
+	points := []outputPoint{
+		{Kind: kindCounter, Name: "c", Tags: map[string]string{"path": "/a b,c=d"}, Value: int64(5), When: 1700000000},
+		{Kind: kindTimer, Name: "t", Stat: "upper_90", Value: math.Inf(1), When: 1700000000},
+		{Kind: kindKeyValue, Name: "kv", Value: "a b", When: 1700000000},
+	}
+	got, err := parseTyped(renderTyped(points).Bytes())
+	if err != nil {
+		t.Fatalf("parseTyped: %v", err)
+	}
+	want := []outputPoint{
+		{Kind: kindCounter, Name: "c", Tags: map[string]string{"path": "/a b,c=d"}, Value: 5.0, When: 1700000000},
+		{Kind: kindTimer, Name: "t", Stat: "upper_90", Value: math.Inf(1), When: 1700000000},
+		{Kind: kindKeyValue, Name: "kv", Value: "a b", When: 1700000000},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parseTyped(renderTyped) = %+v, want %+v", got, want)
+	}
+}
@@ -39,9 +39,17 @@ type Packet struct {
 	Value    any
 	Modifier string
 	Sampling float32
+	// Timestamp - client supplied unix time of a counter or gauge, 0 - none
+	Timestamp int64
 }
 
 func parseTo(conn io.ReadCloser, partialReads bool, out chan<- *Packet) {
+	parseWith(conn, partialReads, func(p *Packet) { out <- p })
+}
+
+// parseWith reads packets from conn until it is closed and passes each to
+// deliver.
+func parseWith(conn io.ReadCloser, partialReads bool, deliver func(*Packet)) {
 
 	defer conn.Close()
 
@@ -49,7 +57,7 @@ func parseTo(conn io.ReadCloser, partialReads bool, out chan<- *Packet) {
 	for {
 		p, more := parser.Next()
 		if p != nil {
-			out <- p
+			deliver(p)
 		}
 
 		if !more {
@@ -64,11 +72,15 @@ type MsgParser struct {
 	buffer       []byte
 	partialReads bool
 	done         bool
+	// pending - packets of the last line not returned yet, more - whether
+	// more data followed it
+	pending     []*Packet
+	pendingMore bool
 }
 
 // NewParser - for UDP/TCP packet
 func NewParser(reader io.Reader, partialReads bool) *MsgParser {
-	return &MsgParser{reader, []byte{}, partialReads, false}
+	return &MsgParser{reader: reader, buffer: []byte{}, partialReads: partialReads}
 }
 
 // Next - for reading whole meter data from packet
@@ -79,6 +91,12 @@ func (mp *MsgParser) Next() (*Packet, bool) {
 		"in":  "MsgParser Next",
 		"ctx": "Parse packet",
 	})
+	if len(mp.pending) > 0 {
+		p := mp.pending[0]
+		mp.pending = mp.pending[1:]
+		return p, mp.pendingMore || len(mp.pending) > 0
+	}
+
 	buf := mp.buffer
 
 	for {
@@ -87,11 +105,11 @@ func (mp *MsgParser) Next() (*Packet, bool) {
 
 		if line != nil {
 			mp.buffer = rest
-			return parseLine(line), true
+			return mp.parse(line, true)
 		}
 
 		if mp.done {
-			return parseLine(rest), false
+			return mp.parse(rest, false)
 		}
 
 		idx := len(buf)
@@ -123,11 +141,11 @@ func (mp *MsgParser) Next() (*Packet, bool) {
 			line, rest = mp.lineFrom(buf)
 			if line != nil {
 				mp.buffer = rest
-				return parseLine(line), len(rest) > 0
+				return mp.parse(line, len(rest) > 0)
 			}
 
 			if len(rest) > 0 {
-				return parseLine(rest), false
+				return mp.parse(rest, false)
 			}
 
 			return nil, false
@@ -135,6 +153,17 @@ func (mp *MsgParser) Next() (*Packet, bool) {
 	}
 }
 
+// parse returns the first packet of line and keeps the others for the next
+// calls of Next.
+func (mp *MsgParser) parse(line []byte, more bool) (*Packet, bool) {
+	packets := parsePackets(line)
+	if len(packets) == 0 {
+		return nil, more
+	}
+	mp.pending, mp.pendingMore = packets[1:], more
+	return packets[0], more || len(mp.pending) > 0
+}
+
 func (mp *MsgParser) lineFrom(input []byte) ([]byte, []byte) {
 
 	split := bytes.SplitAfterN(input, []byte("\n"), 2)
@@ -156,7 +185,19 @@ func (mp *MsgParser) lineFrom(input []byte) ([]byte, []byte) {
 	return nil, input
 }
 
+// parseLine returns the first packet of line, see parsePackets.
 func parseLine(line []byte) *Packet {
+	packets := parsePackets(line)
+	if len(packets) == 0 {
+		return nil
+	}
+	return packets[0]
+}
+
+// parsePackets parses a line, a packet for each of its values: numeric types
+// accept several colon separated values (timer:10:20:30|ms), each with the
+// sampling rate of the line.
+func parsePackets(line []byte) []*Packet {
 
 	if Config.CfgDebugMetrics.Enabled {
 		if prefixPresent(string(line), Config.CfgDebugMetrics.Patterns) {
@@ -173,13 +214,13 @@ func parseLine(line []byte) *Packet {
 
 			Stat.PointTypeInc(&cachedPacket)
 			Stat.PacketCacheHit()
-			return &cachedPacket
+			return []*Packet{&cachedPacket}
 		}
 	}
 
 	Stat.PacketCacheMiss()
 
-	split := bytes.SplitN(line, []byte{'|'}, 3)
+	split := bytes.Split(line, []byte{'|'})
 	if len(split) < 2 {
 		log.WithField("in", "parseLine").Errorf("Failed to parse line: %s", string(line))
 		Stat.PointsParseFailInc()
@@ -187,19 +228,46 @@ func parseLine(line []byte) *Packet {
 	}
 
 	keyval := split[0]
-	typeCode := string(split[1]) // expected c, g, s, ms, kv
+	typeCode := string(split[1]) // expected c, g, s, ms, h, d, kv
 
 	sampling := float32(1)
-	// read sampling from line
-	if strings.HasPrefix(typeCode, "c") || strings.HasPrefix(typeCode, "ms") {
-		if len(split) == 3 && len(split[2]) > 0 && split[2][0] == '@' {
-			f64, err := strconv.ParseFloat(string(split[2][1:]), 32)
+	// DogStatsD tags section (|#env:prod,host:a), parsed with the bucket name
+	var dogTags string
+	// client timestamp section (|T1700000000)
+	var timestamp int64
+	for _, section := range split[2:] {
+		switch {
+		case len(section) == 0:
+		case section[0] == '@':
+			// read sampling from line
+			if typeCode != "c" && typeCode != "ms" && typeCode != "h" && typeCode != "d" {
+				continue
+			}
+			f64, err := strconv.ParseFloat(string(section[1:]), 32)
 			if err != nil {
-				log.WithField("in", "parseLine").Errorf("Failed to ParseFloat %s (%s) in line '%s'", string(split[2][1:]), err, line)
+				log.WithField("in", "parseLine").Errorf("Failed to ParseFloat %s (%s) in line '%s'", string(section[1:]), err, line)
 				Stat.PointsParseFailInc()
 				return nil
 			}
 			sampling = float32(f64)
+		case section[0] == '#':
+			dogTags = string(section[1:])
+		case section[0] == 'T':
+			if typeCode != "c" && typeCode != "g" {
+				continue
+			}
+			ts, err := parseTimestamp(section[1:])
+			if err == errTimestampSkew {
+				log.WithField("in", "parseLine").Warnf("Rejected line with %s: '%s'", err, line)
+				Stat.TimestampRejectedInc()
+				return nil
+			}
+			if err != nil {
+				log.WithField("in", "parseLine").Errorf("Failed to parse %s in line '%s'", err, line)
+				Stat.PointsParseFailInc()
+				return nil
+			}
+			timestamp = ts
 		}
 	}
 
@@ -212,81 +280,46 @@ func parseLine(line []byte) *Packet {
 	// raw bucket name from line
 	name := string(split[0])
 	val := split[1]
-	if len(val) == 0 {
-		log.WithField("in", "parseLine").Errorf("Failed to parse line: '%s'", line)
-		Stat.PointsParseFailInc()
-		return nil
+
+	vals := [][]byte{val}
+	switch typeCode {
+	case "c", "g", "ms", "h", "d":
+		if bytes.IndexByte(val, ':') >= 0 {
+			vals = bytes.Split(val, []byte{':'})
+		}
+	}
+	values := make([]any, len(vals))
+	for i, v := range vals {
+		value, ok := parseValue(typeCode, v, name, line)
+		if !ok {
+			return nil
+		}
+		values[i] = value
 	}
 
 	var (
 		err         error
-		value       any
 		bucket      string
 		cleanBucket string
 	)
 
-	switch typeCode {
-	case "c":
-		value, err = strconv.ParseInt(string(val), 10, 64)
-		if err != nil {
-			log.WithField("in", "parseLine").Errorf("Failed to ParseInt %s - %s, raw bucket: %s, line: `%s`", string(val), err, name, line)
-			Stat.PointsParseFailInc()
-			return nil
-		}
-	case "g":
-		var rel, neg bool
-		var s string
-
-		switch val[0] {
-		case '+':
-			rel = true
-			neg = false
-			s = string(val[1:])
-		case '-':
-			rel = true
-			neg = true
-			s = string(val[1:])
-		default:
-			rel = false
-			neg = false
-			s = string(val)
-		}
-
-		value, err = strconv.ParseFloat(s, 64)
-		if err != nil {
-			log.WithField("in", "parseLine").Errorf("Failed to ParseFloat %s - %s, raw bucket: %s, line: '%s'", string(val), err, name, line)
-			Stat.PointsParseFailInc()
-			return nil
-		}
-
-		value = GaugeData{rel, neg, value.(float64)}
-	case "s":
-		value = string(val)
-	case "ms":
-		value, err = strconv.ParseFloat(string(val), 64)
-		if err != nil {
-			log.WithField("in", "parseLine").Errorf("Failed to ParseFloat %s - %s, raw bucket: %s, line: '%s'", string(val), err, name, line)
-			Stat.PointsParseFailInc()
-			return nil
-		}
-	case "kv":
-		value = string(val) // Key/value should not need transformation
-	default:
-		log.WithField("in", "parseLine").Errorf("Unrecognized type code %q, raw bucket: %s, line: '%s'", typeCode, name, line)
-		Stat.PointsParseFailInc()
-		return nil
-	}
-
 	// parse tags from bucket name
 
 	type bucketNames struct {
 		bucket    string
 		srcBucket string
+		// rewrite-rules result
+		rewrite rewriteResult
 	}
 
 	var cachedBucket bucketNames
 
-	if val, found := nameCache.Get(string(name)); found {
+	cacheKey := name
+	if len(dogTags) > 0 {
+		cacheKey = name + "|#" + dogTags
+	}
+
+	if val, found := nameCache.Get(cacheKey); found {
 		Stat.NameCacheHit()
 		cachedBucket = val.(bucketNames)
 		bucket = cachedBucket.bucket
@@ -301,6 +334,25 @@ func parseLine(line []byte) *Packet {
 			Stat.PointsParseFailInc()
 			return nil
 		}
+		// caret tags win over DogStatsD tags
+		if len(dogTags) > 0 {
+			tagsFromBucketName = addTags(tagsFromBucketName, parseDogStatsDTags(dogTags))
+		}
+
+		var rewrite rewriteResult
+		cleanBucket, tagsFromBucketName, rewrite = rewriteMetric(Config.RewriteRules, cleanBucket, tagsFromBucketName)
+		if rewrite == rewriteDropped {
+			nameCache.Set(cacheKey, bucketNames{srcBucket: string(name), rewrite: rewrite}, cache.DefaultExpiration)
+			Stat.RewriteDroppedInc()
+			return nil
+		}
+		if len(sanitizeBucket(cleanBucket)) == 0 {
+			// logged once, cached packets are only counted
+			nameCache.Set(cacheKey, bucketNames{srcBucket: string(name), rewrite: rewriteEmpty}, cache.DefaultExpiration)
+			log.WithField("in", "parseLine").Errorf("Empty bucket name after rewrite of %s", string(name))
+			Stat.PointsParseFailInc()
+			return nil
+		}
 
 		//TODO use makeBucketName ?
 		// bucket is set to a name WITH tags
@@ -310,27 +362,107 @@ func parseLine(line []byte) *Packet {
 		}
 		bucket = Config.Prefix + sanitizeBucket(cleanBucket) + firstDelim + normalizeTags(addTags(tagsFromBucketName, Config.ExtraTagsHash), tfDefault)
 
-		cachedBucket = bucketNames{bucket: bucket, srcBucket: string(name)}
-		nameCache.Set(string(name), cachedBucket, cache.DefaultExpiration)
+		cachedBucket = bucketNames{bucket: bucket, srcBucket: string(name), rewrite: rewrite}
+		nameCache.Set(cacheKey, cachedBucket, cache.DefaultExpiration)
 	}
 
-	returnPacket := &Packet{
-		Bucket:   bucket,
-		Value:    value,
-		Modifier: typeCode,
-		Sampling: sampling,
+	switch cachedBucket.rewrite {
+	case rewriteDropped:
+		Stat.RewriteDroppedInc()
+		return nil
+	case rewriteEmpty:
+		Stat.PointsParseFailInc()
+		return nil
+	case rewriteChanged:
+		Stat.RewriteRewrittenInc()
 	}
 
-	Stat.PointTypeInc(returnPacket)
+	packets := make([]*Packet, len(values))
+	for i, value := range values {
+		packets[i] = &Packet{
+			Bucket:    bucket,
+			Value:     value,
+			Modifier:  typeCode,
+			Sampling:  sampling,
+			Timestamp: timestamp,
+		}
+		Stat.PointTypeInc(packets[i])
+	}
 
-	if usePacketCache {
+	// rewritten packets are not cached, they would skip the rewrite counter;
+	// neither are lines with several values or with a timestamp, which must be
+	// checked against timestamp-max-skew
+	if usePacketCache && cachedBucket.rewrite == rewriteNone && len(packets) == 1 && timestamp == 0 {
 		// add full packet to cache
-		if returnPacket.Modifier == "c" && returnPacket.Value.(int64) == 1 {
-			packetCache.Set(string(line), *returnPacket, cache.DefaultExpiration)
+		if typeCode == "c" && packets[0].Value.(int64) == 1 {
+			packetCache.Set(string(line), *packets[0], cache.DefaultExpiration)
 		}
 	}
 
-	return returnPacket
+	return packets
+}
+
+// parseValue parses a value of type typeCode; name and line are for error
+// messages.
+func parseValue(typeCode string, val []byte, name string, line []byte) (any, bool) {
+	if len(val) == 0 {
+		log.WithField("in", "parseLine").Errorf("Failed to parse line: '%s'", line)
+		Stat.PointsParseFailInc()
+		return nil, false
+	}
+
+	switch typeCode {
+	case "c":
+		value, err := strconv.ParseInt(string(val), 10, 64)
+		if err != nil {
+			log.WithField("in", "parseLine").Errorf("Failed to ParseInt %s - %s, raw bucket: %s, line: `%s`", string(val), err, name, line)
+			Stat.PointsParseFailInc()
+			return nil, false
+		}
+		return value, true
+	case "g":
+		var rel, neg bool
+		var s string
+
+		switch val[0] {
+		case '+':
+			rel = true
+			neg = false
+			s = string(val[1:])
+		case '-':
+			rel = true
+			neg = true
+			s = string(val[1:])
+		default:
+			rel = false
+			neg = false
+			s = string(val)
+		}
+
+		value, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			log.WithField("in", "parseLine").Errorf("Failed to ParseFloat %s - %s, raw bucket: %s, line: '%s'", string(val), err, name, line)
+			Stat.PointsParseFailInc()
+			return nil, false
+		}
+
+		return GaugeData{rel, neg, value}, true
+	case "s":
+		return string(val), true
+	case "ms", "h", "d":
+		value, err := strconv.ParseFloat(string(val), 64)
+		if err != nil {
+			log.WithField("in", "parseLine").Errorf("Failed to ParseFloat %s - %s, raw bucket: %s, line: '%s'", string(val), err, name, line)
+			Stat.PointsParseFailInc()
+			return nil, false
+		}
+		return value, true
+	case "kv":
+		return string(val), true // Key/value should not need transformation
+	}
+	log.WithField("in", "parseLine").Errorf("Unrecognized type code %q, raw bucket: %s, line: '%s'", typeCode, name, line)
+	Stat.PointsParseFailInc()
+	return nil, false
 }
 
 func sanitizeBucket(bucket string) string {
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// pickle opcodes (protocol 2) used to encode carbon's
+// [(path, (timestamp, value)), ...] message
+const (
+	pickleProto      = 0x80
+	pickleEmptyList  = ']'
+	pickleMark       = '('
+	pickleAppends    = 'e'
+	pickleStop       = '.'
+	pickleBinUnicode = 'X'
+	pickleBinInt     = 'J'
+	pickleLong1      = 0x8a
+	pickleBinFloat   = 'G'
+	pickleTuple2     = 0x86
+)
+
+// pickleMessages converts graphite plaintext lines into length-prefixed
+// pickled lists of at most maxBatch datapoints each, as expected by carbon's
+// pickle receiver. Lines with a non-numeric value are logged and skipped.
+func pickleMessages(data []byte, maxBatch int) [][]byte {
+	logCtx := log.WithFields(log.Fields{
+		"in": "pickleMessages",
+	})
+
+	var (
+		messages [][]byte
+		body     bytes.Buffer
+		n        int
+	)
+	flush := func() {
+		if n == 0 {
+			return
+		}
+		body.WriteByte(pickleAppends)
+		body.WriteByte(pickleStop)
+		msg := make([]byte, 4, 4+body.Len())
+		binary.BigEndian.PutUint32(msg, uint32(body.Len()))
+		messages = append(messages, append(msg, body.Bytes()...))
+		body.Reset()
+		n = 0
+	}
+
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		fields := bytes.Fields(line)
+		if len(fields) != 3 {
+			logCtx.Errorf("Buffer format. Expected \"metric value timestamp\". Got \"%s\"", line)
+			Stat.OtherErrorsInc()
+			continue
+		}
+		value, err := strconv.ParseFloat(string(fields[1]), 64)
+		if err != nil {
+			logCtx.Errorf("Only float/integer values allowed. Got: %s in line \"%s\"", fields[1], line)
+			Stat.OtherErrorsInc()
+			continue
+		}
+		ts, err := strconv.ParseInt(string(fields[2]), 10, 64)
+		if err != nil {
+			logCtx.Errorf("Timestamp expected. Got: %s in line \"%s\"", fields[2], line)
+			Stat.OtherErrorsInc()
+			continue
+		}
+
+		if n == 0 {
+			body.Write([]byte{pickleProto, 2, pickleEmptyList, pickleMark})
+		}
+		pickleDatapoint(&body, fields[0], ts, value)
+		n++
+		if n >= maxBatch {
+			flush()
+		}
+	}
+	flush()
+	return messages
+}
+
+// pickleDatapoint appends the (path, (timestamp, value)) tuple.
+func pickleDatapoint(buf *bytes.Buffer, path []byte, ts int64, value float64) {
+	var b [8]byte
+
+	buf.WriteByte(pickleBinUnicode)
+	binary.LittleEndian.PutUint32(b[:4], uint32(len(path)))
+	buf.Write(b[:4])
+	buf.Write(path)
+
+	if ts >= math.MinInt32 && ts <= math.MaxInt32 {
+		buf.WriteByte(pickleBinInt)
+		binary.LittleEndian.PutUint32(b[:4], uint32(int32(ts)))
+		buf.Write(b[:4])
+	} else {
+		buf.WriteByte(pickleLong1)
+		buf.WriteByte(8)
+		binary.LittleEndian.PutUint64(b[:], uint64(ts))
+		buf.Write(b[:])
+	}
+
+	buf.WriteByte(pickleBinFloat)
+	binary.BigEndian.PutUint64(b[:], math.Float64bits(value))
+	buf.Write(b[:])
+
+	buf.WriteByte(pickleTuple2)
+	buf.WriteByte(pickleTuple2)
+}
+
+// more pickle opcodes accepted by unpickle, carbon clients send protocol 0 to
+// 4 messages
+const (
+	pickleFrame           = 0x95
+	pickleList            = 'l'
+	pickleEmptyTuple      = ')'
+	pickleTuple           = 't'
+	pickleTuple1          = 0x85
+	pickleTuple3          = 0x87
+	pickleAppend          = 'a'
+	pickleShortBinUnicode = 0x8c
+	pickleUnicode         = 'V'
+	pickleString          = 'S'
+	pickleBinString       = 'T'
+	pickleShortBinString  = 'U'
+	pickleBinBytes        = 'B'
+	pickleShortBinBytes   = 'C'
+	pickleBinInt1         = 'K'
+	pickleBinInt2         = 'M'
+	pickleInt             = 'I'
+	pickleLong            = 'L'
+	pickleFloat           = 'F'
+	pickleNone            = 'N'
+	pickleNewTrue         = 0x88
+	pickleNewFalse        = 0x89
+	picklePut             = 'p'
+	pickleBinPut          = 'q'
+	pickleLongBinPut      = 'r'
+	pickleMemoize         = 0x94
+	pickleGet             = 'g'
+	pickleBinGet          = 'h'
+	pickleLongBinGet      = 'j'
+)
+
+// pickleMarkObj - MARK on the unpickle stack
+type pickleMarkObj struct{}
+
+// unpickle decodes the subset of pickle used for lists of tuples of strings
+// and numbers. Lists are *[]any, tuples []any.
+func unpickle(data []byte) (any, error) {
+	var (
+		stack []any
+		memo  = make(map[int]any)
+		pos   int
+	)
+	read := func(n int) ([]byte, error) {
+		if n < 0 || pos+n > len(data) {
+			return nil, fmt.Errorf("pickle: truncated at %d", pos)
+		}
+		b := data[pos : pos+n]
+		pos += n
+		return b, nil
+	}
+	readLine := func() ([]byte, error) {
+		i := bytes.IndexByte(data[pos:], '\n')
+		if i < 0 {
+			return nil, fmt.Errorf("pickle: truncated at %d", pos)
+		}
+		b := data[pos : pos+i]
+		pos += i + 1
+		return b, nil
+	}
+	pop := func() (any, error) {
+		if len(stack) == 0 {
+			return nil, fmt.Errorf("pickle: stack underflow at %d", pos)
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v, nil
+	}
+	popMark := func() ([]any, error) {
+		for i := len(stack) - 1; i >= 0; i-- {
+			if _, ok := stack[i].(pickleMarkObj); ok {
+				items := append([]any{}, stack[i+1:]...)
+				stack = stack[:i]
+				return items, nil
+			}
+		}
+		return nil, fmt.Errorf("pickle: no mark at %d", pos)
+	}
+	// readLen reads a little endian length of n bytes and then the data
+	readLen := func(n int) ([]byte, error) {
+		b, err := read(n)
+		if err != nil {
+			return nil, err
+		}
+		var l uint64
+		for i := n - 1; i >= 0; i-- {
+			l = l<<8 | uint64(b[i])
+		}
+		if l > uint64(len(data)) {
+			return nil, fmt.Errorf("pickle: truncated at %d", pos)
+		}
+		return read(int(l))
+	}
+
+	for {
+		op, err := read(1)
+		if err != nil {
+			return nil, err
+		}
+		var b []byte
+		switch op[0] {
+		case pickleProto:
+			_, err = read(1)
+		case pickleFrame:
+			_, err = read(8)
+		case pickleStop:
+			return pop()
+		case pickleMark:
+			stack = append(stack, pickleMarkObj{})
+		case pickleEmptyList:
+			stack = append(stack, &[]any{})
+		case pickleList:
+			var items []any
+			if items, err = popMark(); err == nil {
+				stack = append(stack, &items)
+			}
+		case pickleEmptyTuple:
+			stack = append(stack, []any{})
+		case pickleTuple:
+			var items []any
+			if items, err = popMark(); err == nil {
+				stack = append(stack, items)
+			}
+		case pickleTuple1, pickleTuple2, pickleTuple3:
+			n := int(op[0]-pickleTuple1) + 1
+			if len(stack) < n {
+				return nil, fmt.Errorf("pickle: stack underflow at %d", pos)
+			}
+			items := append([]any{}, stack[len(stack)-n:]...)
+			stack = append(stack[:len(stack)-n], items)
+		case pickleAppend, pickleAppends:
+			var items []any
+			if op[0] == pickleAppend {
+				var v any
+				v, err = pop()
+				items = []any{v}
+			} else {
+				items, err = popMark()
+			}
+			if err != nil {
+				break
+			}
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("pickle: stack underflow at %d", pos)
+			}
+			list, ok := stack[len(stack)-1].(*[]any)
+			if !ok {
+				return nil, fmt.Errorf("pickle: append to %T at %d", stack[len(stack)-1], pos)
+			}
+			*list = append(*list, items...)
+		case pickleBinUnicode, pickleBinString, pickleBinBytes:
+			if b, err = readLen(4); err == nil {
+				stack = append(stack, string(b))
+			}
+		case pickleShortBinUnicode, pickleShortBinString, pickleShortBinBytes:
+			if b, err = readLen(1); err == nil {
+				stack = append(stack, string(b))
+			}
+		case pickleUnicode:
+			if b, err = readLine(); err == nil {
+				stack = append(stack, string(b))
+			}
+		case pickleString:
+			if b, err = readLine(); err == nil {
+				if len(b) >= 2 && (b[0] == '\'' || b[0] == '"') && b[len(b)-1] == b[0] {
+					b = b[1 : len(b)-1]
+				}
+				stack = append(stack, string(b))
+			}
+		case pickleBinInt:
+			if b, err = read(4); err == nil {
+				stack = append(stack, int64(int32(binary.LittleEndian.Uint32(b))))
+			}
+		case pickleBinInt1:
+			if b, err = read(1); err == nil {
+				stack = append(stack, int64(b[0]))
+			}
+		case pickleBinInt2:
+			if b, err = read(2); err == nil {
+				stack = append(stack, int64(binary.LittleEndian.Uint16(b)))
+			}
+		case pickleLong1:
+			if b, err = readLen(1); err == nil {
+				if len(b) > 8 {
+					return nil, fmt.Errorf("pickle: long too big at %d", pos)
+				}
+				var v int64
+				for i := len(b) - 1; i >= 0; i-- {
+					v = v<<8 | int64(b[i])
+				}
+				if len(b) > 0 && len(b) < 8 && b[len(b)-1]&0x80 != 0 {
+					v -= 1 << (8 * uint(len(b)))
+				}
+				stack = append(stack, v)
+			}
+		case pickleInt, pickleLong:
+			if b, err = readLine(); err == nil {
+				var v int64
+				if v, err = strconv.ParseInt(strings.TrimSuffix(string(b), "L"), 10, 64); err == nil {
+					stack = append(stack, v)
+				}
+			}
+		case pickleBinFloat:
+			if b, err = read(8); err == nil {
+				stack = append(stack, math.Float64frombits(binary.BigEndian.Uint64(b)))
+			}
+		case pickleFloat:
+			if b, err = readLine(); err == nil {
+				var v float64
+				if v, err = strconv.ParseFloat(string(b), 64); err == nil {
+					stack = append(stack, v)
+				}
+			}
+		case pickleNone:
+			stack = append(stack, nil)
+		case pickleNewTrue:
+			stack = append(stack, true)
+		case pickleNewFalse:
+			stack = append(stack, false)
+		case picklePut, pickleBinPut, pickleLongBinPut, pickleMemoize:
+			idx := len(memo)
+			switch op[0] {
+			case picklePut:
+				if b, err = readLine(); err == nil {
+					idx, err = strconv.Atoi(string(b))
+				}
+			case pickleBinPut:
+				if b, err = read(1); err == nil {
+					idx = int(b[0])
+				}
+			case pickleLongBinPut:
+				if b, err = read(4); err == nil {
+					idx = int(binary.LittleEndian.Uint32(b))
+				}
+			}
+			if err != nil {
+				break
+			}
+			if len(stack) == 0 {
+				return nil, fmt.Errorf("pickle: stack underflow at %d", pos)
+			}
+			memo[idx] = stack[len(stack)-1]
+		case pickleGet, pickleBinGet, pickleLongBinGet:
+			var idx int
+			switch op[0] {
+			case pickleGet:
+				if b, err = readLine(); err == nil {
+					idx, err = strconv.Atoi(string(b))
+				}
+			case pickleBinGet:
+				if b, err = read(1); err == nil {
+					idx = int(b[0])
+				}
+			case pickleLongBinGet:
+				if b, err = read(4); err == nil {
+					idx = int(binary.LittleEndian.Uint32(b))
+				}
+			}
+			if err != nil {
+				break
+			}
+			v, ok := memo[idx]
+			if !ok {
+				return nil, fmt.Errorf("pickle: unknown memo %d at %d", idx, pos)
+			}
+			stack = append(stack, v)
+		default:
+			return nil, fmt.Errorf("pickle: unsupported opcode 0x%02x at %d", op[0], pos-1)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+)
+
+func TestPickleMessages(t *testing.T) {
+	msgs := pickleMessages([]byte("a.b 1.5 1700000000\n"), 10)
+	if len(msgs) != 1 {
+		t.Fatalf("got %d messages, want 1", len(msgs))
+	}
+	// pickle.dumps([(u"a.b", (1700000000, 1.5))], protocol=2) without memoization
+	want, _ := hex.DecodeString("80025d28" + // PROTO 2, EMPTY_LIST, MARK
+		"5803000000612e62" + // BINUNICODE "a.b"
+		"4a00f15365" + // BININT 1700000000
+		"473ff8000000000000" + // BINFLOAT 1.5
+		"8686" + // TUPLE2 TUPLE2
+		"652e") // APPENDS STOP
+	msg := msgs[0]
+	if n := binary.BigEndian.Uint32(msg[:4]); int(n) != len(want) {
+		t.Errorf("length prefix = %d, want %d", n, len(want))
+	}
+	if !bytes.Equal(msg[4:], want) {
+		t.Errorf("payload = %x, want %x", msg[4:], want)
+	}
+}
+
+func TestPickleMessagesBatching(t *testing.T) {
+	data := []byte("a 1 1700000000\nb 2 1700000000\nkv text 1700000000\nc 3 1700000000\n")
+	msgs := pickleMessages(data, 2)
+	// the non-numeric key/value line is skipped: 3 points in batches of 2
+	if len(msgs) != 2 {
+		t.Fatalf("got %d messages, want 2", len(msgs))
+	}
+	for i, msg := range msgs {
+		if n := binary.BigEndian.Uint32(msg[:4]); int(n) != len(msg)-4 {
+			t.Errorf("message %d length prefix = %d, want %d", i, n, len(msg)-4)
+		}
+	}
+	if len(pickleMessages(nil, 2)) != 0 {
+		t.Error("empty input must produce no messages")
+	}
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bytes"
 	"fmt"
 	log "github.com/sirupsen/logrus"
 	bolt "go.etcd.io/bbolt"
@@ -14,20 +13,35 @@ import (
 // swapped in by the monitor goroutine at each flush so the previous one can be
 // serialized and sent off the ingestion path (see monitor/flushWorker).
 type metrics struct {
-	counters map[string]int64
-	gauges   map[string]float64
-	timers   map[string]Float64Slice
-	sets     map[string][]string
-	keys     map[string][]string
+	counters      map[string]int64
+	gauges        map[string]float64
+	timers        map[string]Float64Slice
+	timerSketches map[string]*ddSketch
+	histograms    map[string]Float64Slice
+	distributions map[string]*ddSketch
+	sets          map[string]*setCounter
+	keys          map[string][]string
+	// timedCounters and timedGauges - points with client timestamps, by
+	// timestamp
+	timedCounters map[int64]map[string]int64
+	timedGauges   map[int64]map[string]float64
+	// limiter - nil when no cardinality limit is set
+	limiter *cardinalityLimiter
 }
 
 func newMetrics() *metrics {
 	return &metrics{
-		counters: make(map[string]int64),
-		gauges:   make(map[string]float64),
-		timers:   make(map[string]Float64Slice),
-		sets:     make(map[string][]string),
-		keys:     make(map[string][]string),
+		counters:      make(map[string]int64),
+		gauges:        make(map[string]float64),
+		timers:        make(map[string]Float64Slice),
+		timerSketches: make(map[string]*ddSketch),
+		histograms:    make(map[string]Float64Slice),
+		distributions: make(map[string]*ddSketch),
+		sets:          make(map[string]*setCounter),
+		keys:          make(map[string][]string),
+		timedCounters: make(map[int64]map[string]int64),
+		timedGauges:   make(map[int64]map[string]float64),
+		limiter:       newCardinalityLimiter(Config.CfgCardinality),
 	}
 }
 
@@ -36,11 +50,46 @@ func (mx *metrics) handlePacket(s *Packet) {
 
 	Stat.PointsReceivedInc()
 
+	if mx.limiter != nil {
+		bucket, ok := mx.limiter.admit(s.Bucket)
+		if !ok {
+			return
+		}
+		s.Bucket = bucket
+	}
+
+	if s.Timestamp != 0 {
+		mx.handleTimed(s)
+		return
+	}
+
 	switch s.Modifier {
 	// timer
 	case "ms":
+		if Config.CfgTimerSketch.useFor(s.Bucket) {
+			sk, ok := mx.timerSketches[s.Bucket]
+			if !ok {
+				sk = newDDSketch(Config.SketchAccuracy)
+				mx.timerSketches[s.Bucket] = sk
+			}
+			sk.Add(s.Value.(float64))
+			break
+		}
 		mx.timers[s.Bucket] = append(mx.timers[s.Bucket], s.Value.(float64))
 
+		// histogram
+	case "h":
+		mx.histograms[s.Bucket] = append(mx.histograms[s.Bucket], s.Value.(float64))
+
+		// distribution
+	case "d":
+		sk, ok := mx.distributions[s.Bucket]
+		if !ok {
+			sk = newDDSketch(Config.SketchAccuracy)
+			mx.distributions[s.Bucket] = sk
+		}
+		sk.Add(s.Value.(float64))
+
 		// gauge
 	case "g":
 		gaugeValue := mx.gauges[s.Bucket]
@@ -73,7 +122,12 @@ func (mx *metrics) handlePacket(s *Packet) {
 
 		// set
 	case "s":
-		mx.sets[s.Bucket] = append(mx.sets[s.Bucket], s.Value.(string))
+		set, ok := mx.sets[s.Bucket]
+		if !ok {
+			set = newSetCounter(uint8(Config.SetPrecision), Config.SetExactLimit)
+			mx.sets[s.Bucket] = set
+		}
+		set.Add(s.Value.(string))
 
 		// key/value
 	case "kv":
@@ -82,11 +136,25 @@ func (mx *metrics) handlePacket(s *Packet) {
 
 }
 
+// formatMetricOutput formats one metric line for a text backend. Tags are in
+// the bucket, in tfCaret form.
 func formatMetricOutput(bucket string, value any, now int64, backend string) string {
+	cleanBucket, localTags, err := parseBucketAndTags(bucket)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"in": "formatMetricOutput",
+		}).Errorf("parseBucketAndTags error: %s", err)
+		Stat.PointsParseFailInc()
+	}
+	return formatPoint(cleanBucket, localTags, value, now, backend)
+}
+
+// formatPoint formats one metric line with the given tags for a text backend.
+func formatPoint(cleanBucket string, localTags map[string]string, value any, now int64, backend string) string {
 
 	var ret, val string
 	logCtx := log.WithFields(log.Fields{
-		"in": "formatMetricOutput",
+		"in": "formatPoint",
 	})
 	switch v := value.(type) {
 	case string:
@@ -102,15 +170,9 @@ func formatMetricOutput(bucket string, value any, now int64, backend string) str
 		Stat.OtherErrorsInc()
 	}
 
-	cleanBucket, localTags, err := parseBucketAndTags(bucket)
-	if err != nil {
-		logCtx.Errorf("parseBucketAndTags error: %s", err)
-		Stat.PointsParseFailInc()
-	}
-
 	setFirstGraphite := ""
 	sepTags := ""
-	if len(localTags) > 0 || len(Config.ExtraTagsHash) > 0 {
+	if len(localTags) > 0 {
 		setFirstGraphite = tfGraphiteFirstDelim
 		if backend != "graphite" {
 			sepTags = " "
@@ -122,13 +184,19 @@ func formatMetricOutput(bucket string, value any, now int64, backend string) str
 		ret = fmt.Sprintf("%s %s %d%s%s", cleanBucket, val, now, sepTags, normalizeTags(localTags, tfPretty))
 	case "graphite":
 		ret = fmt.Sprintf("%s%s%s%s %s %d", cleanBucket, setFirstGraphite, sepTags, normalizeTags(localTags, tfGraphite), val, now)
+	case "graphite-tagged":
+		tagged := ""
+		if graphiteTags := sanitizeGraphiteTags(localTags); len(graphiteTags) > 0 {
+			tagged = tfGraphiteNativeFirstDelim + normalizeTags(graphiteTags, tfGraphiteNative)
+		}
+		ret = fmt.Sprintf("%s%s %s %d", cleanBucket, tagged, val, now)
 	default:
 		ret = "UNKNOWN_BACKEND"
 	}
 	return ret
 }
 
-func (mx *metrics) processCounters(buffer *bytes.Buffer, now int64, reset bool, backend string, dbHandle *bolt.DB) int64 {
+func (mx *metrics) processCounters(w pointWriter, now int64, reset bool, dbHandle *bolt.DB) int64 {
 	// Normal behaviour is to reset couners after each send
 	// "don't reset" was added for OpenTSDB and Grafana
 
@@ -165,7 +233,7 @@ func (mx *metrics) processCounters(buffer *bytes.Buffer, now int64, reset bool,
 
 		nowCounter.Value = startCounter.Value + value
 		nowCounter.When = now
-		fmt.Fprintf(buffer, "%s\n", formatMetricOutput(bucket, nowCounter.Value, now, backend))
+		num += writeCounter(w, bucket, nowCounter.Value, value, now)
 		delete(mx.counters, bucket)
 		// delete(tags, bucket)
 
@@ -174,7 +242,6 @@ func (mx *metrics) processCounters(buffer *bytes.Buffer, now int64, reset bool,
 		if !reset {
 			toStore[bucket] = nowCounter
 		}
-		num++
 	}
 
 	if !reset {
@@ -199,8 +266,7 @@ func (mx *metrics) processCounters(buffer *bytes.Buffer, now int64, reset bool,
 				startCounter.When = now
 			}
 
-			fmt.Fprintf(buffer, "%s\n", formatMetricOutput(bucket, startCounter.Value, now, backend))
-			num++
+			num += writeCounter(w, bucket, startCounter.Value, 0, now)
 		}
 		countInactivity[bucket]++
 		// remove counter from sending '0'
@@ -212,7 +278,33 @@ func (mx *metrics) processCounters(buffer *bytes.Buffer, now int64, reset bool,
 	return num
 }
 
-func (mx *metrics) processGauges(buffer *bytes.Buffer, now int64, backend string) int64 {
+// writeCounter writes the counter value: the sum in this interval or, in
+// "don't reset" mode, the running total. Counters selected in counter-rate get
+// <bucket>.rate (delta - the sum in this interval - per second) in addition
+// and, when enabled, <bucket>.count with the value. Rates are gauges. It
+// returns the number of points written.
+func writeCounter(w pointWriter, bucket string, value, delta int64, now int64) int64 {
+	p := newPoint(kindCounter, bucket, value, now)
+	w.writePoint(p)
+	if !Config.CfgCounterRate.useFor(bucket) {
+		return 1
+	}
+	rate := float64(delta)
+	if Config.FlushInterval > 0 {
+		rate /= float64(Config.FlushInterval)
+	}
+	name := p.Name
+	p.Kind, p.Name, p.Value = kindGauge, name+".rate", rate
+	w.writePoint(p)
+	if !Config.CfgCounterRate.Count {
+		return 2
+	}
+	p.Kind, p.Name, p.Value = kindCounter, name+".count", value
+	w.writePoint(p)
+	return 3
+}
+
+func (mx *metrics) processGauges(w pointWriter, now int64) int64 {
 
 	var num int64
 
@@ -224,13 +316,13 @@ func (mx *metrics) processGauges(buffer *bytes.Buffer, now int64, backend string
 
 		switch {
 		case hasChanged:
-			fmt.Fprintf(buffer, "%s\n", formatMetricOutput(bucket, currentValue, now, backend))
+			w.writePoint(newPoint(kindGauge, bucket, currentValue, now))
 			lastGaugeValue[bucket] = currentValue
 			mx.gauges[bucket] = math.MaxUint64
 			num++
 		case hasLastValue && !Config.DeleteGauges:
 			// Keep republishing the last known value.
-			fmt.Fprintf(buffer, "%s\n", formatMetricOutput(bucket, lastValue, now, backend))
+			w.writePoint(newPoint(kindGauge, bucket, lastValue, now))
 			num++
 		default:
 			// No new value and either delete-gauges mode or nothing to keep:
@@ -242,24 +334,19 @@ func (mx *metrics) processGauges(buffer *bytes.Buffer, now int64, backend string
 	return num
 }
 
-func (mx *metrics) processSets(buffer *bytes.Buffer, now int64, backend string) int64 {
+func (mx *metrics) processSets(w pointWriter, now int64) int64 {
 
 	num := int64(len(mx.sets))
 	for bucket, set := range mx.sets {
 
-		uniqueSet := map[string]bool{}
-		for _, str := range set {
-			uniqueSet[str] = true
-		}
-
-		fmt.Fprintf(buffer, "%s\n", formatMetricOutput(bucket, len(uniqueSet), now, backend))
+		w.writePoint(newPoint(kindSet, bucket, int64(set.Count()), now))
 		delete(mx.sets, bucket)
 		// delete(tags, bucket)
 	}
 	return num
 }
 
-func (mx *metrics) processKeyValue(buffer *bytes.Buffer, now int64, backend string) int64 {
+func (mx *metrics) processKeyValue(w pointWriter, now int64) int64 {
 
 	num := int64(len(mx.keys))
 	for bucket, values := range mx.keys {
@@ -272,7 +359,7 @@ func (mx *metrics) processKeyValue(buffer *bytes.Buffer, now int64, backend stri
 				continue
 			}
 			uniqueKeyVal[value] = true
-			fmt.Fprintf(buffer, "%s\n", formatMetricOutput(bucket, value, now, backend))
+			w.writePoint(newPoint(kindKeyValue, bucket, value, now))
 		}
 		delete(mx.keys, bucket)
 		// delete(tags, bucket)
@@ -280,85 +367,374 @@ func (mx *metrics) processKeyValue(buffer *bytes.Buffer, now int64, backend stri
 	return num
 }
 
-func (mx *metrics) processTimers(buffer *bytes.Buffer, now int64, pctls Percentiles, backend string) int64 {
+func (mx *metrics) processTimers(w pointWriter, now int64, pctls Percentiles) int64 {
 
 	// FIXME - chceck float64 conversion
 	var num int64
+	stats := timerStatsSet(Config.TimerStats)
 
-	logCtx := log.WithFields(log.Fields{
-		"in": "processTimers",
-	})
 	for bucket, timer := range mx.timers {
-		bucketWithoutPostfix := bucket
 		num++
 
 		sort.Sort(timer)
-		min := timer[0]
-		max := timer[len(timer)-1]
-		maxAtThreshold := max
 		count := len(timer)
 
-		sum := float64(0)
-		for _, value := range timer {
+		// cumulative[i], cumulativeSquares[i] - sum and sum of squares of the
+		// i+1 lowest values
+		cumulative := make([]float64, count)
+		cumulativeSquares := make([]float64, count)
+		sum, sumSquares := float64(0), float64(0)
+		for i, value := range timer {
 			sum += value
+			sumSquares += value * value
+			cumulative[i] = sum
+			cumulativeSquares[i] = sumSquares
 		}
-		mean := sum / float64(len(timer))
 
-		// remove tags form bucketWithoutPostfix
-		cleanBucket, localTags, err := parseBucketAndTags(bucketWithoutPostfix)
-		if err != nil {
-			logCtx.Errorf("parseBucketAndTags: %s", err)
-			Stat.PointsParseFailInc()
+		median := timer[count/2]
+		if count%2 == 0 {
+			median = (timer[count/2-1] + timer[count/2]) / 2
 		}
-		fullNormalizedTags := normalizeTags(addTags(localTags, Config.ExtraTagsHash), tfDefault)
 
-		for _, pct := range pctls {
-			if len(timer) > 1 {
-				var abs float64
-				if pct.Float >= 0 {
-					abs = pct.Float
-				} else {
-					abs = 100 + pct.Float
+		quantile := func(pct float64) float64 {
+			if len(timer) <= 1 {
+				return timer[count-1]
+			}
+			var abs float64
+			if pct >= 0 {
+				abs = pct
+			} else {
+				abs = 100 + pct
+			}
+			// poor man's math.Round(x):
+			// math.Floor(x + 0.5)
+			indexOfPerc := int(math.Floor(((abs / 100.0) * float64(count)) + 0.5))
+			if pct >= 0 {
+				indexOfPerc-- // index offset=0
+			}
+			if indexOfPerc < 0 {
+				indexOfPerc = 0
+			}
+			if indexOfPerc >= count {
+				indexOfPerc = count - 1
+			}
+			return timer[indexOfPerc]
+		}
+
+		writeTimerStats(w, bucket, timerStats{
+			count:      count,
+			sum:        sum,
+			sumSquares: sumSquares,
+			min:        timer[0],
+			max:        timer[count-1],
+			median:     median,
+			quantile:   quantile,
+			sumLowest: func(n int) float64 {
+				if n <= 0 {
+					return 0
 				}
-				// poor man's math.Round(x):
-				// math.Floor(x + 0.5)
-				indexOfPerc := int(math.Floor(((abs / 100.0) * float64(count)) + 0.5))
-				if pct.Float >= 0 {
-					indexOfPerc-- // index offset=0
+				return cumulative[n-1]
+			},
+			sumSquaresLowest: func(n int) float64 {
+				if n <= 0 {
+					return 0
 				}
-				maxAtThreshold = timer[indexOfPerc]
-			}
+				return cumulativeSquares[n-1]
+			},
+			countAtMost: func(bound float64) int {
+				return sort.Search(count, func(i int) bool { return timer[i] > bound })
+			},
+		}, stats, pctls, now)
+		delete(mx.timers, bucket)
+		// delete(localTags, bucket)
+	}
 
-			var tmpl string
-			var pctstr string
-			if pct.Float >= 0 {
-				// tmpl = "%s.upper_%s%s %f %d\n"
-				tmpl = "%s.upper_%s%s%s"
-				pctstr = pct.Str
-			} else {
-				// tmpl = "%s.lower_%s%s %f %d\n"
-				tmpl = "%s.lower_%s%s%s"
-				pctstr = pct.Str[1:]
+	// timers aggregated in sketches: the same statistics, percentiles (and
+	// median, mean_N, sum_N, sum_squares_N) within sketch-accuracy of the
+	// exact ones
+	for bucket, sk := range mx.timerSketches {
+		num++
+		// the same rank as for exact timers
+		quantile := func(pct float64) float64 {
+			abs := pct
+			if pct < 0 {
+				abs = 100 + pct
+			}
+			rank := int(math.Floor(((abs / 100.0) * float64(sk.count)) + 0.5))
+			if pct >= 0 {
+				rank--
 			}
-			sep := ""
-			if len(fullNormalizedTags) > 0 {
-				sep = ".^"
+			if rank < 0 {
+				rank = 0
 			}
+			return sk.Rank(uint64(rank))
+		}
+		writeTimerStats(w, bucket, timerStats{
+			count:      int(sk.count),
+			sum:        sk.sum,
+			sumSquares: sk.sumSquares,
+			min:        sk.min,
+			max:        sk.max,
+			median:     sk.Quantile(0.5),
+			quantile:   quantile,
+			sumLowest:  func(n int) float64 { return sk.SumLowest(uint64(n)) },
+			sumSquaresLowest: func(n int) float64 {
+				return sk.SumSquaresLowest(uint64(n))
+			},
+			countAtMost: func(bound float64) int {
+				return int(sk.CountAtMost(bound))
+			},
+		}, stats, pctls, now)
+		delete(mx.timerSketches, bucket)
+	}
+	return num
+}
 
-			fmt.Fprintf(buffer, "%s\n", formatMetricOutput(fmt.Sprintf(tmpl, cleanBucket, pctstr, sep, fullNormalizedTags), maxAtThreshold, now, backend))
+// timer statistics selectable in 'timer-stats'. upper_N, lower_N, count_N,
+// mean_N, sum_N and sum_squares_N are written for every percent-threshold
+// (those of negative thresholds as count_topN, mean_topN and so on, but
+// lower_N, like Etsy statsd).
+var validTimerStats = []string{
+	"mean", "upper", "lower", "count", "upper_N", "lower_N",
+	"median", "std", "sum", "sum_squares", "count_ps",
+	"count_N", "mean_N", "sum_N", "sum_squares_N",
+}
+
+func validTimerStat(name string) bool {
+	for _, n := range validTimerStats {
+		if n == name {
+			return true
 		}
+	}
+	return false
+}
+
+// timer statistics written when 'timer-stats' is empty
+var defaultTimerStats = []string{"mean", "upper", "lower", "count", "upper_N", "lower_N"}
 
-		sTags := fullNormalizedTags
-		if len(sTags) > 0 {
-			sTags = ".^" + sTags
+// timerStatsSet returns the timer statistics to write.
+func timerStatsSet(names []string) map[string]bool {
+	if len(names) == 0 {
+		names = defaultTimerStats
+	}
+	set := make(map[string]bool, len(names))
+	for _, n := range names {
+		set[n] = true
+	}
+	return set
+}
+
+// timerStats - aggregated values of one timer
+type timerStats struct {
+	count                     int
+	sum, sumSquares, min, max float64
+	median                    float64
+	// quantile gets a percent-threshold, negative for lower_N
+	quantile func(float64) float64
+	// sumLowest returns the sum of the n lowest values
+	sumLowest func(int) float64
+	// sumSquaresLowest returns the sum of squares of the n lowest values
+	sumSquaresLowest func(int) float64
+	// countAtMost returns the number of values <= bound
+	countAtMost func(float64) int
+}
+
+// writeTimerStats writes the statistics of one timer selected in stats:
+// upper_N/lower_N, count_N, mean_N, sum_N and sum_squares_N for every
+// percent-threshold, then mean, upper, lower, count, count_ps, sum,
+// sum_squares, std and median, and the histogram bins configured for the
+// bucket in timer-histograms. The _N statistics are computed over the values
+// up to upper_N, or for negative thresholds over the values from lower_N up
+// (the top N%, written as count_topN, mean_topN, ...), as Etsy statsd does.
+// Like Etsy statsd, they are not written for a threshold that holds no value.
+func writeTimerStats(w pointWriter, bucket string, ts timerStats, stats map[string]bool, pctls Percentiles, now int64) {
+	logCtx := log.WithFields(log.Fields{
+		"in": "processTimers",
+	})
+
+	// remove tags form bucketWithoutPostfix
+	cleanBucket, localTags, err := parseBucketAndTags(bucket)
+	if err != nil {
+		logCtx.Errorf("parseBucketAndTags: %s", err)
+		Stat.PointsParseFailInc()
+	}
+	tags := addTags(localTags, Config.ExtraTagsHash)
+	write := func(stat string, value any) {
+		w.writePoint(outputPoint{Kind: kindTimer, Name: cleanBucket, Stat: stat, Tags: tags, Value: value, When: now})
+	}
+	// count and sum for Prometheus when they are not selected
+	writeTyped := func(stat string, value any) {
+		w.writePoint(outputPoint{Kind: kindTimer, Name: cleanBucket, Stat: stat, Tags: tags, Value: value, When: now, TypedOnly: true})
+	}
+
+	// writeThreshold writes the statistics of the n values of a threshold
+	writeThreshold := func(suffix string, n int, sum, sumSquares float64) {
+		if n == 0 {
+			return
 		}
+		if stats["count_N"] {
+			write("count_"+suffix, n)
+		}
+		if stats["mean_N"] {
+			write("mean_"+suffix, sum/float64(n))
+		}
+		if stats["sum_N"] {
+			write("sum_"+suffix, sum)
+		}
+		if stats["sum_squares_N"] {
+			write("sum_squares_"+suffix, sumSquares)
+		}
+	}
 
-		fmt.Fprintf(buffer, "%s\n", formatMetricOutput(fmt.Sprintf("%s.mean%s", cleanBucket, sTags), mean, now, backend))
-		fmt.Fprintf(buffer, "%s\n", formatMetricOutput(fmt.Sprintf("%s.upper%s", cleanBucket, sTags), max, now, backend))
-		fmt.Fprintf(buffer, "%s\n", formatMetricOutput(fmt.Sprintf("%s.lower%s", cleanBucket, sTags), min, now, backend))
-		fmt.Fprintf(buffer, "%s\n", formatMetricOutput(fmt.Sprintf("%s.count%s", cleanBucket, sTags), count, now, backend))
-		delete(mx.timers, bucket)
-		// delete(localTags, bucket)
+	for _, pct := range pctls {
+		abs := pct.Float
+		if abs < 0 {
+			abs = -abs
+		}
+		// number of values within the threshold, all of a single value
+		numInThreshold := ts.count
+		if ts.count > 1 {
+			numInThreshold = int(math.Floor((abs / 100.0 * float64(ts.count)) + 0.5))
+		}
+		if numInThreshold > ts.count {
+			numInThreshold = ts.count
+		}
+
+		if pct.Float >= 0 {
+			if stats["upper_N"] {
+				write("upper_"+pct.Str, ts.quantile(pct.Float))
+			}
+			writeThreshold(pct.Str, numInThreshold, ts.sumLowest(numInThreshold), ts.sumSquaresLowest(numInThreshold))
+			continue
+		}
+
+		pctstr := pct.Str[1:]
+		if stats["lower_N"] {
+			write("lower_"+pctstr, ts.quantile(pct.Float))
+		}
+		rest := ts.count - numInThreshold
+		writeThreshold("top"+pctstr, numInThreshold, ts.sum-ts.sumLowest(rest), ts.sumSquares-ts.sumSquaresLowest(rest))
+	}
+
+	mean := ts.sum / float64(ts.count)
+	if stats["mean"] {
+		write("mean", mean)
+	}
+	if stats["upper"] {
+		write("upper", ts.max)
+	}
+	if stats["lower"] {
+		write("lower", ts.min)
+	}
+	if stats["count"] {
+		write("count", ts.count)
+	} else {
+		writeTyped("count", ts.count)
+	}
+	if stats["count_ps"] {
+		countPs := float64(ts.count)
+		if Config.FlushInterval > 0 {
+			countPs /= float64(Config.FlushInterval)
+		}
+		write("count_ps", countPs)
+	}
+	if stats["sum"] {
+		write("sum", ts.sum)
+	} else {
+		writeTyped("sum", ts.sum)
+	}
+	if stats["sum_squares"] {
+		write("sum_squares", ts.sumSquares)
+	}
+	if stats["std"] {
+		// population standard deviation
+		variance := ts.sumSquares/float64(ts.count) - mean*mean
+		if variance < 0 {
+			// rounding
+			variance = 0
+		}
+		write("std", math.Sqrt(variance))
+	}
+	if stats["median"] {
+		write("median", ts.median)
+	}
+
+	if h, ok := timerHistogramFor(cleanBucket); ok {
+		writeTimerBins(write, h, ts.count, ts.countAtMost)
+	}
+}
+
+// processHistograms writes histogram statistics, named like the DogStatsD
+// agent does: .count, .avg, .min, .max, .median and .<N>percentile for every
+// positive percent-threshold.
+func (mx *metrics) processHistograms(w pointWriter, now int64, pctls Percentiles) int64 {
+	var num int64
+	for bucket, values := range mx.histograms {
+		num++
+		sort.Sort(values)
+		sum := float64(0)
+		for _, v := range values {
+			sum += v
+		}
+		quantile := func(pct float64) float64 { return sortedPercentile(values, pct) }
+		writeDistributionStats(w, kindHistogram, bucket, len(values), sum, values[0], values[len(values)-1], quantile, pctls, now)
+		delete(mx.histograms, bucket)
+	}
+	return num
+}
+
+// processDistributions writes the same statistics as processHistograms, with
+// percentiles computed from the bucket's sketch.
+func (mx *metrics) processDistributions(w pointWriter, now int64, pctls Percentiles) int64 {
+	var num int64
+	for bucket, sk := range mx.distributions {
+		num++
+		quantile := func(pct float64) float64 { return sk.Quantile(pct / 100) }
+		writeDistributionStats(w, kindDistribution, bucket, int(sk.count), sk.sum, sk.min, sk.max, quantile, pctls, now)
+		delete(mx.distributions, bucket)
 	}
 	return num
 }
+
+func writeDistributionStats(w pointWriter, kind, bucket string, count int, sum, min, max float64, quantile func(float64) float64, pctls Percentiles, now int64) {
+	logCtx := log.WithFields(log.Fields{
+		"in": "writeDistributionStats",
+	})
+
+	cleanBucket, localTags, err := parseBucketAndTags(bucket)
+	if err != nil {
+		logCtx.Errorf("parseBucketAndTags: %s", err)
+		Stat.PointsParseFailInc()
+	}
+	tags := addTags(localTags, Config.ExtraTagsHash)
+	write := func(stat string, value any) {
+		w.writePoint(outputPoint{Kind: kind, Name: cleanBucket, Stat: stat, Tags: tags, Value: value, When: now})
+	}
+
+	for _, pct := range pctls {
+		if pct.Float < 0 {
+			continue
+		}
+		write(pct.Str+"percentile", quantile(pct.Float))
+	}
+	write("median", quantile(50))
+	write("avg", sum/float64(count))
+	write("max", max)
+	write("min", min)
+	write("count", count)
+	// for the Prometheus _sum
+	w.writePoint(outputPoint{Kind: kind, Name: cleanBucket, Stat: "sum", Tags: tags, Value: sum, When: now, TypedOnly: true})
+}
+
+// sortedPercentile returns the value at pct percent of sorted values, the
+// nearest-rank method processTimers uses for upper_N.
+func sortedPercentile(values Float64Slice, pct float64) float64 {
+	i := int(math.Floor((pct/100.0)*float64(len(values))+0.5)) - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(values) {
+		i = len(values) - 1
+	}
+	return values[i]
+}
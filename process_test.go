@@ -7,6 +7,29 @@ import (
 	"testing"
 )
 
+// Extra tags are merged into buckets when they are parsed, buckets without
+// tags (eg. from the graphite input) must not get an empty tag section.
+func TestFormatMetricOutputUntaggedWithExtraTags(t *testing.T) {
+	saved := Config.ExtraTagsHash
+	defer func() { Config.ExtraTagsHash = saved }()
+	Config.ExtraTagsHash = map[string]string{"dc": "west"}
+	const now = int64(1700000000)
+
+	tests := []struct {
+		backend string
+		want    string
+	}{
+		{backend: "external", want: "m 5 1700000000"},
+		{backend: "graphite", want: "m 5 1700000000"},
+		{backend: "graphite-tagged", want: "m 5 1700000000"},
+	}
+	for _, tc := range tests {
+		if got := formatMetricOutput("m", int64(5), now, tc.backend); got != tc.want {
+			t.Errorf("formatMetricOutput(%q, %q) = %q, want %q", "m", tc.backend, got, tc.want)
+		}
+	}
+}
+
 func TestSanitizeBucket(t *testing.T) {
 	tests := []struct {
 		in   string
@@ -42,6 +65,8 @@ func TestFormatMetricOutput(t *testing.T) {
 		{name: "string untagged", bucket: "m", value: "txt", backend: "external", want: "m txt 1700000000"},
 		{name: "tagged external", bucket: "m.^host=web1", value: int64(5), backend: "external", want: "m 5 1700000000 host=web1"},
 		{name: "tagged graphite", bucket: "m.^host=web1", value: int64(5), backend: "graphite", want: "m._t_.host.web1 5 1700000000"},
+		{name: "tagged graphite native", bucket: "m.^host=web1.^env=prod", value: int64(5), backend: "graphite-tagged", want: "m;env=prod;host=web1 5 1700000000"},
+		{name: "untagged graphite native", bucket: "m", value: int64(5), backend: "graphite-tagged", want: "m 5 1700000000"},
 	}
 	for _, tc := range tests {
 		t.Run(tc.name, func(t *testing.T) {
@@ -58,7 +83,7 @@ func TestProcessKeyValue(t *testing.T) {
 	now := int64(1700000000)
 
 	var buf bytes.Buffer
-	num := current.processKeyValue(&buf, now, "external")
+	num := current.processKeyValue(textWriter{&buf, "external"}, now)
 
 	if num != 1 {
 		t.Errorf("processKeyValue num = %d, want 1", num)
@@ -84,14 +109,14 @@ func TestProcessGaugesEviction(t *testing.T) {
 
 	var buf bytes.Buffer
 	current.gauges["g.evict"] = 5
-	current.processGauges(&buf, now, "external") // emit value, set sentinel + lastGaugeValue
+	current.processGauges(textWriter{&buf, "external"}, now) // emit value, set sentinel + lastGaugeValue
 	if _, ok := lastGaugeValue["g.evict"]; !ok {
 		t.Fatal("lastGaugeValue should be set after first cycle")
 	}
 
 	// Second cycle with no new value: delete-gauges mode must evict the bucket
 	// from both maps so they do not grow unbounded.
-	current.processGauges(&buf, now, "external")
+	current.processGauges(textWriter{&buf, "external"}, now)
 	if len(current.gauges) != 0 {
 		t.Errorf("current.gauges not evicted: %v", current.gauges)
 	}
@@ -100,6 +125,47 @@ func TestProcessGaugesEviction(t *testing.T) {
 	}
 }
 
+func TestProcessHistogramsAndDistributions(t *testing.T) {
+	Config.ExtraTagsHash = map[string]string{}
+	Config.SketchAccuracy = 0.01
+	pctls := Percentiles{{Float: 90, Str: "90"}, {Float: -10, Str: "-10"}}
+	now := int64(1700000000)
+
+	mx := newMetrics()
+	for _, v := range []float64{5, 1, 4, 2, 3, 6, 7, 8, 9, 10} {
+		mx.handlePacket(&Packet{Bucket: "h.lat.^host=a", Value: v, Modifier: "h", Sampling: 1})
+		mx.handlePacket(&Packet{Bucket: "d.lat", Value: v * 10, Modifier: "d", Sampling: 1})
+	}
+
+	var buf bytes.Buffer
+	if num := mx.processHistograms(textWriter{&buf, "external"}, now, pctls); num != 1 {
+		t.Errorf("processHistograms num = %d, want 1", num)
+	}
+	want := []string{
+		"h.lat.90percentile 9.000000 1700000000 host=a",
+		"h.lat.median 5.000000 1700000000 host=a",
+		"h.lat.avg 5.500000 1700000000 host=a",
+		"h.lat.max 10.000000 1700000000 host=a",
+		"h.lat.min 1.000000 1700000000 host=a",
+		"h.lat.count 10 1700000000 host=a",
+	}
+	if got := splitNonEmpty(buf.String()); strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("processHistograms output = %v, want %v", got, want)
+	}
+
+	buf.Reset()
+	if num := mx.processDistributions(textWriter{&buf, "external"}, now, pctls); num != 1 {
+		t.Errorf("processDistributions num = %d, want 1", num)
+	}
+	got := splitNonEmpty(buf.String())
+	if len(got) != 6 || got[5] != "d.lat.count 10 1700000000" || got[2] != "d.lat.avg 55.000000 1700000000" {
+		t.Errorf("processDistributions output = %v", got)
+	}
+	if len(mx.histograms) != 0 || len(mx.distributions) != 0 {
+		t.Error("histograms and distributions should be purged after processing")
+	}
+}
+
 func TestPrefixPresent(t *testing.T) {
 	patterns := []string{"app.", "sys.cpu"}
 	tests := []struct {
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// ConfigPrometheusBackend - prometheus backend config.
+type ConfigPrometheusBackend struct {
+	// Address - listen address of the HTTP server, eg. :9102
+	Address string `yaml:"address"`
+	// Path - url path the metrics are served on
+	Path string `yaml:"path"`
+	// ExpireFlushes - counter, summary and histogram totals of a series
+	// missing from a flush are kept and exposed for this many flushes, 0 -
+	// forever
+	ExpireFlushes int64 `yaml:"expire-flushes"`
+}
+
+// promSample is one exposed sample, name and rendered label set.
+type promSample struct {
+	name   string
+	labels string
+	value  float64
+}
+
+// promTotal is a cumulative sample together with its family and the flush it
+// was last updated in.
+type promTotal struct {
+	family string
+	typ    string
+	sample promSample
+	flush  int64
+}
+
+// promSummary collects timer statistics of one series in one flush. Sum and
+// count are cumulative, as Prometheus expects, quantiles are from the last
+// interval only.
+type promSummary struct {
+	name      string
+	labels    map[string]string
+	quantiles map[string]float64
+	count     float64
+	sum       float64
+}
+
+// promHistogram collects the timer histogram bins of one series in one flush.
+type promHistogram struct {
+	name       string
+	labels     map[string]string
+	cumulative bool
+	bins       map[float64]float64
+	// summary - key of the summary of the timer, for the _sum
+	summary string
+}
+
+// prometheusBackend keeps the most recently flushed interval in memory and
+// serves it in the text exposition format. It is pulled, so Send never fails.
+type prometheusBackend struct {
+	cfg ConfigPrometheusBackend
+	// reset - counters are flushed as per interval deltas and are summed up
+	// here to make them monotonic
+	reset bool
+
+	mu sync.Mutex
+	// flushes - number of batches sent so far
+	flushes int64
+	// totals - cumulative samples of counters, summaries (_sum and _count)
+	// and histograms (_bucket and _count) by sample key
+	totals map[string]*promTotal
+	page   []byte
+}
+
+func newPrometheusBackend(cfg ConfigPrometheusBackend, reset bool) *prometheusBackend {
+	return &prometheusBackend{
+		cfg:    cfg,
+		reset:  reset,
+		totals: make(map[string]*promTotal),
+	}
+}
+
+// total returns the cumulative value of a sample, 0 for a new one.
+func (b *prometheusBackend) total(key string) float64 {
+	if t, ok := b.totals[key]; ok {
+		return t.sample.value
+	}
+	return 0
+}
+
+// setTotal stores a cumulative sample updated in this flush.
+func (b *prometheusBackend) setTotal(family, typ string, s promSample) {
+	b.totals[s.name+s.labels] = &promTotal{family: family, typ: typ, sample: s, flush: b.flushes}
+}
+
+// serve runs the HTTP server, it returns only on error.
+func (b *prometheusBackend) serve() {
+	logCtx := log.WithFields(log.Fields{
+		"in": "prometheusBackend serve",
+	})
+	mux := http.NewServeMux()
+	mux.Handle(b.cfg.Path, b)
+	logCtx.Infof("Serving prometheus metrics on %s%s", b.cfg.Address, b.cfg.Path)
+	if err := http.ListenAndServe(b.cfg.Address, mux); err != nil {
+		logCtx.Errorf("prometheus server stopped: %s", err)
+		Stat.OtherErrorsInc()
+	}
+}
+
+// ServeHTTP writes the exposition of the last flush.
+func (b *prometheusBackend) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	b.mu.Lock()
+	page := b.page
+	b.mu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(page)
+}
+
+// Send replaces the exposed metrics with a batch in the "typed" format.
+// Counters become <name>_total counters (counter-rate .rate values are gauges),
+// timers, histograms and distributions summaries with quantiles from
+// percent-threshold (upper is quantile 1, lower quantile 0), gauges and sets
+// gauges. Timer histogram bins (.histogram.bin_N)
+// become a <name>_histogram histogram with cumulative le buckets and count.
+// Key/value metrics have no numeric value and are skipped. Every series has
+// one sample: counter points with client timestamps add up with the others,
+// of gauges the latest point is kept.
+func (b *prometheusBackend) Send(buf *bytes.Buffer, _ time.Time) error {
+	logCtx := log.WithFields(log.Fields{
+		"in": "prometheusBackend Send",
+	})
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	types := make(map[string]string)
+	samples := make(map[string][]promSample)
+	summaries := make(map[string]*promSummary)
+	histograms := make(map[string]*promHistogram)
+	b.flushes++
+
+	points, err := parseTyped(buf.Bytes())
+	if err != nil {
+		logCtx.Errorf("%s", err)
+		Stat.OtherErrorsInc()
+	}
+	// counter and gauge series, one sample each: points with client
+	// timestamps are merged with the other points of their series. With
+	// reset every counter point is a delta, otherwise a running total and
+	// the latest one wins.
+	series := make(map[string]promSample)
+	deltas := make(map[string]float64)
+	totals := make(map[string]float64)
+	counters := make(map[string]int64)
+	gauges := make(map[string]int64)
+
+	for _, p := range points {
+		value, ok := p.Value.(float64)
+		if !ok { // key/value
+			continue
+		}
+
+		switch p.Kind {
+		case kindCounter:
+			name := promName(p.Name)
+			if !strings.HasSuffix(name, "_total") {
+				name += "_total"
+			}
+			labels := promLabels(p.Tags, "")
+			key := name + labels
+			series[key] = promSample{name, labels, 0}
+			types[name] = "counter"
+			if b.reset {
+				deltas[key] += value
+				continue
+			}
+			if when, ok := counters[key]; ok && when > p.When {
+				continue
+			}
+			counters[key] = p.When
+			totals[key] = value
+		case kindTimer, kindHistogram, kindDistribution:
+			if base, bound, ok := parseTimerBin(p.metric()); ok {
+				name := promName(base + "." + timerHistogramStat)
+				labels := promLabels(p.Tags, "")
+				key := name + labels
+				h, ok := histograms[key]
+				if !ok {
+					cfg, _ := timerHistogramFor(base)
+					h = &promHistogram{name: name, labels: p.Tags, cumulative: cfg.Cumulative, bins: make(map[float64]float64), summary: promName(base) + labels}
+					histograms[key] = h
+				}
+				h.bins[bound] = value
+				continue
+			}
+			name := promName(p.Name)
+			key := name + promLabels(p.Tags, "")
+			s, ok := summaries[key]
+			if !ok {
+				s = &promSummary{name: name, labels: p.Tags, quantiles: make(map[string]float64)}
+				summaries[key] = s
+			}
+			// count and sum are always in the typed stream, see TypedOnly
+			switch p.Stat {
+			case "count":
+				s.count = value
+			case "sum":
+				s.sum = value
+			default:
+				if q, ok := timerQuantile(p.Stat); ok {
+					s.quantiles[q] = value
+				}
+			}
+		default: // gauges, counter rates and sets
+			name := promName(p.Name)
+			labels := promLabels(p.Tags, "")
+			key := name + labels
+			// the latest of the points
+			if when, ok := gauges[key]; ok && when > p.When {
+				continue
+			}
+			gauges[key] = p.When
+			series[key] = promSample{name, labels, value}
+			types[name] = "gauge"
+		}
+	}
+
+	for key, s := range series {
+		if _, ok := gauges[key]; !ok {
+			if b.reset {
+				// every point is an increment
+				s.value = b.total(key) + deltas[key]
+			} else {
+				s.value = totals[key]
+			}
+			b.setTotal(s.name, "counter", s)
+			continue
+		}
+		samples[s.name] = append(samples[s.name], s)
+	}
+
+	for _, s := range summaries {
+		types[s.name] = "summary"
+		for q, v := range s.quantiles {
+			samples[s.name] = append(samples[s.name], promSample{s.name, promLabels(s.labels, q), v})
+		}
+		labels := promLabels(s.labels, "")
+		b.setTotal(s.name, "summary", promSample{s.name + "_sum", labels, b.total(s.name+"_sum"+labels) + s.sum})
+		b.setTotal(s.name, "summary", promSample{s.name + "_count", labels, b.total(s.name+"_count"+labels) + s.count})
+	}
+
+	for _, h := range histograms {
+		types[h.name] = "histogram"
+		bounds := make([]float64, 0, len(h.bins))
+		for bound := range h.bins {
+			bounds = append(bounds, bound)
+		}
+		sort.Float64s(bounds)
+		var below float64
+		for _, bound := range bounds {
+			// Prometheus buckets count all values <= le
+			n := h.bins[bound]
+			if !h.cumulative {
+				n += below
+			}
+			below = n
+			le := "+Inf"
+			if !math.IsInf(bound, 1) {
+				le = strconv.FormatFloat(bound, 'g', -1, 64)
+			}
+			labels := promLabels(addTags(map[string]string{"le": le}, h.labels), "")
+			b.setTotal(h.name, "histogram", promSample{h.name + "_bucket", labels, b.total(h.name+"_bucket"+labels) + n})
+			if math.IsInf(bound, 1) {
+				labels = promLabels(h.labels, "")
+				b.setTotal(h.name, "histogram", promSample{h.name + "_count", labels, b.total(h.name+"_count"+labels) + n})
+				var sum float64
+				if s, ok := summaries[h.summary]; ok {
+					sum = s.sum
+				}
+				b.setTotal(h.name, "histogram", promSample{h.name + "_sum", labels, b.total(h.name+"_sum"+labels) + sum})
+			}
+		}
+	}
+
+	// totals of series missing from this flush keep their last value, so
+	// they don't restart from 0, until they expire
+	for key, t := range b.totals {
+		if idle := b.flushes - t.flush; b.cfg.ExpireFlushes > 0 && idle > b.cfg.ExpireFlushes {
+			delete(b.totals, key)
+			continue
+		}
+		types[t.family] = t.typ
+		samples[t.family] = append(samples[t.family], t.sample)
+	}
+
+	b.page = renderPrometheus(types, samples)
+	return nil
+}
+
+// renderPrometheus writes families sorted by name with a TYPE line each.
+func renderPrometheus(types map[string]string, samples map[string][]promSample) []byte {
+	names := make([]string, 0, len(types))
+	for name := range types {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var out bytes.Buffer
+	for _, name := range names {
+		fmt.Fprintf(&out, "# TYPE %s %s\n", name, types[name])
+		family := samples[name]
+		sort.SliceStable(family, func(i, j int) bool {
+			if family[i].name != family[j].name {
+				return family[i].name < family[j].name
+			}
+			return family[i].labels < family[j].labels
+		})
+		for _, s := range family {
+			fmt.Fprintf(&out, "%s%s %s\n", s.name, s.labels, strconv.FormatFloat(s.value, 'g', -1, 64))
+		}
+	}
+	return out.Bytes()
+}
+
+// timerQuantile maps a timer (or histogram) statistic to its quantile:
+// upper_90 and 90percentile are 0.9, lower_75 (the lowest 75%) 0.25, upper
+// and max 1, lower and min 0.
+func timerQuantile(stat string) (string, bool) {
+	switch stat {
+	case "upper", "max":
+		return "1", true
+	case "lower", "min":
+		return "0", true
+	case "median":
+		return "0.5", true
+	}
+	pct, lower := strings.CutPrefix(stat, "lower_")
+	if !lower {
+		var ok bool
+		if pct, ok = strings.CutPrefix(stat, "upper_"); !ok {
+			if pct, ok = strings.CutSuffix(stat, "percentile"); !ok {
+				return "", false
+			}
+		}
+	}
+	f, err := strconv.ParseFloat(strings.ReplaceAll(pct, "_", "."), 64)
+	if err != nil {
+		return "", false
+	}
+	if lower {
+		f = 100 - f
+	}
+	return strconv.FormatFloat(f/100, 'g', -1, 64), true
+}
+
+// promName converts a bucket name into a valid metric name
+// ([a-zA-Z_:][a-zA-Z0-9_:]*), eg. api.req-time becomes api_req_time.
+func promName(bucket string) string {
+	return promSanitize(bucket, true)
+}
+
+// promSanitize replaces invalid characters with '_' and prefixes names
+// starting with a digit. Colons are only valid in metric names.
+func promSanitize(s string, colon bool) string {
+	b := []byte(s)
+	for i, c := range b {
+		switch {
+		case (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_':
+		case c == ':' && colon:
+		default:
+			b[i] = '_'
+		}
+	}
+	if len(b) == 0 || (b[0] >= '0' && b[0] <= '9') {
+		return "_" + string(b)
+	}
+	return string(b)
+}
+
+// promLabels renders tags as a sorted label set, with an optional quantile
+// label last. Empty tags and quantile give an empty string.
+func promLabels(tags map[string]string, quantile string) string {
+	if len(tags) == 0 && quantile == "" {
+		return ""
+	}
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var out strings.Builder
+	out.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			out.WriteByte(',')
+		}
+		fmt.Fprintf(&out, "%s=\"%s\"", promSanitize(k, false), promEscape(tags[k]))
+	}
+	if quantile != "" {
+		if len(keys) > 0 {
+			out.WriteByte(',')
+		}
+		fmt.Fprintf(&out, "quantile=\"%s\"", quantile)
+	}
+	out.WriteByte('}')
+	return out.String()
+}
+
+var promEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promEscape escapes a label value.
+func promEscape(s string) string {
+	return promEscaper.Replace(s)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPrometheusBackend(t *testing.T) {
+	b := newPrometheusBackend(ConfigPrometheusBackend{Address: ":0", Path: "/metrics"}, true)
+
+	web1 := map[string]string{"host": "web1"}
+	flush := []outputPoint{
+		{Kind: kindCounter, Name: "api.calls", Tags: web1, Value: int64(5), When: 1700000000},
+		{Kind: kindGauge, Name: "cpu.load", Value: 1.5, When: 1700000000},
+		{Kind: kindTimer, Name: "req.time", Stat: "upper_90", Tags: web1, Value: 9.0, When: 1700000000},
+		{Kind: kindTimer, Name: "req.time", Stat: "lower_75", Tags: web1, Value: 2.0, When: 1700000000},
+		{Kind: kindTimer, Name: "req.time", Stat: "sum", Tags: web1, Value: 40.0, When: 1700000000, TypedOnly: true},
+		{Kind: kindTimer, Name: "req.time", Stat: "upper", Tags: web1, Value: 10.0, When: 1700000000},
+		{Kind: kindTimer, Name: "req.time", Stat: "lower", Tags: web1, Value: 1.0, When: 1700000000},
+		{Kind: kindTimer, Name: "req.time", Stat: "count", Tags: web1, Value: 10, When: 1700000000},
+		{Kind: kindSet, Name: "users", Value: int64(3), When: 1700000000},
+		{Kind: kindKeyValue, Name: "build", Value: "abc", When: 1700000000},
+	}
+	for i := 0; i < 2; i++ {
+		if err := b.Send(renderTyped(flush), time.Now()); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+
+	want := `# TYPE api_calls_total counter
+api_calls_total{host="web1"} 10
+# TYPE cpu_load gauge
+cpu_load 1.5
+# TYPE req_time summary
+req_time{host="web1",quantile="0"} 1
+req_time{host="web1",quantile="0.25"} 2
+req_time{host="web1",quantile="0.9"} 9
+req_time{host="web1",quantile="1"} 10
+req_time_count{host="web1"} 20
+req_time_sum{host="web1"} 80
+# TYPE users gauge
+users 3
+`
+	rec := httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	got, _ := io.ReadAll(rec.Body)
+	if string(got) != want {
+		t.Errorf("exposition =\n%s\nwant\n%s", got, want)
+	}
+
+	// gauges missing from a flush are dropped, totals are kept
+	b.Send(renderTyped([]outputPoint{{Kind: kindGauge, Name: "cpu.load", Value: 2.0, When: 1700000010}}), time.Now())
+	want = `# TYPE api_calls_total counter
+api_calls_total{host="web1"} 10
+# TYPE cpu_load gauge
+cpu_load 2
+# TYPE req_time summary
+req_time_count{host="web1"} 20
+req_time_sum{host="web1"} 80
+`
+	rec = httptest.NewRecorder()
+	b.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	got, _ = io.ReadAll(rec.Body)
+	if string(got) != want {
+		t.Errorf("exposition after flush =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestPrometheusExpireTotals(t *testing.T) {
+	b := newPrometheusBackend(ConfigPrometheusBackend{ExpireFlushes: 2}, true)
+	calls := renderTyped([]outputPoint{{Kind: kindCounter, Name: "c", Value: int64(5), When: 1700000000}})
+	idle := renderTyped(nil)
+
+	b.Send(calls, time.Now())
+	b.Send(idle, time.Now())
+	b.Send(idle, time.Now())
+	// idle for two flushes, then it continues from its total
+	b.Send(calls, time.Now())
+	if got := string(b.page); got != "# TYPE c_total counter\nc_total 10\n" {
+		t.Errorf("exposition = %q", got)
+	}
+
+	for i := 0; i < 3; i++ {
+		b.Send(idle, time.Now())
+	}
+	if len(b.page) != 0 || len(b.totals) != 0 {
+		t.Errorf("exposition after expiry = %q", b.page)
+	}
+}
+
+func TestPrometheusNotReset(t *testing.T) {
+	b := newPrometheusBackend(ConfigPrometheusBackend{}, false)
+	b.Send(renderTyped([]outputPoint{{Kind: kindCounter, Name: "c", Value: int64(5), When: 1700000000}}), time.Now())
+	b.Send(renderTyped([]outputPoint{{Kind: kindCounter, Name: "c", Value: int64(7), When: 1700000010}}), time.Now())
+	if got := string(b.page); got != "# TYPE c_total counter\nc_total 7\n" {
+		t.Errorf("exposition = %q", got)
+	}
+}
+
+func TestPromNames(t *testing.T) {
+	tests := map[string]string{
+		"api.req-time": "api_req_time",
+		"1xx.count":    "_1xx_count",
+		"ns:sub.x":     "ns:sub_x",
+	}
+	for in, want := range tests {
+		if got := promName(in); got != want {
+			t.Errorf("promName(%q) = %q, want %q", in, got, want)
+		}
+	}
+	got := promLabels(map[string]string{"a.b": `x"y\z`}, "0.5")
+	if want := `{a_b="x\"y\\z",quantile="0.5"}`; got != want {
+		t.Errorf("promLabels = %s, want %s", got, want)
+	}
+}
+
+func TestPrometheusTimerHistogram(t *testing.T) {
+	Config.TimerHistograms = []ConfigTimerHistogram{{Prefix: "req.", Bins: []float64{100, 500}}}
+	Config.ExtraTagsHash = map[string]string{}
+	Config.TimerStats = []string{"upper"}
+	defer func() {
+		Config.TimerHistograms = nil
+		Config.TimerStats = nil
+	}()
+
+	// count and sum reach the backend though timer-stats has neither
+	b := newPrometheusBackend(ConfigPrometheusBackend{}, true)
+	mx := newMetrics()
+	for i := 0; i < 2; i++ {
+		for _, v := range []float64{50, 50, 50, 50, 50, 50, 200, 200, 200, 1000} {
+			mx.handlePacket(&Packet{Bucket: "req.time.^host=web1", Value: v, Modifier: "ms", Sampling: 1})
+		}
+		var out flushOutput
+		mx.processTimers(&out, 1700000000, nil)
+		b.Send(out.render("typed"), time.Now())
+	}
+
+	want := `# TYPE req_time summary
+req_time{host="web1",quantile="1"} 1000
+req_time_count{host="web1"} 20
+req_time_sum{host="web1"} 3800
+# TYPE req_time_histogram histogram
+req_time_histogram_bucket{host="web1",le="+Inf"} 20
+req_time_histogram_bucket{host="web1",le="100"} 12
+req_time_histogram_bucket{host="web1",le="500"} 18
+req_time_histogram_count{host="web1"} 20
+req_time_histogram_sum{host="web1"} 3800
+`
+	if got := string(b.page); got != want {
+		t.Errorf("exposition =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestPrometheusCounterRate(t *testing.T) {
+	Config.CfgCounterRate = ConfigCounterRate{Enabled: true, Count: true}
+	flushInterval := Config.FlushInterval
+	Config.FlushInterval = 10
+	defer func() {
+		Config.CfgCounterRate = ConfigCounterRate{}
+		Config.FlushInterval = flushInterval
+	}()
+
+	b := newPrometheusBackend(ConfigPrometheusBackend{}, true)
+	var flush flushOutput
+	writeCounter(&flush, "api.calls", 5, 5, 1700000000)
+	b.Send(flush.render("typed"), time.Now())
+	b.Send(flush.render("typed"), time.Now())
+	want := "# TYPE api_calls_count_total counter\napi_calls_count_total 10\n# TYPE api_calls_rate gauge\napi_calls_rate 0.5\n# TYPE api_calls_total counter\napi_calls_total 10\n"
+	if got := string(b.page); got != want {
+		t.Errorf("exposition = %q, want %q", got, want)
+	}
+}
+
+func TestPrometheusTimedPoints(t *testing.T) {
+	lastGaugeValue = make(map[string]float64)
+	db := openSpoolTestDB(t, "/tmp/prometheus_timed_test.db")
+	defer closeAndRemove(db, "/tmp/prometheus_timed_test.db")
+
+	for _, reset := range []bool{true, false} {
+		b := newPrometheusBackend(ConfigPrometheusBackend{}, reset)
+		for i := 0; i < 2; i++ {
+			mx := newMetrics()
+			mx.handlePacket(&Packet{Bucket: "api.calls", Value: int64(5), Modifier: "c", Sampling: 1})
+			mx.handlePacket(&Packet{Bucket: "api.calls", Value: int64(2), Modifier: "c", Sampling: 1, Timestamp: 1700000000})
+			mx.handlePacket(&Packet{Bucket: "api.calls", Value: int64(1), Modifier: "c", Sampling: 1, Timestamp: 1700000005})
+			mx.handlePacket(&Packet{Bucket: "cpu.load", Value: GaugeData{false, false, 1}, Modifier: "g", Sampling: 1})
+			mx.handlePacket(&Packet{Bucket: "cpu.load", Value: GaugeData{false, false, 2}, Modifier: "g", Sampling: 1, Timestamp: 1700000000})
+
+			var out flushOutput
+			now := int64(1700000010)
+			mx.processTimedCounters(&out, reset, db)
+			mx.processCounters(&out, now, reset, db)
+			mx.processGauges(&out, now)
+			mx.processTimedGauges(&out)
+			b.Send(out.render("typed"), time.Now())
+		}
+		want := "# TYPE api_calls_total counter\napi_calls_total 16\n# TYPE cpu_load gauge\ncpu_load 1\n"
+		if got := string(b.page); got != want {
+			t.Errorf("reset %v: exposition = %q, want %q", reset, got, want)
+		}
+	}
+}
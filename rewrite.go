@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+)
+
+// ConfigRewriteRule - one of the ordered 'rewrite-rules' applied to every
+// metric name (without tags, before the global prefix) and its tags. A rule
+// whose Match matches the name:
+//   - drops the metric, or
+//   - renames it (regexp replacement, $1 or ${name} refer to groups of Match),
+//   - adds tags, values may refer to groups too (segments of the name become
+//     tags),
+//   - removes and renames tags,
+//
+// and the next rules see the result, unless the rule is the last one.
+type ConfigRewriteRule struct {
+	// Match - regexp; empty matches every name
+	Match      string            `yaml:"match"`
+	Drop       bool              `yaml:"drop"`
+	Rename     string            `yaml:"rename"`
+	AddTags    map[string]string `yaml:"add-tags"`
+	RemoveTags []string          `yaml:"remove-tags"`
+	RenameTags map[string]string `yaml:"rename-tags"`
+	// Last - no more rules are applied after this one matched
+	Last bool `yaml:"last"`
+
+	// private - compiled Match
+	re *regexp.Regexp
+}
+
+// compileRewriteRules compiles the Match of every rule.
+func compileRewriteRules(rules []ConfigRewriteRule) error {
+	for i := range rules {
+		re, err := regexp.Compile(rules[i].Match)
+		if err != nil {
+			return fmt.Errorf("Parameter error: rewrite-rules entry %d: invalid match %q: %s", i+1, rules[i].Match, err)
+		}
+		for from, to := range rules[i].RenameTags {
+			if len(from) == 0 || len(to) == 0 {
+				return fmt.Errorf("Parameter error: rewrite-rules entry %d: empty tag name in rename-tags", i+1)
+			}
+		}
+		rules[i].re = re
+	}
+	return nil
+}
+
+// rewriteResult - how rewriteMetric changed a metric
+type rewriteResult int
+
+const (
+	rewriteNone rewriteResult = iota
+	rewriteChanged
+	rewriteDropped
+	// rewriteEmpty - renamed to an empty name, the metric is rejected (set by
+	// parseLine, cached like drops)
+	rewriteEmpty
+)
+
+// rewriteMetric applies rules to the metric name and tags, which it may
+// modify. Rules without a compiled match (see compileRewriteRules) are
+// skipped.
+func rewriteMetric(rules []ConfigRewriteRule, name string, tags map[string]string) (string, map[string]string, rewriteResult) {
+	result := rewriteNone
+	for _, r := range rules {
+		if r.re == nil {
+			continue
+		}
+		m := r.re.FindStringSubmatchIndex(name)
+		if m == nil {
+			continue
+		}
+		if r.Drop {
+			return name, tags, rewriteDropped
+		}
+
+		newName := name
+		if len(r.Rename) > 0 {
+			newName = r.re.ReplaceAllString(name, r.Rename)
+		}
+		for k, v := range r.AddTags {
+			value := string(r.re.ExpandString(nil, v, name, m))
+			value = sanitizeBucket(value)
+			if len(value) == 0 {
+				continue
+			}
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[sanitizeBucket(k)] = value
+		}
+		for _, k := range r.RemoveTags {
+			delete(tags, k)
+		}
+		for from, to := range r.RenameTags {
+			if v, ok := tags[from]; ok {
+				delete(tags, from)
+				tags[to] = v
+			}
+		}
+		name = newName
+		result = rewriteChanged
+
+		if r.Last {
+			break
+		}
+	}
+	return name, tags, result
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestRewriteMetric(t *testing.T) {
+	rules := []ConfigRewriteRule{
+		{Match: `^junk\.`, Drop: true},
+		{Match: `^servers\.([^.]+)\.(cpu|mem)\.(.+)$`, Rename: "system.$2.$3", AddTags: map[string]string{"host": "$1"}},
+		{Match: `^system\.`, RemoveTags: []string{"tmp"}, RenameTags: map[string]string{"dc": "datacenter"}, Last: true},
+		{Match: `^system\.`, Drop: true},
+		{Match: `^legacy_(\w+)$`, Rename: "app.${1}"},
+	}
+	assert.Equal(t, nil, compileRewriteRules(rules))
+
+	tests := []struct {
+		name     string
+		tags     map[string]string
+		wantName string
+		wantTags map[string]string
+		want     rewriteResult
+	}{
+		{"junk.x", nil, "junk.x", nil, rewriteDropped},
+		{"other.metric", map[string]string{"a": "b"}, "other.metric", map[string]string{"a": "b"}, rewriteNone},
+		// rename with tags from segments, then the tag rules, then stop
+		{"servers.web1.cpu.user", map[string]string{"dc": "eu", "tmp": "1"}, "system.cpu.user",
+			map[string]string{"host": "web1", "datacenter": "eu"}, rewriteChanged},
+		{"legacy_calls", nil, "app.calls", nil, rewriteChanged},
+	}
+	for _, tt := range tests {
+		name, tags, got := rewriteMetric(rules, tt.name, tt.tags)
+		assert.Equal(t, tt.want, got, tt.name)
+		assert.Equal(t, tt.wantName, name, tt.name)
+		assert.Equal(t, tt.wantTags, tags, tt.name)
+	}
+
+	assert.NotEqual(t, nil, compileRewriteRules([]ConfigRewriteRule{{Match: "("}}))
+	assert.NotEqual(t, nil, compileRewriteRules([]ConfigRewriteRule{{RenameTags: map[string]string{"a": ""}}}))
+}
+
+func TestParseLineRewrite(t *testing.T) {
+	Config.RewriteRules = []ConfigRewriteRule{
+		{Match: `^debug\.`, Drop: true},
+		{Match: `^api\.([^.]+)\.latency$`, Rename: "api.latency", AddTags: map[string]string{"endpoint": "$1"}},
+	}
+	assert.Equal(t, nil, compileRewriteRules(Config.RewriteRules))
+	nameCache.Flush()
+	packetCache.Flush()
+	defer func() {
+		Config.RewriteRules = nil
+		nameCache.Flush()
+		packetCache.Flush()
+	}()
+	Stat.ProcessStats(packetCache, nameCache) // drain counters from other tests
+
+	// the second time from the caches
+	for i := 0; i < 2; i++ {
+		assert.Equal(t, (*Packet)(nil), parseLine([]byte("debug.x:1|c")))
+		p := parseLine([]byte("api.login.latency.^host=h1:1|c"))
+		assert.NotEqual(t, (*Packet)(nil), p)
+		assert.Equal(t, "api.latency.^endpoint=login.^host=h1", p.Bucket)
+		p = parseLine([]byte("api.other:1|c"))
+		assert.Equal(t, "api.other", p.Bucket)
+	}
+
+	Stat.ProcessStats(packetCache, nameCache)
+	assert.Equal(t, int64(2), Stat.savedStat.RewriteDropped)
+	assert.Equal(t, int64(2), Stat.savedStat.RewriteRewritten)
+}
+
+func TestParseLineRewriteEmptyName(t *testing.T) {
+	Config.RewriteRules = []ConfigRewriteRule{
+		{Match: `^tmp\..*`, Rename: "@"},
+	}
+	assert.Equal(t, nil, compileRewriteRules(Config.RewriteRules))
+	nameCache.Flush()
+	defer func() {
+		Config.RewriteRules = nil
+		nameCache.Flush()
+	}()
+	Stat.ProcessStats(packetCache, nameCache) // drain counters from other tests
+
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, (*Packet)(nil), parseLine([]byte("tmp.x:1|c")))
+	}
+	// the rejection is cached, rules run once
+	_, found := nameCache.Get("tmp.x")
+	assert.T(t, found)
+
+	Stat.ProcessStats(packetCache, nameCache)
+	assert.Equal(t, int64(3), Stat.savedStat.PointsParseFail)
+}
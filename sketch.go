@@ -0,0 +1,253 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// default relative accuracy of quantiles computed from a ddSketch
+const defaultSketchAccuracy = 0.01
+
+// ConfigTimerSketch - timers aggregated in sketches instead of keeping every
+// sample until flush. Memory per timer is bounded by the number of sketch
+// buckets, percentiles are within sketch-accuracy of the exact ones.
+type ConfigTimerSketch struct {
+	// Enabled - all timers use sketches
+	Enabled bool `yaml:"enabled"`
+	// Prefixes - when not enabled for all timers, only timers whose bucket
+	// starts with one of the prefixes use sketches
+	Prefixes []string `yaml:"prefixes"`
+}
+
+// useFor reports whether the timer bucket is aggregated in a sketch.
+func (c ConfigTimerSketch) useFor(bucket string) bool {
+	return c.Enabled || prefixPresent(bucket, c.Prefixes)
+}
+
+// ddSketch is a DDSketch (Masson et al., VLDB 2019): values are counted in
+// logarithmic buckets, so every quantile is returned with a relative error of
+// at most alpha, whatever the number of values. Sketches with the same alpha
+// merge exactly by adding bucket counts. Exact count, sum, sum of squares, min
+// and max are kept on the side.
+type ddSketch struct {
+	alpha    float64
+	gamma    float64
+	lnGamma  float64
+	positive map[int]uint64
+	negative map[int]uint64
+	zero     uint64
+	count    uint64
+	sum      float64
+	// sumSquares - for the standard deviation of timers
+	sumSquares float64
+	min        float64
+	max        float64
+}
+
+func newDDSketch(alpha float64) *ddSketch {
+	if alpha <= 0 || alpha >= 1 {
+		alpha = defaultSketchAccuracy
+	}
+	gamma := (1 + alpha) / (1 - alpha)
+	return &ddSketch{
+		alpha:    alpha,
+		gamma:    gamma,
+		lnGamma:  math.Log(gamma),
+		positive: make(map[int]uint64),
+		negative: make(map[int]uint64),
+		min:      math.Inf(1),
+		max:      math.Inf(-1),
+	}
+}
+
+// values smaller than this are counted as zero
+const sketchMinValue = 1e-9
+
+func (s *ddSketch) index(v float64) int {
+	return int(math.Ceil(math.Log(v) / s.lnGamma))
+}
+
+// value is the representative of bucket i, within alpha of every value in it.
+func (s *ddSketch) value(i int) float64 {
+	return 2 * math.Pow(s.gamma, float64(i)) / (s.gamma + 1)
+}
+
+// Add counts v.
+func (s *ddSketch) Add(v float64) {
+	switch {
+	case v > sketchMinValue:
+		s.positive[s.index(v)]++
+	case v < -sketchMinValue:
+		s.negative[s.index(-v)]++
+	default:
+		s.zero++
+	}
+	s.count++
+	s.sum += v
+	s.sumSquares += v * v
+	s.min = math.Min(s.min, v)
+	s.max = math.Max(s.max, v)
+}
+
+// Merge adds the values counted by o, which must have the same accuracy.
+func (s *ddSketch) Merge(o *ddSketch) {
+	for i, c := range o.positive {
+		s.positive[i] += c
+	}
+	for i, c := range o.negative {
+		s.negative[i] += c
+	}
+	s.zero += o.zero
+	s.count += o.count
+	s.sum += o.sum
+	s.sumSquares += o.sumSquares
+	s.min = math.Min(s.min, o.min)
+	s.max = math.Max(s.max, o.max)
+}
+
+// Quantile returns the q-quantile (0 <= q <= 1), clamped to [min, max].
+func (s *ddSketch) Quantile(q float64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return s.min
+	}
+	if q >= 1 {
+		return s.max
+	}
+	return s.Rank(uint64(q * float64(s.count-1)))
+}
+
+// Rank returns the value of the rank-th smallest value (0 based), clamped to
+// [min, max].
+func (s *ddSketch) Rank(rank uint64) float64 {
+	if s.count == 0 {
+		return 0
+	}
+	if rank >= s.count-1 {
+		return s.max
+	}
+
+	var v float64
+	var seen uint64
+	found := false
+	// negative values from the most negative one
+	for _, i := range sortedKeys(s.negative, true) {
+		seen += s.negative[i]
+		if seen > rank {
+			v, found = -s.value(i), true
+			break
+		}
+	}
+	if !found {
+		seen += s.zero
+		if seen > rank {
+			found = true
+		}
+	}
+	if !found {
+		for _, i := range sortedKeys(s.positive, false) {
+			seen += s.positive[i]
+			if seen > rank {
+				v = s.value(i)
+				break
+			}
+		}
+	}
+	return math.Max(s.min, math.Min(s.max, v))
+}
+
+// SumLowest returns the sum of the n smallest values, each counted as its
+// bucket representative, so within alpha of the exact sum.
+func (s *ddSketch) SumLowest(n uint64) float64 {
+	if n >= s.count {
+		return s.sum
+	}
+	return s.sumLowest(n, func(v float64) float64 { return v })
+}
+
+// SumSquaresLowest returns the sum of squares of the n smallest values, within
+// about 2*alpha of the exact sum.
+func (s *ddSketch) SumSquaresLowest(n uint64) float64 {
+	if n >= s.count {
+		return s.sumSquares
+	}
+	return s.sumLowest(n, func(v float64) float64 { return v * v })
+}
+
+// sumLowest adds f of the bucket representatives of the n smallest values.
+func (s *ddSketch) sumLowest(n uint64, f func(float64) float64) float64 {
+	var sum float64
+	left := n
+	add := func(c uint64, v float64) {
+		c = min(c, left)
+		sum += float64(c) * f(v)
+		left -= c
+	}
+	for _, i := range sortedKeys(s.negative, true) {
+		if left == 0 {
+			break
+		}
+		add(s.negative[i], -s.value(i))
+	}
+	add(s.zero, 0)
+	for _, i := range sortedKeys(s.positive, false) {
+		if left == 0 {
+			break
+		}
+		add(s.positive[i], s.value(i))
+	}
+	return sum
+}
+
+// CountAtMost returns the number of values <= bound. All values in the
+// bucket of bound (within alpha of it) are counted as <= bound.
+func (s *ddSketch) CountAtMost(bound float64) uint64 {
+	if bound >= s.max {
+		return s.count
+	}
+	if bound < s.min {
+		return 0
+	}
+	var n uint64
+	switch {
+	case bound > sketchMinValue:
+		n = s.zero
+		for _, c := range s.negative {
+			n += c
+		}
+		k := s.index(bound)
+		for i, c := range s.positive {
+			if i <= k {
+				n += c
+			}
+		}
+	case bound < -sketchMinValue:
+		k := s.index(-bound)
+		for i, c := range s.negative {
+			if i >= k {
+				n += c
+			}
+		}
+	default:
+		n = s.zero
+		for _, c := range s.negative {
+			n += c
+		}
+	}
+	return n
+}
+
+func sortedKeys(m map[int]uint64, desc bool) []int {
+	keys := make([]int, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	if desc {
+		sort.Sort(sort.Reverse(sort.IntSlice(keys)))
+	} else {
+		sort.Ints(keys)
+	}
+	return keys
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func TestDDSketchAccuracy(t *testing.T) {
+	const alpha = 0.01
+	r := rand.New(rand.NewSource(1))
+	sk := newDDSketch(alpha)
+	var values []float64
+	for i := 0; i < 10000; i++ {
+		v := math.Exp(r.NormFloat64() * 3) // wide, skewed range
+		if i%10 == 0 {
+			v = -v
+		}
+		values = append(values, v)
+		sk.Add(v)
+	}
+	sort.Float64s(values)
+
+	for _, q := range []float64{0.01, 0.1, 0.25, 0.5, 0.75, 0.9, 0.99} {
+		want := values[int(q*float64(len(values)-1))]
+		got := sk.Quantile(q)
+		if math.Abs(got-want) > alpha*math.Abs(want) {
+			t.Errorf("Quantile(%v) = %v, want %v within %v", q, got, want, alpha)
+		}
+	}
+	if sk.Quantile(0) != values[0] || sk.Quantile(1) != values[len(values)-1] {
+		t.Errorf("Quantile(0/1) = %v/%v, want min/max %v/%v", sk.Quantile(0), sk.Quantile(1), values[0], values[len(values)-1])
+	}
+}
+
+func TestDDSketchMerge(t *testing.T) {
+	a, b, all := newDDSketch(0.01), newDDSketch(0.01), newDDSketch(0.01)
+	for i := 1; i <= 1000; i++ {
+		v := float64(i)
+		all.Add(v)
+		if i%2 == 0 {
+			a.Add(v)
+		} else {
+			b.Add(v)
+		}
+	}
+	a.Add(0)
+	all.Add(0)
+	a.Merge(b)
+
+	if a.count != all.count || a.sum != all.sum || a.min != all.min || a.max != all.max {
+		t.Errorf("merged count/sum/min/max = %d/%v/%v/%v, want %d/%v/%v/%v", a.count, a.sum, a.min, a.max, all.count, all.sum, all.min, all.max)
+	}
+	for _, q := range []float64{0.1, 0.5, 0.9} {
+		if a.Quantile(q) != all.Quantile(q) {
+			t.Errorf("merged Quantile(%v) = %v, want %v", q, a.Quantile(q), all.Quantile(q))
+		}
+	}
+}
+
+func TestDDSketchSumLowest(t *testing.T) {
+	sk := newDDSketch(0.01)
+	for i := -100; i <= 1000; i++ {
+		sk.Add(float64(i))
+	}
+	for _, n := range []uint64{0, 1, 50, 101, 102, 600, 1101, 2000} {
+		want, abs := float64(0), float64(0)
+		for i := 0; i < int(min(n, 1101)); i++ {
+			want += float64(i - 100)
+			abs += math.Abs(float64(i - 100))
+		}
+		// every value is counted within 1%
+		if got := sk.SumLowest(n); math.Abs(got-want) > 0.01*abs {
+			t.Errorf("SumLowest(%d) = %v, want %v", n, got, want)
+		}
+	}
+}
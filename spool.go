@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Failed batches are kept in the store-db, in a bucket next to the counters
+// bucket, with one nested bucket per backend. Keys are big-endian sequence
+// numbers so a cursor walks the spool oldest first. Values are the big-endian
+// unix time the batch was spooled (spoolHeaderLen bytes) followed by the
+// batch, already serialized in the backend format, so the points keep their
+// original timestamps on replay.
+var spoolBucketName = "spool"
+
+const spoolHeaderLen = 8
+
+// ConfigSpool - retry spool config for batches that failed to be sent.
+type ConfigSpool struct {
+	Enabled bool `yaml:"enabled"`
+	// limits per backend; 0 means no limit. When exceeded the oldest
+	// batches are dropped.
+	MaxBatches int64 `yaml:"max-batches"`
+	MaxBytes   int64 `yaml:"max-bytes"`
+	MaxAge     int64 `yaml:"max-age"` // seconds
+	// replay backoff in seconds, doubled after each failed attempt
+	InitialBackoff int64 `yaml:"initial-backoff"`
+	MaxBackoff     int64 `yaml:"max-backoff"`
+}
+
+// backendSpool tracks the replay backoff and the size of the spool of a
+// single backend.
+type backendSpool struct {
+	backend     string
+	mu          sync.Mutex
+	backoff     time.Duration
+	nextAttempt time.Time
+
+	// sizeMu guards the running totals of the spool bucket, counted once on
+	// first use and updated on every push, drop and replay
+	sizeMu  sync.Mutex
+	counted bool
+	batches int64
+	bytes   int64
+}
+
+func newBackendSpool(backend string) *backendSpool {
+	return &backendSpool{backend: backend}
+}
+
+// failed pushes the replay backoff forward after a failed replay.
+func (s *backendSpool) failed(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	initial := time.Duration(Config.CfgSpool.InitialBackoff) * time.Second
+	max := time.Duration(Config.CfgSpool.MaxBackoff) * time.Second
+	if s.backoff == 0 {
+		s.backoff = initial
+	} else {
+		s.backoff *= 2
+	}
+	if max > 0 && s.backoff > max {
+		s.backoff = max
+	}
+	s.nextAttempt = now.Add(s.backoff)
+}
+
+// recovered resets the backoff once the spool has been fully replayed.
+func (s *backendSpool) recovered() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.backoff = 0
+	s.nextAttempt = time.Time{}
+}
+
+// due reports whether a replay may be attempted at now.
+func (s *backendSpool) due(now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !now.Before(s.nextAttempt)
+}
+
+// push stores a failed batch and enforces the spool limits.
+func (s *backendSpool) push(db *bolt.DB, data []byte, now time.Time) error {
+	entry := make([]byte, spoolHeaderLen+len(data))
+	binary.BigEndian.PutUint64(entry, uint64(now.Unix()))
+	copy(entry[spoolHeaderLen:], data)
+
+	s.sizeMu.Lock()
+	defer s.sizeMu.Unlock()
+	batches, size := s.batches, s.bytes
+	err := db.Update(func(tx *bolt.Tx) error {
+		b, err := spoolBucket(tx, s.backend)
+		if err != nil {
+			return err
+		}
+		if !s.counted {
+			batches, size = countSpool(b)
+		}
+		seq, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err := b.Put(spoolKey(seq), entry); err != nil {
+			return err
+		}
+		batches++
+		size += int64(len(entry))
+		return trimSpool(b, now, &batches, &size)
+	})
+	if err != nil {
+		return err
+	}
+	s.counted, s.batches, s.bytes = true, batches, size
+	Stat.BatchesSpooledInc()
+	return nil
+}
+
+// replay sends spooled batches oldest first until the spool is empty, a send
+// fails or the deadline passes. Each batch is removed only after it was sent;
+// batches older than max-age are dropped without sending.
+func (s *backendSpool) replay(db *bolt.DB, backend Backend, deadline time.Time) error {
+	for time.Now().Before(deadline) {
+		var key, entry []byte
+		err := db.View(func(tx *bolt.Tx) error {
+			b := existingSpoolBucket(tx, s.backend)
+			if b == nil {
+				return nil
+			}
+			k, v := b.Cursor().First()
+			if k == nil {
+				return nil
+			}
+			key = append([]byte{}, k...)
+			entry = append([]byte{}, v...)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if key == nil {
+			s.recovered()
+			return nil
+		}
+
+		// truncated and expired entries are only dropped
+		if spoolExpired(entry, time.Now()) {
+			Stat.BatchesSpoolDroppedInc()
+		} else {
+			if err := backend.Send(bytes.NewBuffer(entry[spoolHeaderLen:]), deadline); err != nil {
+				return err
+			}
+			Stat.BatchesReplayedInc()
+		}
+
+		if err := s.remove(db, key, int64(len(entry))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// remove deletes a replayed batch of size bytes from the spool.
+func (s *backendSpool) remove(db *bolt.DB, key []byte, size int64) error {
+	s.sizeMu.Lock()
+	defer s.sizeMu.Unlock()
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := existingSpoolBucket(tx, s.backend)
+		if b == nil {
+			return nil
+		}
+		return b.Delete(key)
+	})
+	if err != nil {
+		return err
+	}
+	if s.counted {
+		s.batches--
+		s.bytes -= size
+	}
+	return nil
+}
+
+// countSpool returns the number of batches and bytes in a spool bucket.
+func countSpool(b *bolt.Bucket) (batches, size int64) {
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.Next() {
+		batches++
+		size += int64(len(v))
+	}
+	return batches, size
+}
+
+// trimSpool drops the oldest batches until the bucket fits the configured
+// limits, keeping the running totals of batches and bytes up to date.
+func trimSpool(b *bolt.Bucket, now time.Time, batches, size *int64) error {
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.First() {
+		overCount := Config.CfgSpool.MaxBatches > 0 && *batches > Config.CfgSpool.MaxBatches
+		overSize := Config.CfgSpool.MaxBytes > 0 && *size > Config.CfgSpool.MaxBytes
+		if !overCount && !overSize && !spoolExpired(v, now) {
+			break
+		}
+		*batches--
+		*size -= int64(len(v))
+		if err := c.Delete(); err != nil {
+			return err
+		}
+		Stat.BatchesSpoolDroppedInc()
+	}
+	return nil
+}
+
+// spoolExpired reports whether a spool entry is truncated or older than
+// max-age at now.
+func spoolExpired(entry []byte, now time.Time) bool {
+	if len(entry) < spoolHeaderLen {
+		return true
+	}
+	return Config.CfgSpool.MaxAge > 0 && int64(binary.BigEndian.Uint64(entry)) < now.Unix()-Config.CfgSpool.MaxAge
+}
+
+func spoolBucket(tx *bolt.Tx, backend string) (*bolt.Bucket, error) {
+	if len(backend) == 0 {
+		return nil, errors.New("backend name can't be empty")
+	}
+	root, err := tx.CreateBucketIfNotExists([]byte(spoolBucketName))
+	if err != nil {
+		return nil, err
+	}
+	return root.CreateBucketIfNotExists([]byte(backend))
+}
+
+func existingSpoolBucket(tx *bolt.Tx, backend string) *bolt.Bucket {
+	root := tx.Bucket([]byte(spoolBucketName))
+	if root == nil {
+		return nil
+	}
+	return root.Bucket([]byte(backend))
+}
+
+func spoolKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// sendWithSpool sends data to the backend. On failure the batch is spooled;
+// on success any previously spooled batches are replayed when the backoff
+// allows it.
+func sendWithSpool(nb namedBackend, data []byte, deadline time.Time) error {
+	logCtx := log.WithFields(log.Fields{
+		"in":      "sendWithSpool",
+		"backend": nb.Name,
+	})
+
+	err := nb.Backend.Send(bytes.NewBuffer(data), deadline)
+	if nb.spool == nil || dbHandle == nil {
+		return err
+	}
+
+	// a failed send only spools the batch, the replay backoff grows with
+	// failed replays
+	now := time.Now()
+	if err != nil {
+		if serr := nb.spool.push(dbHandle, data, now); serr != nil {
+			logCtx.Errorf("spooling failed batch: %s", serr)
+			Stat.OtherErrorsInc()
+		}
+		return err
+	}
+
+	if nb.spool.due(now) {
+		if rerr := nb.spool.replay(dbHandle, nb.Backend, deadline); rerr != nil {
+			logCtx.Warnf("replaying spooled batches: %s", rerr)
+			nb.spool.failed(now)
+		}
+	}
+	return nil
+}
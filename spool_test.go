@@ -0,0 +1,257 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// seqBackend records every batch it was sent and fails while down is set.
+type seqBackend struct {
+	down bool
+	got  []string
+}
+
+func (b *seqBackend) Send(buf *bytes.Buffer, _ time.Time) error {
+	if b.down {
+		return errors.New("backend down")
+	}
+	b.got = append(b.got, buf.String())
+	return nil
+}
+
+func openSpoolTestDB(t *testing.T, file string) *bolt.DB {
+	removeFile(file)
+	db, err := bolt.Open(file, 0644, &bolt.Options{Timeout: 1 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return db
+}
+
+func spoolLen(t *testing.T, db *bolt.DB, backend string) int {
+	n := 0
+	err := db.View(func(tx *bolt.Tx) error {
+		if b := existingSpoolBucket(tx, backend); b != nil {
+			n = b.Stats().KeyN
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestSpoolLimitsDropOldest(t *testing.T) {
+	db := openSpoolTestDB(t, "/tmp/spool_limits_test.db")
+	defer closeAndRemove(db, "/tmp/spool_limits_test.db")
+
+	saved := Config.CfgSpool
+	defer func() { Config.CfgSpool = saved }()
+	Config.CfgSpool = ConfigSpool{Enabled: true, MaxBatches: 2, MaxAge: 60}
+
+	s := newBackendSpool("graphite")
+	now := time.Now().Add(-2 * time.Minute)
+	for _, data := range []string{"a 1 1\n", "b 2 2\n", "c 3 3\n"} {
+		if err := s.push(db, []byte(data), now); err != nil {
+			t.Fatalf("push: %v", err)
+		}
+	}
+	if n := spoolLen(t, db, "graphite"); n != 2 {
+		t.Fatalf("spool holds %d batches, want 2 (max-batches)", n)
+	}
+
+	// a batch pushed after max-age evicts everything older
+	if err := s.push(db, []byte("d 4 4\n"), now.Add(2*time.Minute)); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if n := spoolLen(t, db, "graphite"); n != 1 {
+		t.Fatalf("spool holds %d batches, want 1 (max-age)", n)
+	}
+
+	b := &seqBackend{}
+	if err := s.replay(db, b, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if len(b.got) != 1 || b.got[0] != "d 4 4\n" {
+		t.Errorf("replayed %q, want only the newest batch", b.got)
+	}
+}
+
+func TestSendWithSpoolReplaysInOrder(t *testing.T) {
+	db := openSpoolTestDB(t, "/tmp/spool_replay_test.db")
+	defer closeAndRemove(db, "/tmp/spool_replay_test.db")
+
+	savedDb, savedCfg := dbHandle, Config.CfgSpool
+	defer func() { dbHandle, Config.CfgSpool = savedDb, savedCfg }()
+	dbHandle = db
+	Config.CfgSpool = ConfigSpool{Enabled: true, InitialBackoff: 0, MaxBackoff: 0}
+
+	b := &seqBackend{down: true}
+	nb := namedBackend{Name: "graphite", Format: "graphite", Backend: b, spool: newBackendSpool("graphite")}
+	deadline := time.Now().Add(time.Second)
+
+	for _, data := range []string{"m 1 100\n", "m 2 110\n"} {
+		if err := sendWithSpool(nb, []byte(data), deadline); err == nil {
+			t.Fatal("sendWithSpool to a down backend expected error")
+		}
+	}
+	if n := spoolLen(t, db, "graphite"); n != 2 {
+		t.Fatalf("spool holds %d batches, want 2", n)
+	}
+
+	b.down = false
+	if err := sendWithSpool(nb, []byte("m 3 120\n"), deadline); err != nil {
+		t.Fatalf("sendWithSpool: %v", err)
+	}
+	want := []string{"m 3 120\n", "m 1 100\n", "m 2 110\n"}
+	if len(b.got) != len(want) {
+		t.Fatalf("backend got %q, want %q", b.got, want)
+	}
+	for i := range want {
+		if b.got[i] != want[i] {
+			t.Errorf("batch %d = %q, want %q", i, b.got[i], want[i])
+		}
+	}
+	if n := spoolLen(t, db, "graphite"); n != 0 {
+		t.Errorf("spool holds %d batches after replay, want 0", n)
+	}
+}
+
+func TestBackendSpoolBackoff(t *testing.T) {
+	saved := Config.CfgSpool
+	defer func() { Config.CfgSpool = saved }()
+	Config.CfgSpool = ConfigSpool{InitialBackoff: 10, MaxBackoff: 30}
+
+	s := newBackendSpool("graphite")
+	now := time.Unix(1700000000, 0)
+	for _, want := range []time.Duration{10, 20, 30, 30} {
+		s.failed(now)
+		if s.backoff != want*time.Second {
+			t.Errorf("backoff = %s, want %s", s.backoff, want*time.Second)
+		}
+	}
+	if s.due(now.Add(29 * time.Second)) {
+		t.Error("replay due before backoff elapsed")
+	}
+	if !s.due(now.Add(30 * time.Second)) {
+		t.Error("replay not due after backoff elapsed")
+	}
+	s.recovered()
+	if !s.due(now) {
+		t.Error("replay not due after recovery")
+	}
+}
+
+func TestSpoolRunningTotals(t *testing.T) {
+	db := openSpoolTestDB(t, "/tmp/spool_totals_test.db")
+	defer closeAndRemove(db, "/tmp/spool_totals_test.db")
+
+	saved := Config.CfgSpool
+	defer func() { Config.CfgSpool = saved }()
+	Config.CfgSpool = ConfigSpool{Enabled: true, MaxBytes: 3 * (spoolHeaderLen + 6)}
+
+	now := time.Unix(1700000000, 0)
+	// batches spooled by an earlier run are counted on first use
+	if err := newBackendSpool("graphite").push(db, []byte("a 1 1\n"), now); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	s := newBackendSpool("graphite")
+	for _, data := range []string{"b 2 2\n", "c 3 3\n", "d 4 4\n"} {
+		if err := s.push(db, []byte(data), now); err != nil {
+			t.Fatalf("push: %v", err)
+		}
+	}
+	if s.batches != 3 || s.bytes != 3*(spoolHeaderLen+6) {
+		t.Errorf("totals = %d batches, %d bytes; want 3, %d", s.batches, s.bytes, 3*(spoolHeaderLen+6))
+	}
+
+	// entries are the spool time and the raw batch
+	err := db.View(func(tx *bolt.Tx) error {
+		_, v := existingSpoolBucket(tx, "graphite").Cursor().First()
+		want := append(binary.BigEndian.AppendUint64(nil, uint64(now.Unix())), "b 2 2\n"...)
+		if !bytes.Equal(v, want) {
+			t.Errorf("oldest entry = %q, want %q", v, want)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.replay(db, &seqBackend{}, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	if s.batches != 0 || s.bytes != 0 {
+		t.Errorf("totals after replay = %d batches, %d bytes; want 0", s.batches, s.bytes)
+	}
+}
+
+func TestSendFailureKeepsReplayBackoff(t *testing.T) {
+	db := openSpoolTestDB(t, "/tmp/spool_backoff_test.db")
+	defer closeAndRemove(db, "/tmp/spool_backoff_test.db")
+
+	savedDb, savedCfg := dbHandle, Config.CfgSpool
+	defer func() { dbHandle, Config.CfgSpool = savedDb, savedCfg }()
+	dbHandle = db
+	Config.CfgSpool = ConfigSpool{Enabled: true, InitialBackoff: 60, MaxBackoff: 600}
+
+	b := &seqBackend{down: true}
+	nb := namedBackend{Name: "graphite", Format: "graphite", Backend: b, spool: newBackendSpool("graphite")}
+	for i := 0; i < 3; i++ {
+		sendWithSpool(nb, []byte("m 1 100\n"), time.Now().Add(time.Second))
+	}
+	if nb.spool.backoff != 0 || !nb.spool.due(time.Now()) {
+		t.Errorf("replay backoff %s after failed sends, want none", nb.spool.backoff)
+	}
+
+	// the next successful send replays right away
+	b.down = false
+	if err := sendWithSpool(nb, []byte("m 2 110\n"), time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("sendWithSpool: %v", err)
+	}
+	if len(b.got) != 4 {
+		t.Errorf("backend got %d batches, want 4", len(b.got))
+	}
+}
+
+func TestSpoolReplayDropsExpired(t *testing.T) {
+	db := openSpoolTestDB(t, "/tmp/spool_expired_test.db")
+	defer closeAndRemove(db, "/tmp/spool_expired_test.db")
+
+	saved := Config.CfgSpool
+	defer func() { Config.CfgSpool = saved }()
+	Config.CfgSpool = ConfigSpool{Enabled: true}
+
+	s := newBackendSpool("graphite")
+	now := time.Now()
+	if err := s.push(db, []byte("old 1 1\n"), now.Add(-2*time.Minute)); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	if err := s.push(db, []byte("new 2 2\n"), now.Add(-30*time.Second)); err != nil {
+		t.Fatalf("push: %v", err)
+	}
+	// the outage outlived the first batch, no push trimmed it since
+	Config.CfgSpool.MaxAge = 60
+
+	Stat.ProcessStats(packetCache, nameCache)
+	b := &seqBackend{}
+	if err := s.replay(db, b, time.Now().Add(time.Second)); err != nil {
+		t.Fatalf("replay: %v", err)
+	}
+	Stat.ProcessStats(packetCache, nameCache)
+	if len(b.got) != 1 || b.got[0] != "new 2 2\n" {
+		t.Errorf("replayed %q, want only the batch within max-age", b.got)
+	}
+	if Stat.savedStat.BatchesSpoolDropped != 1 {
+		t.Errorf("BatchesSpoolDropped = %d, want 1", Stat.savedStat.BatchesSpoolDropped)
+	}
+	if s.batches != 0 {
+		t.Errorf("spool holds %d batches after replay, want 0", s.batches)
+	}
+}
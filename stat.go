@@ -4,43 +4,83 @@ import (
 	"fmt"
 	"github.com/patrickmn/go-cache"
 	"runtime"
+	"sort"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type internalDaemonStat struct {
-	PointsReceived         int64
-	PointsReceivedRate     float64
-	PointsParseFail        int64
-	PointsSoftParseFail    int64
-	BytesReceived          int64
-	ReadFail               int64
-	BatchesTransmitted     int64
-	BatchesTransmitFail    int64
-	PointsTransmitted      int64
-	OtherErrors            int64
-	PointsReceivedCounter  int64
-	PointsReceivedGauge    int64
-	PointsReceivedSet      int64
-	PointsReceivedTimer    int64
-	PointsReceivedKeyValue int64
-	MemAlloc               uint64
-	MemSys                 uint64
-	MemHeapInuse           uint64
-	QueueLen               int64
-	PacketCacheHit         int64
-	PacketCacheMiss        int64
-	PacketCacheSize        int64
-	NameCacheHit           int64
-	NameCacheMiss          int64
-	NameCacheSize          int64
-	Goroutines             int64
+	PointsReceived             int64
+	PointsReceivedRate         float64
+	PointsParseFail            int64
+	PointsSoftParseFail        int64
+	BytesReceived              int64
+	ReadFail                   int64
+	BatchesTransmitted         int64
+	BatchesTransmitFail        int64
+	BatchesSpooled             int64
+	BatchesReplayed            int64
+	BatchesSpoolDropped        int64
+	PointsTransmitted          int64
+	GraphiteConnects           int64
+	GraphiteConnectFail        int64
+	GraphiteWriteFail          int64
+	GraphiteConnected          int64
+	OpenTSDBConnectFail        int64
+	OpenTSDBAccepted           int64
+	OpenTSDBRejected           int64
+	RewriteDropped             int64
+	RewriteRewritten           int64
+	CardinalityDropped         int64
+	CardinalityOverflowed      int64
+	TimestampRejected          int64
+	OpenTSDBTagless            int64
+	OtherErrors                int64
+	PointsReceivedCounter      int64
+	PointsReceivedGauge        int64
+	PointsReceivedSet          int64
+	PointsReceivedTimer        int64
+	PointsReceivedHistogram    int64
+	PointsReceivedDistribution int64
+	PointsReceivedKeyValue     int64
+	MemAlloc                   uint64
+	MemSys                     uint64
+	MemHeapInuse               uint64
+	QueueLen                   int64
+	PacketCacheHit             int64
+	PacketCacheMiss            int64
+	PacketCacheSize            int64
+	NameCacheHit               int64
+	NameCacheMiss              int64
+	NameCacheSize              int64
+	Goroutines                 int64
+	UDPKernelQueue             int64
+	UDPKernelDrops             int64
+}
+
+// backendDaemonStat - per-backend transmit counters
+type backendDaemonStat struct {
+	BatchesTransmitted  int64
+	BatchesTransmitFail int64
 }
 
 type DaemonStat struct {
 	curStat   internalDaemonStat
 	savedStat internalDaemonStat
 	Interval  int64
+
+	// per-backend counters keyed by backend name; the mutex guards the maps
+	// only, counters themselves are updated atomically
+	backendMu        sync.Mutex
+	curBackendStat   map[string]*backendDaemonStat
+	savedBackendStat map[string]backendDaemonStat
+
+	// udpPort - port of the UDP listener, its sockets' kernel counters are
+	// read from /proc/net/udp; lastUDPDrops - the drop counter at the last
+	// flush (accessed by the flush goroutine only)
+	udpPort      int64
+	lastUDPDrops int64
 }
 
 // atomicMax - lock-free update of *addr to max(*addr, v).
@@ -53,7 +93,7 @@ func atomicMax(addr *int64, v int64) {
 	}
 }
 
-func (ds *DaemonStat) Init(q chan *Packet, t time.Duration, interval int64) {
+func (ds *DaemonStat) Init(q func() int, t time.Duration, interval int64) {
 	// batch send interval
 	ds.Interval = interval
 
@@ -69,8 +109,8 @@ func (ds *DaemonStat) Init(q chan *Packet, t time.Duration, interval int64) {
 // flushed (mx) plus the flush-side state. It must be called from the flush
 // goroutine only, since mx and the flush-side maps are owned there.
 func (ds *DaemonStat) GlobalVarsSizeToString(mx *metrics) string {
-	s := fmt.Sprintf("counters: %d, gauges: %d, lastGaugeValue: %d, timers: %d, countInactivity: %d, sets: %d, keys: %d",
-		len(mx.counters), len(mx.gauges), len(lastGaugeValue), len(mx.timers), len(countInactivity), len(mx.sets), len(mx.keys))
+	s := fmt.Sprintf("counters: %d, gauges: %d, lastGaugeValue: %d, timers: %d, timerSketches: %d, histograms: %d, distributions: %d, countInactivity: %d, sets: %d, keys: %d",
+		len(mx.counters), len(mx.gauges), len(lastGaugeValue), len(mx.timers), len(mx.timerSketches), len(mx.histograms), len(mx.distributions), len(countInactivity), len(mx.sets), len(mx.keys))
 	return s
 }
 
@@ -83,13 +123,34 @@ func (ds *DaemonStat) String(mx *metrics) string {
 	s = s + fmt.Sprintf("ReadFail: %d ops, ", ds.savedStat.ReadFail)
 	s = s + fmt.Sprintf("BatchesTransmitted: %d ops, ", ds.savedStat.BatchesTransmitted)
 	s = s + fmt.Sprintf("BatchesTransmitFail: %d ops, ", ds.savedStat.BatchesTransmitFail)
+	s = s + fmt.Sprintf("BatchesSpooled: %d ops, ", ds.savedStat.BatchesSpooled)
+	s = s + fmt.Sprintf("BatchesReplayed: %d ops, ", ds.savedStat.BatchesReplayed)
+	s = s + fmt.Sprintf("BatchesSpoolDropped: %d ops, ", ds.savedStat.BatchesSpoolDropped)
+	for _, name := range ds.backendNames() {
+		bs := ds.savedBackendStat[name]
+		s = s + fmt.Sprintf("Backend[%s]: BatchesTransmitted: %d ops, BatchesTransmitFail: %d ops, ", name, bs.BatchesTransmitted, bs.BatchesTransmitFail)
+	}
 	s = s + fmt.Sprintf("PointsTransmitted: %d ops, ", ds.savedStat.PointsTransmitted)
+	s = s + fmt.Sprintf("GraphiteConnects: %d ops, ", ds.savedStat.GraphiteConnects)
+	s = s + fmt.Sprintf("GraphiteConnectFail: %d ops, ", ds.savedStat.GraphiteConnectFail)
+	s = s + fmt.Sprintf("GraphiteWriteFail: %d ops, ", ds.savedStat.GraphiteWriteFail)
+	s = s + fmt.Sprintf("GraphiteConnected: %d, ", ds.savedStat.GraphiteConnected)
+	s = s + fmt.Sprintf("OpenTSDBConnectFail: %d ops, ", ds.savedStat.OpenTSDBConnectFail)
+	s = s + fmt.Sprintf("OpenTSDBAccepted: %d points, ", ds.savedStat.OpenTSDBAccepted)
+	s = s + fmt.Sprintf("OpenTSDBRejected: %d points, ", ds.savedStat.OpenTSDBRejected)
+	s = s + fmt.Sprintf("RewriteDropped: %d points, ", ds.savedStat.RewriteDropped)
+	s = s + fmt.Sprintf("RewriteRewritten: %d points, ", ds.savedStat.RewriteRewritten)
+	s = s + fmt.Sprintf("CardinalityDropped: %d points, ", ds.savedStat.CardinalityDropped)
+	s = s + fmt.Sprintf("CardinalityOverflowed: %d points, ", ds.savedStat.CardinalityOverflowed)
+	s = s + fmt.Sprintf("TimestampRejected: %d ops, ", ds.savedStat.TimestampRejected)
+	s = s + fmt.Sprintf("OpenTSDBTagless: %d points, ", ds.savedStat.OpenTSDBTagless)
 	s = s + fmt.Sprintf("OtherErrors: %d errors, ", ds.savedStat.OtherErrors)
 
 	s = s + fmt.Sprintf("MemAlloc: %.0f MB, ", float64(ds.savedStat.MemAlloc)/(1024*1024))
 	s = s + fmt.Sprintf("MemSys: %.0f MB, ", float64(ds.savedStat.MemSys)/(1024*1024))
 	s = s + fmt.Sprintf("MemHeapInuse: %.0f MB, ", float64(ds.savedStat.MemHeapInuse)/(1024*1024))
 	s = s + fmt.Sprintf("QueueLen: %d, ", ds.savedStat.QueueLen)
+	s = s + fmt.Sprintf("UDPKernelQueue: %d bytes, UDPKernelDrops: %d packets, ", ds.savedStat.UDPKernelQueue, ds.savedStat.UDPKernelDrops)
 	s = s + ds.GlobalVarsSizeToString(mx)
 	return s
 }
@@ -130,6 +191,107 @@ func (ds *DaemonStat) BatchesTransmitFailInc() {
 	atomic.AddInt64(&ds.curStat.BatchesTransmitFail, 1)
 }
 
+func (ds *DaemonStat) BatchesSpooledInc() {
+	atomic.AddInt64(&ds.curStat.BatchesSpooled, 1)
+}
+
+func (ds *DaemonStat) BatchesReplayedInc() {
+	atomic.AddInt64(&ds.curStat.BatchesReplayed, 1)
+}
+
+func (ds *DaemonStat) BatchesSpoolDroppedInc() {
+	atomic.AddInt64(&ds.curStat.BatchesSpoolDropped, 1)
+}
+
+func (ds *DaemonStat) GraphiteConnectsInc() {
+	atomic.AddInt64(&ds.curStat.GraphiteConnects, 1)
+}
+
+func (ds *DaemonStat) GraphiteConnectFailInc() {
+	atomic.AddInt64(&ds.curStat.GraphiteConnectFail, 1)
+}
+
+func (ds *DaemonStat) GraphiteWriteFailInc() {
+	atomic.AddInt64(&ds.curStat.GraphiteWriteFail, 1)
+}
+
+func (ds *DaemonStat) OpenTSDBConnectFailInc() {
+	atomic.AddInt64(&ds.curStat.OpenTSDBConnectFail, 1)
+}
+
+// OpenTSDBAcceptedInc - points stored by OpenTSDB
+func (ds *DaemonStat) OpenTSDBAcceptedInc(n int64) {
+	atomic.AddInt64(&ds.curStat.OpenTSDBAccepted, n)
+}
+
+// OpenTSDBRejectedInc - points refused by OpenTSDB
+func (ds *DaemonStat) OpenTSDBRejectedInc(n int64) {
+	atomic.AddInt64(&ds.curStat.OpenTSDBRejected, n)
+}
+
+// RewriteDroppedInc - points dropped by rewrite rules
+func (ds *DaemonStat) RewriteDroppedInc() {
+	atomic.AddInt64(&ds.curStat.RewriteDropped, 1)
+}
+
+// RewriteRewrittenInc - points renamed or retagged by rewrite rules
+func (ds *DaemonStat) RewriteRewrittenInc() {
+	atomic.AddInt64(&ds.curStat.RewriteRewritten, 1)
+}
+
+// CardinalityDroppedInc - points dropped over cardinality limits
+func (ds *DaemonStat) CardinalityDroppedInc() {
+	atomic.AddInt64(&ds.curStat.CardinalityDropped, 1)
+}
+
+// CardinalityOverflowedInc - points folded into __overflow__ over cardinality limits
+func (ds *DaemonStat) CardinalityOverflowedInc() {
+	atomic.AddInt64(&ds.curStat.CardinalityOverflowed, 1)
+}
+
+// SetUDPPort - port of the UDP listener for kernel socket stats
+func (ds *DaemonStat) SetUDPPort(port int) {
+	atomic.StoreInt64(&ds.udpPort, int64(port))
+}
+
+// TimestampRejectedInc - points with a timestamp out of the timestamp-max-skew window
+func (ds *DaemonStat) TimestampRejectedInc() {
+	atomic.AddInt64(&ds.curStat.TimestampRejected, 1)
+}
+
+// OpenTSDBTaglessInc - points without tags not sent to OpenTSDB
+func (ds *DaemonStat) OpenTSDBTaglessInc() {
+	atomic.AddInt64(&ds.curStat.OpenTSDBTagless, 1)
+}
+
+// GraphiteConnectedAdd - tracks the number of open graphite relay connections
+func (ds *DaemonStat) GraphiteConnectedAdd(n int64) {
+	atomic.AddInt64(&ds.curStat.GraphiteConnected, n)
+}
+
+// backendStat returns the current counters for backend name, creating them on first use.
+func (ds *DaemonStat) backendStat(name string) *backendDaemonStat {
+	ds.backendMu.Lock()
+	defer ds.backendMu.Unlock()
+	if ds.curBackendStat == nil {
+		ds.curBackendStat = make(map[string]*backendDaemonStat)
+	}
+	bs, ok := ds.curBackendStat[name]
+	if !ok {
+		bs = &backendDaemonStat{}
+		ds.curBackendStat[name] = bs
+	}
+	return bs
+}
+
+func (ds *DaemonStat) BackendBatchesTransmittedInc(name string) {
+	atomic.AddInt64(&ds.backendStat(name).BatchesTransmitted, 1)
+}
+
+func (ds *DaemonStat) BackendBatchesTransmitFailInc(name string) {
+	atomic.AddInt64(&ds.backendStat(name).BatchesTransmitFail, 1)
+}
+
 func (ds *DaemonStat) PointsTransmittedInc(n int64) {
 	atomic.AddInt64(&ds.curStat.PointsTransmitted, n)
 }
@@ -144,6 +306,10 @@ func (ds *DaemonStat) PointTypeInc(p *Packet) {
 		atomic.AddInt64(&ds.curStat.PointsReceivedSet, 1)
 	case "ms":
 		atomic.AddInt64(&ds.curStat.PointsReceivedTimer, 1)
+	case "h":
+		atomic.AddInt64(&ds.curStat.PointsReceivedHistogram, 1)
+	case "d":
+		atomic.AddInt64(&ds.curStat.PointsReceivedDistribution, 1)
 	case "kv":
 		atomic.AddInt64(&ds.curStat.PointsReceivedKeyValue, 1)
 	}
@@ -235,6 +401,39 @@ func (ds *DaemonStat) WriteMetrics(countersMap map[string]int64, gaugesMap map[s
 	}
 	countersMap[batchesTransmitFail] += ds.savedStat.BatchesTransmitFail
 
+	batchesSpooled := makeBucketName(globalPrefix, metricNamePrefix, "batch.spooled", extraTagsStr, versionTag)
+	_, ok = countersMap[batchesSpooled]
+	if !ok {
+		countersMap[batchesSpooled] = 0
+	}
+	countersMap[batchesSpooled] += ds.savedStat.BatchesSpooled
+
+	batchesReplayed := makeBucketName(globalPrefix, metricNamePrefix, "batch.replayed", extraTagsStr, versionTag)
+	_, ok = countersMap[batchesReplayed]
+	if !ok {
+		countersMap[batchesReplayed] = 0
+	}
+	countersMap[batchesReplayed] += ds.savedStat.BatchesReplayed
+
+	batchesSpoolDropped := makeBucketName(globalPrefix, metricNamePrefix, "batch.spooldropped", extraTagsStr, versionTag)
+	_, ok = countersMap[batchesSpoolDropped]
+	if !ok {
+		countersMap[batchesSpoolDropped] = 0
+	}
+	countersMap[batchesSpoolDropped] += ds.savedStat.BatchesSpoolDropped
+
+	// Per-backend batch counters, tagged with the backend name
+	for _, name := range ds.backendNames() {
+		bs := ds.savedBackendStat[name]
+		backendTag := versionTag + tfCaretTagsDelim + "backend" + tfCaretKVDelim + sanitizeBucket(name)
+
+		backendTransmitted := makeBucketName(globalPrefix, metricNamePrefix, "batch.transmitted", extraTagsStr, backendTag)
+		countersMap[backendTransmitted] += bs.BatchesTransmitted
+
+		backendTransmitFail := makeBucketName(globalPrefix, metricNamePrefix, "batch.transmitfail", extraTagsStr, backendTag)
+		countersMap[backendTransmitFail] += bs.BatchesTransmitFail
+	}
+
 	pointsTransmitted := makeBucketName(globalPrefix, metricNamePrefix, "point.transmitted", extraTagsStr, versionTag)
 	_, ok = countersMap[pointsTransmitted]
 	if !ok {
@@ -242,6 +441,97 @@ func (ds *DaemonStat) WriteMetrics(countersMap map[string]int64, gaugesMap map[s
 	}
 	countersMap[pointsTransmitted] += ds.savedStat.PointsTransmitted
 
+	graphiteConnects := makeBucketName(globalPrefix, metricNamePrefix, "graphite.connect", extraTagsStr, versionTag)
+	_, ok = countersMap[graphiteConnects]
+	if !ok {
+		countersMap[graphiteConnects] = 0
+	}
+	countersMap[graphiteConnects] += ds.savedStat.GraphiteConnects
+
+	graphiteConnectFail := makeBucketName(globalPrefix, metricNamePrefix, "graphite.connectfail", extraTagsStr, versionTag)
+	_, ok = countersMap[graphiteConnectFail]
+	if !ok {
+		countersMap[graphiteConnectFail] = 0
+	}
+	countersMap[graphiteConnectFail] += ds.savedStat.GraphiteConnectFail
+
+	graphiteWriteFail := makeBucketName(globalPrefix, metricNamePrefix, "graphite.writefail", extraTagsStr, versionTag)
+	_, ok = countersMap[graphiteWriteFail]
+	if !ok {
+		countersMap[graphiteWriteFail] = 0
+	}
+	countersMap[graphiteWriteFail] += ds.savedStat.GraphiteWriteFail
+
+	openTSDBConnectFail := makeBucketName(globalPrefix, metricNamePrefix, "opentsdb.connectfail", extraTagsStr, versionTag)
+	_, ok = countersMap[openTSDBConnectFail]
+	if !ok {
+		countersMap[openTSDBConnectFail] = 0
+	}
+	countersMap[openTSDBConnectFail] += ds.savedStat.OpenTSDBConnectFail
+
+	openTSDBAccepted := makeBucketName(globalPrefix, metricNamePrefix, "opentsdb.accepted", extraTagsStr, versionTag)
+	_, ok = countersMap[openTSDBAccepted]
+	if !ok {
+		countersMap[openTSDBAccepted] = 0
+	}
+	countersMap[openTSDBAccepted] += ds.savedStat.OpenTSDBAccepted
+
+	openTSDBRejected := makeBucketName(globalPrefix, metricNamePrefix, "opentsdb.rejected", extraTagsStr, versionTag)
+	_, ok = countersMap[openTSDBRejected]
+	if !ok {
+		countersMap[openTSDBRejected] = 0
+	}
+	countersMap[openTSDBRejected] += ds.savedStat.OpenTSDBRejected
+
+	rewriteDropped := makeBucketName(globalPrefix, metricNamePrefix, "rewrite.dropped", extraTagsStr, versionTag)
+	_, ok = countersMap[rewriteDropped]
+	if !ok {
+		countersMap[rewriteDropped] = 0
+	}
+	countersMap[rewriteDropped] += ds.savedStat.RewriteDropped
+
+	rewriteRewritten := makeBucketName(globalPrefix, metricNamePrefix, "rewrite.rewritten", extraTagsStr, versionTag)
+	_, ok = countersMap[rewriteRewritten]
+	if !ok {
+		countersMap[rewriteRewritten] = 0
+	}
+	countersMap[rewriteRewritten] += ds.savedStat.RewriteRewritten
+
+	cardinalityDropped := makeBucketName(globalPrefix, metricNamePrefix, "cardinality.dropped", extraTagsStr, versionTag)
+	_, ok = countersMap[cardinalityDropped]
+	if !ok {
+		countersMap[cardinalityDropped] = 0
+	}
+	countersMap[cardinalityDropped] += ds.savedStat.CardinalityDropped
+
+	cardinalityOverflowed := makeBucketName(globalPrefix, metricNamePrefix, "cardinality.overflowed", extraTagsStr, versionTag)
+	_, ok = countersMap[cardinalityOverflowed]
+	if !ok {
+		countersMap[cardinalityOverflowed] = 0
+	}
+	countersMap[cardinalityOverflowed] += ds.savedStat.CardinalityOverflowed
+
+	udpKernelDrops := makeBucketName(globalPrefix, metricNamePrefix, "udp.kernel.drops", extraTagsStr, versionTag)
+	_, ok = countersMap[udpKernelDrops]
+	if !ok {
+		countersMap[udpKernelDrops] = 0
+	}
+	countersMap[udpKernelDrops] += ds.savedStat.UDPKernelDrops
+
+	timestampRejected := makeBucketName(globalPrefix, metricNamePrefix, "timestamp.rejected", extraTagsStr, versionTag)
+	_, ok = countersMap[timestampRejected]
+	if !ok {
+		countersMap[timestampRejected] = 0
+	}
+	countersMap[timestampRejected] += ds.savedStat.TimestampRejected
+
+	openTSDBTagless := makeBucketName(globalPrefix, metricNamePrefix, "opentsdb.tagless", extraTagsStr, versionTag)
+	_, ok = countersMap[openTSDBTagless]
+	if !ok {
+		countersMap[openTSDBTagless] = 0
+	}
+	countersMap[openTSDBTagless] += ds.savedStat.OpenTSDBTagless
+
 	otherErrors := makeBucketName(globalPrefix, metricNamePrefix, "error.other", extraTagsStr, versionTag)
 	_, ok = countersMap[otherErrors]
 	if !ok {
@@ -277,6 +567,20 @@ func (ds *DaemonStat) WriteMetrics(countersMap map[string]int64, gaugesMap map[s
 	}
 	countersMap[pointsReceivedTimer] += ds.savedStat.PointsReceivedTimer
 
+	pointsReceivedHistogram := makeBucketName(globalPrefix, metricNamePrefix, "point.received.histogram", extraTagsStr, versionTag)
+	_, ok = countersMap[pointsReceivedHistogram]
+	if !ok {
+		countersMap[pointsReceivedHistogram] = 0
+	}
+	countersMap[pointsReceivedHistogram] += ds.savedStat.PointsReceivedHistogram
+
+	pointsReceivedDistribution := makeBucketName(globalPrefix, metricNamePrefix, "point.received.distribution", extraTagsStr, versionTag)
+	_, ok = countersMap[pointsReceivedDistribution]
+	if !ok {
+		countersMap[pointsReceivedDistribution] = 0
+	}
+	countersMap[pointsReceivedDistribution] += ds.savedStat.PointsReceivedDistribution
+
 	pointsReceivedKeyValue := makeBucketName(globalPrefix, metricNamePrefix, "point.received.keyvalue", extraTagsStr, versionTag)
 	_, ok = countersMap[pointsReceivedKeyValue]
 	if !ok {
@@ -325,9 +629,15 @@ func (ds *DaemonStat) WriteMetrics(countersMap map[string]int64, gaugesMap map[s
 	nameCacheSize := makeBucketName(globalPrefix, metricNamePrefix, "cache.name.size", extraTagsStr, versionTag)
 	gaugesMap[nameCacheSize] = float64(ds.savedStat.NameCacheSize)
 
+	udpKernelQueue := makeBucketName(globalPrefix, metricNamePrefix, "udp.kernel.queue", extraTagsStr, versionTag)
+	gaugesMap[udpKernelQueue] = float64(ds.savedStat.UDPKernelQueue)
+
 	goroutines := makeBucketName(globalPrefix, metricNamePrefix, "goroutines.number", extraTagsStr, versionTag)
 	gaugesMap[goroutines] = float64(ds.savedStat.Goroutines)
 
+	graphiteConnected := makeBucketName(globalPrefix, metricNamePrefix, "graphite.connected", extraTagsStr, versionTag)
+	gaugesMap[graphiteConnected] = float64(ds.savedStat.GraphiteConnected)
+
 	memAlloc := makeBucketName(globalPrefix, metricNamePrefix, "memory.alloc", extraTagsStr, versionTag)
 	gaugesMap[memAlloc] = float64(ds.savedStat.MemAlloc)
 
@@ -342,10 +652,10 @@ func (ds *DaemonStat) WriteMetrics(countersMap map[string]int64, gaugesMap map[s
 }
 
 // QueueStats - incoming queue len monitoring every t time
-func (ds *DaemonStat) QueueStats(c chan *Packet, t time.Duration) {
+func (ds *DaemonStat) QueueStats(queueLen func() int, t time.Duration) {
 
 	for {
-		atomicMax(&ds.curStat.QueueLen, int64(len(c)))
+		atomicMax(&ds.curStat.QueueLen, int64(queueLen()))
 		time.Sleep(t)
 	}
 
@@ -384,12 +694,29 @@ func (ds *DaemonStat) ProcessStats(packetCache, nameCache *cache.Cache) {
 	saved.ReadFail = swapCounter(&cur.ReadFail)
 	saved.BatchesTransmitted = swapCounter(&cur.BatchesTransmitted)
 	saved.BatchesTransmitFail = swapCounter(&cur.BatchesTransmitFail)
+	saved.BatchesSpooled = swapCounter(&cur.BatchesSpooled)
+	saved.BatchesReplayed = swapCounter(&cur.BatchesReplayed)
+	saved.BatchesSpoolDropped = swapCounter(&cur.BatchesSpoolDropped)
 	saved.PointsTransmitted = swapCounter(&cur.PointsTransmitted)
+	saved.GraphiteConnects = swapCounter(&cur.GraphiteConnects)
+	saved.GraphiteConnectFail = swapCounter(&cur.GraphiteConnectFail)
+	saved.GraphiteWriteFail = swapCounter(&cur.GraphiteWriteFail)
+	saved.OpenTSDBConnectFail = swapCounter(&cur.OpenTSDBConnectFail)
+	saved.OpenTSDBAccepted = swapCounter(&cur.OpenTSDBAccepted)
+	saved.OpenTSDBRejected = swapCounter(&cur.OpenTSDBRejected)
+	saved.RewriteDropped = swapCounter(&cur.RewriteDropped)
+	saved.RewriteRewritten = swapCounter(&cur.RewriteRewritten)
+	saved.CardinalityDropped = swapCounter(&cur.CardinalityDropped)
+	saved.CardinalityOverflowed = swapCounter(&cur.CardinalityOverflowed)
+	saved.TimestampRejected = swapCounter(&cur.TimestampRejected)
+	saved.OpenTSDBTagless = swapCounter(&cur.OpenTSDBTagless)
 	saved.OtherErrors = swapCounter(&cur.OtherErrors)
 	saved.PointsReceivedCounter = swapCounter(&cur.PointsReceivedCounter)
 	saved.PointsReceivedGauge = swapCounter(&cur.PointsReceivedGauge)
 	saved.PointsReceivedSet = swapCounter(&cur.PointsReceivedSet)
 	saved.PointsReceivedTimer = swapCounter(&cur.PointsReceivedTimer)
+	saved.PointsReceivedHistogram = swapCounter(&cur.PointsReceivedHistogram)
+	saved.PointsReceivedDistribution = swapCounter(&cur.PointsReceivedDistribution)
 	saved.PointsReceivedKeyValue = swapCounter(&cur.PointsReceivedKeyValue)
 	saved.PacketCacheHit = swapCounter(&cur.PacketCacheHit)
 	saved.PacketCacheMiss = swapCounter(&cur.PacketCacheMiss)
@@ -398,7 +725,18 @@ func (ds *DaemonStat) ProcessStats(packetCache, nameCache *cache.Cache) {
 	saved.QueueLen = swapCounter(&cur.QueueLen)
 	saved.Goroutines = swapCounter(&cur.Goroutines)
 
+	ds.backendMu.Lock()
+	ds.savedBackendStat = make(map[string]backendDaemonStat, len(ds.curBackendStat))
+	for name, bs := range ds.curBackendStat {
+		ds.savedBackendStat[name] = backendDaemonStat{
+			BatchesTransmitted:  swapCounter(&bs.BatchesTransmitted),
+			BatchesTransmitFail: swapCounter(&bs.BatchesTransmitFail),
+		}
+	}
+	ds.backendMu.Unlock()
+
 	// Gauges - sampled here, in this goroutine only.
+	saved.GraphiteConnected = atomic.LoadInt64(&cur.GraphiteConnected)
 	saved.MemAlloc = memStats.Alloc
 	saved.MemSys = memStats.Sys
 	saved.MemHeapInuse = memStats.HeapInuse
@@ -406,6 +744,30 @@ func (ds *DaemonStat) ProcessStats(packetCache, nameCache *cache.Cache) {
 	saved.PacketCacheSize = int64(packetCache.ItemCount())
 	saved.PointsReceivedRate = float64(saved.PointsReceived) / float64(ds.Interval)
 
+	// kernel UDP socket counters, drops are cumulative per socket
+	saved.UDPKernelQueue, saved.UDPKernelDrops = 0, 0
+	if port := atomic.LoadInt64(&ds.udpPort); port > 0 {
+		if queue, drops, ok := udpSocketStats(int(port)); ok {
+			saved.UDPKernelQueue = queue
+			saved.UDPKernelDrops = drops - ds.lastUDPDrops
+			if saved.UDPKernelDrops < 0 {
+				// sockets reopened
+				saved.UDPKernelDrops = drops
+			}
+			ds.lastUDPDrops = drops
+		}
+	}
+
+}
+
+// backendNames - sorted names of backends present in the saved snapshot
+func (ds *DaemonStat) backendNames() []string {
+	names := make([]string, 0, len(ds.savedBackendStat))
+	for name := range ds.savedBackendStat {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 func makeBucketName(globalPrefix string, metricNamePrefix string, metricName string, extraTagsStr string, addTagsStr string) string {
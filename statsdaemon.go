@@ -11,6 +11,7 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"sync"
 	"syscall"
 	"time"
 
@@ -38,8 +39,9 @@ const (
 	configPath      = "/etc/statsdaemon/statsdaemon.yml"
 	statsPrefixName = "statsdaemon"
 
-	defaultGraphiteAddress = "127.0.0.1:2003"
-	defaultOpenTSDBAddress = "127.0.0.1:4242"
+	defaultGraphiteAddress       = "127.0.0.1:2003"
+	defaultGraphitePickleAddress = "127.0.0.1:2004"
+	defaultOpenTSDBAddress       = "127.0.0.1:4242"
 
 	defaultUDPServiceAddress = ":8125"
 	defaultTCPServiceAddress = ""
@@ -51,6 +53,34 @@ const (
 
 	// empty disables the pprof/HTTP debug server
 	defaultPprofAddr = ""
+
+	defaultGraphiteChunkSize           = 64 * 1024
+	defaultGraphiteReconnectBackoff    = 1
+	defaultGraphiteMaxReconnectBackoff = 60
+	defaultGraphitePickleMaxBatchSize  = 500
+
+	defaultOpenTSDBBatchSize           = 50
+	defaultOpenTSDBWorkers             = 4
+	defaultOpenTSDBRetries             = 1
+	defaultOpenTSDBRetryBackoff        = 100
+	defaultOpenTSDBErrorReadTimeout    = 200
+	defaultOpenTSDBReconnectBackoff    = 1
+	defaultOpenTSDBMaxReconnectBackoff = 60
+
+	defaultInfluxDBURL            = "http://127.0.0.1:8086"
+	defaultInfluxDBDatabase       = "statsd"
+	defaultInfluxDBUDPAddress     = "127.0.0.1:8089"
+	defaultInfluxDBUDPPayloadSize = 512
+
+	defaultPrometheusAddress       = ":9102"
+	defaultPrometheusPath          = "/metrics"
+	defaultPrometheusExpireFlushes = 360
+
+	defaultSpoolMaxBatches     = 1000
+	defaultSpoolMaxBytes       = 100 * 1024 * 1024
+	defaultSpoolMaxAge         = 24 * 3600
+	defaultSpoolInitialBackoff = 10
+	defaultSpoolMaxBackoff     = 600
 )
 
 // ConfigFileBackend - file backend config.
@@ -69,34 +99,98 @@ type ConfigDebugMetrics struct {
 	LogFile *os.File `yaml:"-" ignore:"true"`
 }
 
+// ConfigCounterRate - counters written with <bucket>.rate (per second of
+// flush-interval) and optionally <bucket>.count in addition to <bucket>.
+type ConfigCounterRate struct {
+	// Enabled - all counters get rates
+	Enabled bool `yaml:"enabled"`
+	// Prefixes - when not enabled for all counters, only counters whose bucket
+	// starts with one of the prefixes
+	Prefixes []string `yaml:"prefixes"`
+	// Count - also <bucket>.count with the value of <bucket>, eg. for
+	// dashboards of a .rate/.count pair
+	Count bool `yaml:"count"`
+}
+
+// useFor reports whether the counter bucket gets a rate.
+func (c ConfigCounterRate) useFor(bucket string) bool {
+	return c.Enabled || prefixPresent(bucket, c.Prefixes)
+}
+
 // ConfigApp - apppliaction config.
 type ConfigApp struct {
 	CfgFormat         int    `yaml:"cfg-format"`
 	UDPServiceAddress string `yaml:"udp-addr"`
 	TCPServiceAddress string `yaml:"tcp-addr"`
-	MaxUDPPacketSize  int64  `yaml:"max-udp-packet-size"`
-	BackendType       string `yaml:"backend-type"`
-	//Backends          []string          `yaml:"backends"`
-	CfgFileBackend   ConfigFileBackend  `yaml:"file-backend"`
-	PostFlushCmd     string             `yaml:"post-flush-cmd"`
-	GraphiteAddress  string             `yaml:"graphite"`
-	OpenTSDBAddress  string             `yaml:"opentsdb"`
-	FlushInterval    int64              `yaml:"flush-interval"`
-	LogLevel         string             `yaml:"log-level"`
-	DeleteGauges     bool               `yaml:"delete-gauges"`
-	ResetCounters    bool               `yaml:"reset-counters"`
-	PersistCountKeys int64              `yaml:"persist-count-keys"`
-	StatsPrefix      string             `yaml:"stats-prefix"`
-	StoreDb          string             `yaml:"store-db"`
-	Prefix           string             `yaml:"prefix"`
-	ExtraTags        string             `yaml:"extra-tags"`
-	PercentThreshold Percentiles        `yaml:"percent-threshold"`
-	LogName          string             `yaml:"log-name"`
-	LogToSyslog      bool               `yaml:"log-to-syslog"`
-	SyslogUDPAddress string             `yaml:"syslog-udp-address"`
-	DisableStatSend  bool               `yaml:"disable-stat-send"`
-	PprofAddr        string             `yaml:"pprof-addr"`
-	CfgDebugMetrics  ConfigDebugMetrics `yaml:"debug-metrics"`
+	// UnixgramServiceAddress and UnixServiceAddress - paths of unix datagram
+	// and stream sockets, empty - disabled
+	UnixgramServiceAddress string           `yaml:"unixgram-addr"`
+	UnixServiceAddress     string           `yaml:"unix-addr"`
+	CfgUnixSocket          ConfigUnixSocket `yaml:"unix-socket"`
+	// CfgGraphiteInput - carbon compatible listeners
+	CfgGraphiteInput ConfigGraphiteInput `yaml:"graphite-input"`
+	// CfgInfluxInput - InfluxDB line protocol listeners
+	CfgInfluxInput   ConfigInfluxInput `yaml:"influx-input"`
+	MaxUDPPacketSize int64             `yaml:"max-udp-packet-size"`
+	// UDPReaders - goroutines reading UDP packets
+	UDPReaders int `yaml:"udp-readers"`
+	// UDPReusePort - a SO_REUSEPORT socket per reader instead of one shared
+	UDPReusePort bool `yaml:"udp-reuseport"`
+	// UDPReadBuffer - SO_RCVBUF of UDP sockets in bytes, 0 - system default
+	UDPReadBuffer int `yaml:"udp-read-buffer"`
+	// Aggregators - goroutines aggregating packets, buckets are sharded by
+	// hash over them
+	Aggregators int    `yaml:"aggregators"`
+	BackendType string `yaml:"backend-type"`
+	// Backends - list of backend types metrics are sent to simultaneously.
+	// When empty, BackendType is used.
+	Backends                 []string                `yaml:"backends"`
+	CfgFileBackend           ConfigFileBackend       `yaml:"file-backend"`
+	CfgGraphiteBackend       ConfigGraphiteBackend   `yaml:"graphite-backend"`
+	GraphitePickleAddress    string                  `yaml:"graphite-pickle"`
+	CfgGraphitePickleBackend ConfigGraphiteBackend   `yaml:"graphite-pickle-backend"`
+	PostFlushCmd             string                  `yaml:"post-flush-cmd"`
+	GraphiteAddress          string                  `yaml:"graphite"`
+	OpenTSDBAddress          string                  `yaml:"opentsdb"`
+	CfgOpenTSDBBackend       ConfigOpenTSDBBackend   `yaml:"opentsdb-backend"`
+	CfgInfluxDBBackend       ConfigInfluxDBBackend   `yaml:"influxdb-backend"`
+	CfgPrometheusBackend     ConfigPrometheusBackend `yaml:"prometheus-backend"`
+	FlushInterval            int64                   `yaml:"flush-interval"`
+	LogLevel                 string                  `yaml:"log-level"`
+	DeleteGauges             bool                    `yaml:"delete-gauges"`
+	ResetCounters            bool                    `yaml:"reset-counters"`
+	CfgCounterRate           ConfigCounterRate       `yaml:"counter-rate"`
+	PersistCountKeys         int64                   `yaml:"persist-count-keys"`
+	StatsPrefix              string                  `yaml:"stats-prefix"`
+	StoreDb                  string                  `yaml:"store-db"`
+	Prefix                   string                  `yaml:"prefix"`
+	ExtraTags                string                  `yaml:"extra-tags"`
+	PercentThreshold         Percentiles             `yaml:"percent-threshold"`
+	// SketchAccuracy - relative error of percentiles computed from sketches
+	// (distributions and timers in sketch mode)
+	SketchAccuracy float64           `yaml:"sketch-accuracy"`
+	CfgTimerSketch ConfigTimerSketch `yaml:"timer-sketch"`
+	// SetPrecision - HyperLogLog precision of sets (2^precision registers)
+	SetPrecision int `yaml:"set-precision"`
+	// SetExactLimit - sets are counted exactly up to this number of members
+	SetExactLimit int `yaml:"set-exact-limit"`
+	// TimestampMaxSkew - counters and gauges with a client timestamp (|T<unix>)
+	// further than this number of seconds from now are rejected, 0 - no limit
+	TimestampMaxSkew int64 `yaml:"timestamp-max-skew"`
+	// TimerStats - timer statistics written at flush (see validTimerStats)
+	TimerStats []string `yaml:"timer-stats"`
+	// TimerHistograms - bin counts of timers, the first matching prefix is used
+	TimerHistograms []ConfigTimerHistogram `yaml:"timer-histograms"`
+	// RewriteRules - ordered metric name rewrite and drop rules
+	RewriteRules     []ConfigRewriteRule `yaml:"rewrite-rules"`
+	CfgCardinality   ConfigCardinality   `yaml:"cardinality"`
+	LogName          string              `yaml:"log-name"`
+	LogToSyslog      bool                `yaml:"log-to-syslog"`
+	SyslogUDPAddress string              `yaml:"syslog-udp-address"`
+	DisableStatSend  bool                `yaml:"disable-stat-send"`
+	PprofAddr        string              `yaml:"pprof-addr"`
+	CfgDebugMetrics  ConfigDebugMetrics  `yaml:"debug-metrics"`
+	CfgSpool         ConfigSpool         `yaml:"spool"`
 
 	// private - calculated below
 	ExtraTagsHash      map[string]string `yaml:"-"`
@@ -104,6 +198,25 @@ type ConfigApp struct {
 	ParsedPostFlushCmd []string          `yaml:"-"`
 }
 
+// backendNames returns the backend types metrics are sent to: the backends
+// list or, for configs predating it, the single backend-type.
+func (c ConfigApp) backendNames() []string {
+	if len(c.Backends) > 0 {
+		return c.Backends
+	}
+	return []string{c.BackendType}
+}
+
+// usesBackend reports whether name is one of the configured backends.
+func (c ConfigApp) usesBackend(name string) bool {
+	for _, b := range c.backendNames() {
+		if b == name {
+			return true
+		}
+	}
+	return false
+}
+
 // Global vars for command line flags
 var (
 	configFile  *string
@@ -121,21 +234,47 @@ func setConfigDefaults() {
 	Config.CfgFormat = defaultCfgFormat
 	Config.UDPServiceAddress = defaultUDPServiceAddress
 	Config.TCPServiceAddress = defaultTCPServiceAddress
+	Config.UnixgramServiceAddress = ""
+	Config.UnixServiceAddress = ""
+	Config.CfgUnixSocket.Mode = defaultUnixSocketMode
+	Config.CfgInfluxInput.Separator = defaultInfluxInputSeparator
+	Config.CfgInfluxInput.DefaultType = influxInputGauge
 	Config.MaxUDPPacketSize = maxUDPPacket
+	Config.UDPReaders = 1
+	Config.UDPReusePort = false
+	Config.UDPReadBuffer = 0
+	Config.Aggregators = 1
 	Config.BackendType = defaultBackendType
+	Config.Backends = []string{}
 	Config.PostFlushCmd = "stdout"
 	Config.GraphiteAddress = defaultGraphiteAddress
+	Config.GraphitePickleAddress = defaultGraphitePickleAddress
 	Config.OpenTSDBAddress = defaultOpenTSDBAddress
 	Config.FlushInterval = flushInterval
 	Config.LogLevel = "error"
 	Config.DeleteGauges = true
 	Config.ResetCounters = true
+	Config.CfgCounterRate.Enabled = false
+	Config.CfgCounterRate.Prefixes = []string{}
+	Config.CfgCounterRate.Count = false
 	Config.PersistCountKeys = 0
 	Config.StatsPrefix = statsPrefixName
 	Config.StoreDb = dbPath
 	Config.Prefix = ""
 	Config.ExtraTags = ""
 	Config.PercentThreshold = Percentiles{}
+	Config.SketchAccuracy = defaultSketchAccuracy
+	Config.CfgTimerSketch.Enabled = false
+	Config.CfgTimerSketch.Prefixes = []string{}
+	Config.SetPrecision = defaultSetPrecision
+	Config.SetExactLimit = defaultSetExactLimit
+	Config.TimestampMaxSkew = defaultTimestampMaxSkew
+	Config.TimerStats = append([]string{}, defaultTimerStats...)
+	Config.TimerHistograms = []ConfigTimerHistogram{}
+	Config.RewriteRules = []ConfigRewriteRule{}
+	Config.CfgCardinality.Prefixes = []ConfigCardinalityPrefix{}
+	Config.CfgCardinality.TagKeys = []ConfigCardinalityTag{}
+	Config.CfgCardinality.TopOffenders = defaultCardinalityTopOffenders
 	Config.LogName = "stdout"
 	Config.LogToSyslog = true
 	Config.SyslogUDPAddress = ""
@@ -149,6 +288,55 @@ func setConfigDefaults() {
 
 	// File backend config
 	Config.CfgFileBackend.FileName = defaultFileBackendFile
+
+	// Graphite backend config
+	Config.CfgGraphiteBackend.Relays = []string{}
+	Config.CfgGraphiteBackend.Mode = graphiteModeFailover
+	Config.CfgGraphiteBackend.ChunkSize = defaultGraphiteChunkSize
+	Config.CfgGraphiteBackend.ReconnectBackoff = defaultGraphiteReconnectBackoff
+	Config.CfgGraphiteBackend.MaxReconnectBackoff = defaultGraphiteMaxReconnectBackoff
+	Config.CfgGraphiteBackend.TagFormat = graphiteTagFormatPath
+
+	// Graphite pickle backend config
+	Config.CfgGraphitePickleBackend.Relays = []string{}
+	Config.CfgGraphitePickleBackend.Mode = graphiteModeFailover
+	Config.CfgGraphitePickleBackend.ChunkSize = defaultGraphiteChunkSize
+	Config.CfgGraphitePickleBackend.ReconnectBackoff = defaultGraphiteReconnectBackoff
+	Config.CfgGraphitePickleBackend.MaxReconnectBackoff = defaultGraphiteMaxReconnectBackoff
+	Config.CfgGraphitePickleBackend.MaxBatchSize = defaultGraphitePickleMaxBatchSize
+	Config.CfgGraphitePickleBackend.TagFormat = graphiteTagFormatPath
+
+	// OpenTSDB backend config
+	Config.CfgOpenTSDBBackend.Transport = opentsdbTransportHTTP
+	Config.CfgOpenTSDBBackend.BatchSize = defaultOpenTSDBBatchSize
+	Config.CfgOpenTSDBBackend.Workers = defaultOpenTSDBWorkers
+	Config.CfgOpenTSDBBackend.Gzip = true
+	Config.CfgOpenTSDBBackend.Retries = defaultOpenTSDBRetries
+	Config.CfgOpenTSDBBackend.RetryBackoff = defaultOpenTSDBRetryBackoff
+	Config.CfgOpenTSDBBackend.ErrorReadTimeout = defaultOpenTSDBErrorReadTimeout
+	Config.CfgOpenTSDBBackend.ReconnectBackoff = defaultOpenTSDBReconnectBackoff
+	Config.CfgOpenTSDBBackend.MaxReconnectBackoff = defaultOpenTSDBMaxReconnectBackoff
+
+	// InfluxDB backend config
+	Config.CfgInfluxDBBackend.Transport = influxTransportHTTP
+	Config.CfgInfluxDBBackend.URL = defaultInfluxDBURL
+	Config.CfgInfluxDBBackend.Database = defaultInfluxDBDatabase
+	Config.CfgInfluxDBBackend.Gzip = true
+	Config.CfgInfluxDBBackend.UDPAddress = defaultInfluxDBUDPAddress
+	Config.CfgInfluxDBBackend.UDPPayloadSize = defaultInfluxDBUDPPayloadSize
+
+	// Prometheus backend config
+	Config.CfgPrometheusBackend.Address = defaultPrometheusAddress
+	Config.CfgPrometheusBackend.Path = defaultPrometheusPath
+	Config.CfgPrometheusBackend.ExpireFlushes = defaultPrometheusExpireFlushes
+
+	// Retry spool
+	Config.CfgSpool.Enabled = false
+	Config.CfgSpool.MaxBatches = defaultSpoolMaxBatches
+	Config.CfgSpool.MaxBytes = defaultSpoolMaxBytes
+	Config.CfgSpool.MaxAge = defaultSpoolMaxAge
+	Config.CfgSpool.InitialBackoff = defaultSpoolInitialBackoff
+	Config.CfgSpool.MaxBackoff = defaultSpoolMaxBackoff
 }
 
 // registerFlags wires command-line flags to the package-level flag vars.
@@ -204,13 +392,17 @@ var (
 	In = make(chan *Packet, maxUnprocessedPackets)
 
 	// current holds the accumulation maps for the in-progress flush interval.
-	// It is owned by the monitor goroutine and swapped at each flush.
+	// It is owned by the monitor goroutine and swapped at each flush. With
+	// more than one aggregator the shards hold their own (see aggregatorPool).
 	current = newMetrics()
 
 	// Persistent flush-side state, touched only by the flush path.
 	lastGaugeValue  = make(map[string]float64)
 	countInactivity = make(map[string]int64)
 
+	// flushBackends are instantiated once at start-up and used by every flush.
+	flushBackends []namedBackend
+
 	dbHandle *bolt.DB
 	logFile  io.Writer
 )
@@ -258,6 +450,11 @@ func main() {
 		os.Exit(0)
 	}
 
+	if flushBackends, err = selectBackends(Config); err != nil {
+		fmt.Printf("%s. Exiting...\n", err)
+		os.Exit(1)
+	}
+
 	log.SetLevel(Config.InternalLogLevel)
 
 	if Config.LogName == "stdout" {
@@ -306,8 +503,20 @@ func main() {
 		}()
 	}
 
+	// pulled backends serve their own endpoint
+	for _, nb := range flushBackends {
+		if pb, ok := nb.Backend.(*prometheusBackend); ok {
+			go pb.serve()
+		}
+	}
+
+	if Config.Aggregators > 1 {
+		shards = newAggregatorPool(Config.Aggregators)
+		shards.start()
+	}
+
 	// Stat
-	Stat.Init(In, 200*time.Millisecond, Config.FlushInterval)
+	Stat.Init(queueLen, 200*time.Millisecond, Config.FlushInterval)
 
 	signalchan = make(chan os.Signal, 1)
 	signal.Notify(signalchan, syscall.SIGTERM, syscall.SIGQUIT, syscall.SIGINT)
@@ -327,28 +536,115 @@ func main() {
 	if Config.TCPServiceAddress != "" {
 		go tcpListener()
 	}
+	if Config.UnixgramServiceAddress != "" {
+		go unixgramListener()
+	}
+	if Config.UnixServiceAddress != "" {
+		go unixListener()
+	}
+	if Config.CfgGraphiteInput.Addr != "" {
+		go graphiteInputListener()
+	}
+	if Config.CfgGraphiteInput.PickleAddr != "" {
+		go graphitePickleListener()
+	}
+	if Config.CfgInfluxInput.UDPAddr != "" {
+		go influxInputUDPListener()
+	}
+	if Config.CfgInfluxInput.HTTPAddr != "" {
+		go influxInputHTTPListener()
+	}
 	monitor()
 }
 
 func validateConfig() error {
 	// FIXME  check all params/flags
 	doNotCheckBackend := *printConfig || *showVersion
-	if Config.BackendType == "" && !doNotCheckBackend {
+	if Config.BackendType == "" && len(Config.Backends) == 0 && !doNotCheckBackend {
 		return fmt.Errorf("Parameter error: backend-type can't be empty")
 	}
-	if Config.BackendType != "external" && Config.BackendType != "graphite" && Config.BackendType != "opentsdb" && Config.BackendType != "file" && Config.BackendType != "dummy" && !doNotCheckBackend {
-		return fmt.Errorf("Parameter error: Invalid backend-type: %s", Config.BackendType)
+	seen := make(map[string]bool)
+	for _, name := range Config.backendNames() {
+		if !validBackend(name) && !doNotCheckBackend {
+			return fmt.Errorf("Parameter error: Invalid backend-type: %s", name)
+		}
+		if seen[name] {
+			return fmt.Errorf("Parameter error: Duplicate backend: %s", name)
+		}
+		seen[name] = true
 	}
 
-	if (Config.GraphiteAddress == "-" || Config.GraphiteAddress == "") && Config.BackendType == "graphite" {
+	if (Config.GraphiteAddress == "-" || Config.GraphiteAddress == "") && len(Config.CfgGraphiteBackend.Relays) == 0 && Config.usesBackend("graphite") {
 		return fmt.Errorf("Parameter error: Graphite backend selected and no graphite server address")
 	}
 
-	if (Config.OpenTSDBAddress == "-" || Config.OpenTSDBAddress == "") && Config.BackendType == "opentsdb" {
+	if (Config.GraphitePickleAddress == "-" || Config.GraphitePickleAddress == "") && len(Config.CfgGraphitePickleBackend.Relays) == 0 && Config.usesBackend("graphite-pickle") {
+		return fmt.Errorf("Parameter error: Graphite pickle backend selected and no graphite-pickle server address")
+	}
+
+	graphiteCfgs := map[string]ConfigGraphiteBackend{"graphite": Config.CfgGraphiteBackend, "graphite-pickle": Config.CfgGraphitePickleBackend}
+	for name, gcfg := range graphiteCfgs {
+		if !Config.usesBackend(name) {
+			continue
+		}
+		if gcfg.Mode != graphiteModeFailover && gcfg.Mode != graphiteModeHash {
+			return fmt.Errorf("Parameter error: Invalid %s-backend mode: %s", name, gcfg.Mode)
+		}
+		if gcfg.ReconnectBackoff < 0 || gcfg.MaxReconnectBackoff < 0 {
+			return fmt.Errorf("Parameter error: Graphite reconnect backoff can't be negative")
+		}
+		if gcfg.TagFormat != graphiteTagFormatPath && gcfg.TagFormat != graphiteTagFormatNative {
+			return fmt.Errorf("Parameter error: Invalid %s-backend tag-format: %s", name, gcfg.TagFormat)
+		}
+	}
+
+	if (Config.OpenTSDBAddress == "-" || Config.OpenTSDBAddress == "") && Config.usesBackend("opentsdb") {
 		return fmt.Errorf("Parameter error: OpenTSDB backend selected and no OpenTSDB server address")
 	}
 
-	if Config.BackendType == "file" {
+	if Config.usesBackend("opentsdb") {
+		ocfg := Config.CfgOpenTSDBBackend
+		if ocfg.Transport != opentsdbTransportHTTP && ocfg.Transport != opentsdbTransportTelnet {
+			return fmt.Errorf("Parameter error: Invalid opentsdb-backend transport: %s", ocfg.Transport)
+		}
+		if ocfg.ErrorReadTimeout < 0 || ocfg.ReconnectBackoff < 0 || ocfg.MaxReconnectBackoff < 0 {
+			return fmt.Errorf("Parameter error: OpenTSDB timeouts and backoff can't be negative")
+		}
+		if ocfg.BatchSize <= 0 || ocfg.Workers <= 0 || ocfg.Retries < 0 || ocfg.RetryBackoff < 0 {
+			return fmt.Errorf("Parameter error: OpenTSDB batch-size and workers must be positive, retries and retry-backoff not negative")
+		}
+	}
+
+	if Config.usesBackend("influxdb") {
+		icfg := Config.CfgInfluxDBBackend
+		switch icfg.Transport {
+		case influxTransportHTTP:
+			if icfg.URL == "" || icfg.Database == "" {
+				return fmt.Errorf("Parameter error: InfluxDB backend selected and no url or database")
+			}
+		case influxTransportUDP:
+			if icfg.UDPAddress == "" {
+				return fmt.Errorf("Parameter error: InfluxDB UDP backend selected and no udp-address")
+			}
+			if icfg.UDPPayloadSize <= 0 {
+				return fmt.Errorf("Parameter error: InfluxDB udp-payload-size must be positive")
+			}
+		default:
+			return fmt.Errorf("Parameter error: Invalid influxdb-backend transport: %s", icfg.Transport)
+		}
+	}
+
+	if Config.usesBackend("prometheus") {
+		pcfg := Config.CfgPrometheusBackend
+		if pcfg.Address == "" || !strings.HasPrefix(pcfg.Path, "/") {
+			return fmt.Errorf("Parameter error: Prometheus backend selected and no address or path")
+		}
+		if pcfg.ExpireFlushes < 0 {
+			return fmt.Errorf("Parameter error: prometheus-backend expire-flushes must not be negative")
+		}
+	}
+
+	if Config.usesBackend("file") {
 		if len(Config.CfgFileBackend.FileName) == 0 {
 			return fmt.Errorf("Parameter error: File backend selected and no output FileName")
 		}
@@ -359,6 +655,67 @@ func validateConfig() error {
 		Config.CfgFileBackend.LogFile = f
 	}
 
+	if Config.CfgSpool.Enabled {
+		sp := Config.CfgSpool
+		if sp.MaxBatches < 0 || sp.MaxBytes < 0 || sp.MaxAge < 0 || sp.InitialBackoff < 0 || sp.MaxBackoff < 0 {
+			return fmt.Errorf("Parameter error: Spool limits and backoff can't be negative")
+		}
+	}
+
+	if Config.SketchAccuracy <= 0 || Config.SketchAccuracy >= 1 {
+		return fmt.Errorf("Parameter error: sketch-accuracy must be between 0 and 1")
+	}
+
+	if Config.SetPrecision < minSetPrecision || Config.SetPrecision > maxSetPrecision {
+		return fmt.Errorf("Parameter error: set-precision must be between %d and %d", minSetPrecision, maxSetPrecision)
+	}
+	if Config.SetExactLimit < 0 {
+		return fmt.Errorf("Parameter error: set-exact-limit can't be negative")
+	}
+	if Config.TimestampMaxSkew < 0 {
+		return fmt.Errorf("Parameter error: timestamp-max-skew can't be negative")
+	}
+
+	for _, name := range Config.TimerStats {
+		if !validTimerStat(name) {
+			return fmt.Errorf("Parameter error: Invalid timer-stats entry %q. Valid are: %s", name, strings.Join(validTimerStats, ", "))
+		}
+	}
+
+	if err := validateTimerHistograms(Config.TimerHistograms); err != nil {
+		return err
+	}
+
+	if err := compileRewriteRules(Config.RewriteRules); err != nil {
+		return err
+	}
+
+	if err := validateCardinality(Config.CfgCardinality); err != nil {
+		return err
+	}
+	if err := validateInfluxInput(Config.CfgInfluxInput); err != nil {
+		return err
+	}
+
+	if Config.UDPReaders < 1 {
+		return fmt.Errorf("Parameter error: udp-readers must be at least 1")
+	}
+	if Config.UDPReadBuffer < 0 {
+		return fmt.Errorf("Parameter error: udp-read-buffer can't be negative")
+	}
+	if Config.Aggregators < 1 {
+		return fmt.Errorf("Parameter error: aggregators must be at least 1")
+	}
+
+	if Config.UnixgramServiceAddress != "" || Config.UnixServiceAddress != "" {
+		if Config.UnixgramServiceAddress == Config.UnixServiceAddress {
+			return fmt.Errorf("Parameter error: unixgram-addr and unix-addr must be different paths")
+		}
+		if _, _, _, err := Config.CfgUnixSocket.parse(); err != nil {
+			return fmt.Errorf("Parameter error: unix-socket: %s", err)
+		}
+	}
+
 	if Config.CfgDebugMetrics.Enabled == true {
 		if len(Config.CfgDebugMetrics.FileName) == 0 {
 			return fmt.Errorf("Parameter error: Debug matrics enabled and no output FileName")
@@ -378,26 +735,26 @@ func udpListener() {
 		"in": "udpListener",
 	})
 
-	address, err := net.ResolveUDPAddr("udp", Config.UDPServiceAddress)
-	if err != nil {
-		fmt.Printf("Error in ResolveUDPAddr: %v\n", err)
-		logCtx.Fatalf("%s", err)
-	}
-	logCtx.Infof("Listening on %s", address)
-
-	listener, err := net.ListenUDP("udp", address)
+	conns, err := listenUDP(Config.UDPServiceAddress, Config.UDPReaders, Config.UDPReusePort, Config.UDPReadBuffer)
 	if err != nil {
 		fmt.Printf("Error in ListenUDP: %v\n", err)
 		logCtx.WithField("after", "ListenUDP").Fatalf("%s", err)
 	}
-	// err = listener.SetReadBuffer(1024 * 1024 * 50)
-	// if err != nil {
-	//
-	// 	logCtx.WithField("after", "SetReadBuffer").Fatalf("%s", err)
-	// }
-	//
-
-	parseTo(listener, false, In)
+	address := conns[0].LocalAddr().(*net.UDPAddr)
+	logCtx.Infof("Listening on %s with %d readers on %d sockets", address, max(Config.UDPReaders, 1), len(conns))
+	Stat.SetUDPPort(address.Port)
+
+	// readers share the socket unless each has its own SO_REUSEPORT one
+	readers := max(Config.UDPReaders, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < readers; i++ {
+		wg.Add(1)
+		go func(conn *net.UDPConn) {
+			defer wg.Done()
+			parseWith(conn, false, deliverPacket)
+		}(conns[i%len(conns)])
+	}
+	wg.Wait()
 }
 
 func tcpListener() {
@@ -423,7 +780,7 @@ func tcpListener() {
 			fmt.Printf("Error in AcceptTCP: %v\n", err)
 			logCtx.Fatalf("%s", err)
 		}
-		go parseTo(conn, true, In)
+		go parseWith(conn, true, deliverPacket)
 	}
 }
 
@@ -472,16 +829,33 @@ func monitor() {
 			logCtx.Infof("Caught signal \"%v\"... shutting down", sig)
 			// Hand off the final interval, then drain the worker so we do not
 			// lose buffered snapshots or run a flush concurrently with one.
-			flushJobs <- flushJob{m: current, deadline: time.Now().Add(period)}
-			current = newMetrics()
+			flushJobs <- flushJob{m: swapMetrics(), deadline: time.Now().Add(period)}
 			close(flushJobs)
 			<-done
 			return
 		case <-ticker.C:
-			flushJobs <- flushJob{m: current, deadline: time.Now().Add(period)}
-			current = newMetrics()
+			flushJobs <- flushJob{m: swapMetrics(), deadline: time.Now().Add(period)}
 		case s := <-In:
 			current.handlePacket(s)
 		}
 	}
 }
+
+// swapMetrics returns the metrics of the ending interval, merged from the
+// aggregator shards when there are more than one, and starts a new interval.
+func swapMetrics() *metrics {
+	if shards != nil {
+		return shards.flush()
+	}
+	mx := current
+	current = newMetrics()
+	return mx
+}
+
+// queueLen - packets waiting for aggregation
+func queueLen() int {
+	if shards != nil {
+		return shards.queueLen()
+	}
+	return len(In)
+}
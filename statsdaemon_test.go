@@ -5,6 +5,8 @@ import (
 	"math"
 	"net"
 	"os"
+	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -328,6 +330,29 @@ func TestParseLineTimer(t *testing.T) {
 	assert.Equal(t, float32(0.1), packet.Sampling)
 }
 
+func TestParseLineHistogramDistribution(t *testing.T) {
+	d := []byte("req.size:512|h|@0.5")
+	packet := parseLine(d)
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "req.size", packet.Bucket)
+	assert.Equal(t, float64(512), packet.Value.(float64))
+	assert.Equal(t, "h", packet.Modifier)
+	assert.Equal(t, float32(0.5), packet.Sampling)
+
+	d = []byte("req.time:1.5|d|#env:prod")
+	packet = parseLine(d)
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "req.time.^env=prod", packet.Bucket)
+	assert.Equal(t, float64(1.5), packet.Value.(float64))
+	assert.Equal(t, "d", packet.Modifier)
+
+	d = []byte("req.time:abc|d")
+	packet = parseLine(d)
+	if packet != nil {
+		t.Fail()
+	}
+}
+
 func TestParseLineSet(t *testing.T) {
 	d := []byte("uniques:765|s")
 	packet := parseLine(d)
@@ -555,6 +580,35 @@ func TestParseLineTags(t *testing.T) {
 
 }
 
+func TestParseLineDogStatsDTags(t *testing.T) {
+	d := []byte("dog.calls:1|c|@0.5|#env:prod,host:a")
+	packet := parseLine(d)
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "dog.calls.^env=prod.^host=a", packet.Bucket)
+	assert.Equal(t, int64(1), packet.Value.(int64))
+	assert.Equal(t, float32(0.5), packet.Sampling)
+
+	// tag without value, sampling after tags
+	d = []byte("dog.time:320|ms|#canary|@0.1")
+	packet = parseLine(d)
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "dog.time.^canary=true", packet.Bucket)
+	assert.Equal(t, float64(320), packet.Value.(float64))
+	assert.Equal(t, float32(0.1), packet.Sampling)
+
+	// caret tags win over DogStatsD tags
+	d = []byte("dog.load.^host=b:2|g|#host:a,env:dev")
+	packet = parseLine(d)
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "dog.load.^env=dev.^host=b", packet.Bucket)
+
+	// the same name with other tags is a different bucket, not a cache hit
+	d = []byte("dog.load.^host=b:2|g|#env:prod")
+	packet = parseLine(d)
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "dog.load.^env=prod.^host=b", packet.Bucket)
+}
+
 func TestMultiLine(t *testing.T) {
 	b := bytes.NewBuffer([]byte("a.key.with-0.dash:4|c\ngauge:3|g"))
 	parser := NewParser(b, true)
@@ -576,6 +630,67 @@ func TestMultiLine(t *testing.T) {
 	assert.Equal(t, float32(1), packet.Sampling)
 }
 
+func TestParsePacketsMultiValue(t *testing.T) {
+	packets := parsePackets([]byte("glork:10:20:30|ms|@0.5"))
+	assert.Equal(t, len(packets), 3)
+	for i, v := range []float64{10, 20, 30} {
+		assert.Equal(t, "glork", packets[i].Bucket)
+		assert.Equal(t, v, packets[i].Value.(float64))
+		assert.Equal(t, "ms", packets[i].Modifier)
+		assert.Equal(t, float32(0.5), packets[i].Sampling)
+	}
+
+	packets = parsePackets([]byte("gaugor:5:+2:-1|g"))
+	assert.Equal(t, len(packets), 3)
+	assert.Equal(t, GaugeData{false, false, 5}, packets[0].Value)
+	assert.Equal(t, GaugeData{true, false, 2}, packets[1].Value)
+	assert.Equal(t, GaugeData{true, true, 1}, packets[2].Value)
+
+	// sets and key/values keep colons in the value
+	packets = parsePackets([]byte("uniques:a:b|s"))
+	assert.Equal(t, len(packets), 1)
+	assert.Equal(t, "a:b", packets[0].Value.(string))
+
+	// one bad value fails the line
+	assert.Equal(t, len(parsePackets([]byte("gorets:1:x|c"))), 0)
+	assert.Equal(t, len(parsePackets([]byte("gorets:1::2|c"))), 0)
+	assert.Equal(t, len(parsePackets([]byte("gorets:1:|c"))), 0)
+}
+
+func TestPacketCacheMultiValue(t *testing.T) {
+	d := []byte("multi.cached:1:1|c")
+	for i := 0; i < 2; i++ {
+		packets := parsePackets(d)
+		assert.Equal(t, len(packets), 2)
+		assert.Equal(t, int64(1), packets[1].Value.(int64))
+	}
+	_, found := packetCache.Get(string(d))
+	assert.Equal(t, found, false)
+}
+
+func TestMultiLineMultiValue(t *testing.T) {
+	parser := NewParser(bytes.NewBuffer([]byte("glork:1:2|ms\ngorets:3|c\nglork:4:5|ms")), true)
+
+	want := []struct {
+		bucket string
+		value  any
+		more   bool
+	}{
+		{"glork", float64(1), true},
+		{"glork", float64(2), true},
+		{"gorets", int64(3), true},
+		{"glork", float64(4), true},
+		{"glork", float64(5), false},
+	}
+	for _, w := range want {
+		packet, more := parser.Next()
+		assert.NotEqual(t, packet, nil)
+		assert.Equal(t, w.bucket, packet.Bucket)
+		assert.Equal(t, w.value, packet.Value)
+		assert.Equal(t, w.more, more)
+	}
+}
+
 func TestPacketHandlerReceiveCounter(t *testing.T) {
 
 	Stat.curStat.PointsReceived = 0
@@ -676,7 +791,8 @@ func TestPacketHandlerTimer(t *testing.T) {
 }
 
 func TestPacketHandlerSet(t *testing.T) {
-	current.sets = make(map[string][]string)
+	Config.SetExactLimit = 1000
+	current.sets = make(map[string]*setCounter)
 
 	p := &Packet{
 		Bucket:   "uniques",
@@ -685,13 +801,12 @@ func TestPacketHandlerSet(t *testing.T) {
 		Sampling: float32(1),
 	}
 	current.handlePacket(p)
-	assert.Equal(t, len(current.sets["uniques"]), 1)
-	assert.Equal(t, current.sets["uniques"][0], "765")
+	assert.Equal(t, current.sets["uniques"].Count(), uint64(1))
 
 	p.Value = "567"
 	current.handlePacket(p)
-	assert.Equal(t, len(current.sets["uniques"]), 2)
-	assert.Equal(t, current.sets["uniques"][1], "567")
+	current.handlePacket(p)
+	assert.Equal(t, current.sets["uniques"].Count(), uint64(2))
 }
 
 func TestProcessCounters(t *testing.T) {
@@ -714,13 +829,13 @@ func TestProcessCounters(t *testing.T) {
 
 	defer closeAndRemove(dbHandle, Config.StoreDb)
 
-	num := current.processCounters(&buffer, now, true, "external", dbHandle)
+	num := current.processCounters(textWriter{&buffer, "external"}, now, true, dbHandle)
 	assert.Equal(t, num, int64(1))
 	assert.Equal(t, buffer.String(), "gorets 123 1418052649\n")
 
 	// run current.processCounters() enough times to make sure it purges items
 	for i := 0; i < int(Config.PersistCountKeys)+10; i++ {
-		num = current.processCounters(&buffer, now, true, "external", dbHandle)
+		num = current.processCounters(textWriter{&buffer, "external"}, now, true, dbHandle)
 	}
 	lines := bytes.Split(buffer.Bytes(), []byte("\n"))
 
@@ -730,6 +845,59 @@ func TestProcessCounters(t *testing.T) {
 	assert.Equal(t, string(lines[Config.PersistCountKeys]), "gorets 0 1418052649")
 }
 
+func TestProcessCountersRate(t *testing.T) {
+	Config.PersistCountKeys = 1
+	Config.FlushInterval = 10
+	Config.CfgCounterRate = ConfigCounterRate{Prefixes: []string{"api."}, Count: true}
+	defer func() { Config.CfgCounterRate = ConfigCounterRate{} }()
+	countInactivity = make(map[string]int64)
+
+	Config.StoreDb = "/tmp/stats_rate_test.db"
+	removeFile(Config.StoreDb)
+	db, err := bolt.Open(Config.StoreDb, 0644, &bolt.Options{Timeout: 1 * time.Second})
+	assert.Equal(t, nil, err)
+	defer closeAndRemove(db, Config.StoreDb)
+
+	tests := []struct {
+		reset bool
+		want  []string
+	}{
+		{true, []string{
+			"api.calls 123 1418052649 host=h1\napi.calls.rate 12.300000 1418052649 host=h1\napi.calls.count 123 1418052649 host=h1\nother 5 1418052649\n",
+			"api.calls 20 1418052649 host=h1\napi.calls.rate 2.000000 1418052649 host=h1\napi.calls.count 20 1418052649 host=h1\nother 0 1418052649\n",
+			"api.calls 0 1418052649 host=h1\napi.calls.rate 0.000000 1418052649 host=h1\napi.calls.count 0 1418052649 host=h1\n",
+		}},
+		// the running total is the count, the rate stays per interval
+		{false, []string{
+			"api.calls 123 1418052649 host=h1\napi.calls.rate 12.300000 1418052649 host=h1\napi.calls.count 123 1418052649 host=h1\nother 5 1418052649\n",
+			"api.calls 143 1418052649 host=h1\napi.calls.rate 2.000000 1418052649 host=h1\napi.calls.count 143 1418052649 host=h1\nother 5 1418052649\n",
+			"api.calls 143 1418052649 host=h1\napi.calls.rate 0.000000 1418052649 host=h1\napi.calls.count 143 1418052649 host=h1\n",
+		}},
+	}
+	for _, tt := range tests {
+		mx := newMetrics()
+		for i, want := range tt.want {
+			switch i {
+			case 0:
+				mx.counters["api.calls.^host=h1"] = 123
+				mx.counters["other"] = 5
+			case 1:
+				mx.counters["api.calls.^host=h1"] = 20
+			}
+			var buffer bytes.Buffer
+			num := mx.processCounters(textWriter{&buffer, "external"}, 1418052649, tt.reset, db)
+			lines := splitNonEmpty(buffer.String())
+			// every point is counted
+			assert.Equal(t, int64(len(lines)), num)
+			sort.Strings(lines)
+			wantLines := splitNonEmpty(want)
+			sort.Strings(wantLines)
+			assert.Equal(t, wantLines, lines, tt.reset, i)
+		}
+		countInactivity = make(map[string]int64)
+	}
+}
+
 func TestProcessTimers(t *testing.T) {
 	// Some data with expected mean of 20
 	current.timers = make(map[string]Float64Slice)
@@ -738,7 +906,7 @@ func TestProcessTimers(t *testing.T) {
 	now := int64(1418052649)
 
 	var buffer bytes.Buffer
-	num := current.processTimers(&buffer, now, Percentiles{}, "external")
+	num := current.processTimers(textWriter{&buffer, "external"}, now, Percentiles{})
 
 	lines := bytes.Split(buffer.Bytes(), []byte("\n"))
 
@@ -748,7 +916,7 @@ func TestProcessTimers(t *testing.T) {
 	assert.Equal(t, string(lines[2]), "response_time.lower 0.000000 1418052649")
 	assert.Equal(t, string(lines[3]), "response_time.count 3 1418052649")
 
-	num = current.processTimers(&buffer, now, Percentiles{}, "external")
+	num = current.processTimers(textWriter{&buffer, "external"}, now, Percentiles{})
 	assert.Equal(t, num, int64(0))
 }
 
@@ -763,16 +931,16 @@ func TestProcessGauges(t *testing.T) {
 
 	var buffer bytes.Buffer
 
-	num := current.processGauges(&buffer, now, "external")
+	num := current.processGauges(textWriter{&buffer, "external"}, now)
 	assert.Equal(t, num, int64(0))
 	assert.Equal(t, buffer.String(), "")
 
 	current.gauges["gaugor"] = 12345
-	num = current.processGauges(&buffer, now, "external")
+	num = current.processGauges(textWriter{&buffer, "external"}, now)
 	assert.Equal(t, num, int64(1))
 
 	current.gauges["gaugor"] = math.MaxUint64
-	num = current.processGauges(&buffer, now, "external")
+	num = current.processGauges(textWriter{&buffer, "external"}, now)
 	assert.Equal(t, buffer.String(), "gaugor 12345.000000 1418052649\ngaugor 12345.000000 1418052649\n")
 	assert.Equal(t, num, int64(1))
 }
@@ -787,42 +955,49 @@ func TestProcessDeleteGauges(t *testing.T) {
 
 	var buffer bytes.Buffer
 
-	num := current.processGauges(&buffer, now, "external")
+	num := current.processGauges(textWriter{&buffer, "external"}, now)
 	assert.Equal(t, num, int64(0))
 	assert.Equal(t, buffer.String(), "")
 
 	current.gauges["gaugordelete"] = 12345
-	num = current.processGauges(&buffer, now, "external")
+	num = current.processGauges(textWriter{&buffer, "external"}, now)
 	assert.Equal(t, num, int64(1))
 
 	current.gauges["gaugordelete"] = math.MaxUint64
-	num = current.processGauges(&buffer, now, "external")
+	num = current.processGauges(textWriter{&buffer, "external"}, now)
 	assert.Equal(t, buffer.String(), "gaugordelete 12345.000000 1418052649\n")
 	assert.Equal(t, num, int64(0))
 }
 
 func TestProcessSets(t *testing.T) {
-	current.sets = make(map[string][]string)
+	current.sets = make(map[string]*setCounter)
+	addSet := func(bucket string, members ...string) {
+		set := newSetCounter(defaultSetPrecision, defaultSetExactLimit)
+		for _, m := range members {
+			set.Add(m)
+		}
+		current.sets[bucket] = set
+	}
 
 	now := int64(1418052649)
 
 	var buffer bytes.Buffer
 
 	// three unique values
-	current.sets["uniques"] = []string{"123", "234", "345"}
-	num := current.processSets(&buffer, now, "external")
+	addSet("uniques", "123", "234", "345")
+	num := current.processSets(textWriter{&buffer, "external"}, now)
 	assert.Equal(t, num, int64(1))
 	assert.Equal(t, buffer.String(), "uniques 3 1418052649\n")
 
 	// one value is repeated
 	buffer.Reset()
-	current.sets["uniques"] = []string{"123", "234", "234"}
-	num = current.processSets(&buffer, now, "external")
+	addSet("uniques", "123", "234", "234")
+	num = current.processSets(textWriter{&buffer, "external"}, now)
 	assert.Equal(t, num, int64(1))
 	assert.Equal(t, buffer.String(), "uniques 2 1418052649\n")
 
 	// make sure current.sets are purged
-	num = current.processSets(&buffer, now, "external")
+	num = current.processSets(textWriter{&buffer, "external"}, now)
 	assert.Equal(t, num, int64(0))
 }
 
@@ -834,12 +1009,12 @@ func TestProcessTimersUpperPercentile(t *testing.T) {
 	now := int64(1418052649)
 
 	var buffer bytes.Buffer
-	num := current.processTimers(&buffer, now, Percentiles{
+	num := current.processTimers(textWriter{&buffer, "external"}, now, Percentiles{
 		Percentile{
 			75,
 			"75",
 		},
-	}, "external")
+	})
 
 	lines := bytes.Split(buffer.Bytes(), []byte("\n"))
 
@@ -854,12 +1029,12 @@ func TestProcessTimesLowerPercentile(t *testing.T) {
 	now := int64(1418052649)
 
 	var buffer bytes.Buffer
-	num := current.processTimers(&buffer, now, Percentiles{
+	num := current.processTimers(textWriter{&buffer, "external"}, now, Percentiles{
 		Percentile{
 			-75,
 			"-75",
 		},
-	}, "external")
+	})
 
 	lines := bytes.Split(buffer.Bytes(), []byte("\n"))
 
@@ -867,6 +1042,136 @@ func TestProcessTimesLowerPercentile(t *testing.T) {
 	assert.Equal(t, string(lines[0]), "time.lower_75 1.000000 1418052649")
 }
 
+func TestProcessTimersSketch(t *testing.T) {
+	Config.SketchAccuracy = 0.01
+	Config.ExtraTagsHash = map[string]string{}
+	Config.CfgTimerSketch = ConfigTimerSketch{Prefixes: []string{"sk."}}
+	Config.TimerStats = validTimerStats
+	defer func() {
+		Config.CfgTimerSketch = ConfigTimerSketch{}
+		Config.TimerStats = nil
+	}()
+
+	mx := newMetrics()
+	for i := 1; i <= 1000; i++ {
+		v := float64(i*i) / 10
+		mx.handlePacket(&Packet{Bucket: "sk.time", Value: v, Modifier: "ms", Sampling: 1})
+		mx.handlePacket(&Packet{Bucket: "ex.time", Value: v, Modifier: "ms", Sampling: 1})
+	}
+	assert.Equal(t, 1, len(mx.timers))
+	assert.Equal(t, 1, len(mx.timerSketches))
+
+	var out flushOutput
+	pctls := Percentiles{{Float: 90, Str: "90"}, {Float: -25, Str: "-25"}}
+	num := mx.processTimers(&out, 1418052649, pctls)
+	assert.Equal(t, int64(2), num)
+
+	values := map[string]float64{}
+	for _, p := range out {
+		values[p.metric()], _ = pointFloat(p.Value)
+	}
+	for _, stat := range []string{"upper_90", "lower_25", "mean", "upper", "lower", "count",
+		"count_90", "mean_90", "sum_90", "sum_squares_90", "count_top25", "mean_top25", "sum_top25", "sum_squares_top25",
+		"median", "std", "sum", "sum_squares"} {
+		exact, approx := values["ex.time."+stat], values["sk.time."+stat]
+		if math.Abs(exact-approx) > 0.01*math.Abs(exact) {
+			t.Errorf("%s: sketch %v, exact %v", stat, approx, exact)
+		}
+	}
+	assert.Equal(t, 0, len(mx.timerSketches))
+}
+
+func TestProcessTimersExtendedStats(t *testing.T) {
+	Config.ExtraTagsHash = map[string]string{}
+	Config.FlushInterval = 10
+	Config.TimerStats = validTimerStats
+	defer func() { Config.TimerStats = nil }()
+
+	mx := newMetrics()
+	for i := 10; i >= 1; i-- {
+		mx.handlePacket(&Packet{Bucket: "api.time", Value: float64(i), Modifier: "ms", Sampling: 1})
+	}
+
+	var buffer bytes.Buffer
+	pctls := Percentiles{{Float: 90, Str: "90"}, {Float: -20, Str: "-20"}}
+	mx.processTimers(textWriter{&buffer, "external"}, 1418052649, pctls)
+
+	values := map[string]string{}
+	for _, line := range splitNonEmpty(buffer.String()) {
+		f := strings.Fields(line)
+		values[f[0]] = f[1]
+	}
+	assert.Equal(t, map[string]string{
+		"api.time.upper_90":          "9.000000",
+		"api.time.count_90":          "9",
+		"api.time.mean_90":           "5.000000",
+		"api.time.sum_90":            "45.000000",
+		"api.time.sum_squares_90":    "285.000000",
+		"api.time.lower_20":          "9.000000",
+		"api.time.count_top20":       "2",
+		"api.time.mean_top20":        "9.500000",
+		"api.time.sum_top20":         "19.000000",
+		"api.time.sum_squares_top20": "181.000000",
+		"api.time.mean":              "5.500000",
+		"api.time.upper":             "10.000000",
+		"api.time.lower":             "1.000000",
+		"api.time.count":             "10",
+		"api.time.count_ps":          "1.000000",
+		"api.time.sum":               "55.000000",
+		"api.time.sum_squares":       "385.000000",
+		"api.time.std":               "2.872281",
+		"api.time.median":            "5.500000",
+	}, values)
+
+	// only the selected statistics
+	Config.TimerStats = []string{"count", "median"}
+	mx.handlePacket(&Packet{Bucket: "api.time", Value: float64(3), Modifier: "ms", Sampling: 1})
+	buffer.Reset()
+	mx.processTimers(textWriter{&buffer, "external"}, 1418052649, pctls)
+	assert.Equal(t, "api.time.count 1 1418052649\napi.time.median 3.000000 1418052649\n", buffer.String())
+}
+
+// TestProcessTimersEtsy compares the timer statistics with the output of Etsy
+// statsd (lib/process_metrics.js) for the same timer and thresholds.
+func TestProcessTimersEtsy(t *testing.T) {
+	Config.ExtraTagsHash = map[string]string{}
+	Config.FlushInterval = 10
+	Config.TimerStats = validTimerStats
+	defer func() { Config.TimerStats = nil }()
+
+	// statsd timers: {'api.time': [2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37]},
+	// percentThreshold: [50, 99.5, -25], flushInterval: 10000
+	etsy := map[string]float64{
+		"count_50": 6, "mean_50": 6.833333333333333, "upper_50": 13, "sum_50": 41, "sum_squares_50": 377,
+		"count_99_5": 12, "mean_99_5": 16.416666666666668, "upper_99_5": 37, "sum_99_5": 197, "sum_squares_99_5": 4727,
+		"count_top25": 3, "mean_top25": 32.333333333333336, "lower_top25": 29, "sum_top25": 97, "sum_squares_top25": 3171,
+		"std": 11.153910624629473, "upper": 37, "lower": 2, "count": 12, "count_ps": 1.2,
+		"sum": 197, "sum_squares": 4727, "mean": 16.416666666666668, "median": 15,
+	}
+
+	mx := newMetrics()
+	for _, v := range []float64{37, 2, 31, 3, 29, 5, 23, 7, 19, 11, 17, 13} {
+		mx.handlePacket(&Packet{Bucket: "api.time", Value: v, Modifier: "ms", Sampling: 1})
+	}
+	var out flushOutput
+	pctls := Percentiles{{Float: 50, Str: "50"}, {Float: 99.5, Str: "99_5"}, {Float: -25, Str: "-25"}}
+	mx.processTimers(&out, 1418052649, pctls)
+
+	got := map[string]float64{}
+	for _, p := range out {
+		got[p.Stat], _ = pointFloat(p.Value)
+	}
+	// the only name that differs
+	got["lower_top25"] = got["lower_25"]
+	delete(got, "lower_25")
+	for stat, want := range etsy {
+		if v, ok := got[stat]; !ok || math.Abs(v-want) > 1e-9 {
+			t.Errorf("%s = %v (written %v), Etsy statsd %v", stat, v, ok, want)
+		}
+	}
+	assert.Equal(t, len(etsy), len(got))
+}
+
 func TestMultipleUDPSends(t *testing.T) {
 	addr := "127.0.0.1:8126"
 
@@ -965,9 +1270,9 @@ func TestMultipleUDPSends(t *testing.T) {
 //
 //	now := time.Now().Unix()
 //	t.ResetTimer()
-//	current.processTimers(&buff, now, commonPercentiles, "external")
-//	current.processCounters(&buff, now, true, "external", dbHandle)
-//	current.processGauges(&buff, now, "external")
+//	current.processTimers(textWriter{&buff, "external"}, now, commonPercentiles)
+//	current.processCounters(textWriter{&buff, "external"}, now, true, dbHandle)
+//	current.processGauges(textWriter{&buff, "external"}, now)
 //}
 //
 //func BenchmarkOneBigTimer(t *testing.B) {
@@ -1046,7 +1351,7 @@ func TestMultipleUDPSends(t *testing.T) {
 //	t.ResetTimer()
 //
 //	for i := 0; i < t.N; i++ {
-//		current.processCounters(&buff, time.Now().Unix(), true, "external", dbHandle)
+//		current.processCounters(textWriter{&buff, "external"}, time.Now().Unix(), true, dbHandle)
 //		buff = bytes.Buffer{}
 //	}
 //
@@ -1172,7 +1477,7 @@ func BenchmarkPacketHandlerTimer(b *testing.B) {
 }
 
 func BenchmarkPacketHandlerSet(b *testing.B) {
-	current.sets = make(map[string][]string)
+	current.sets = make(map[string]*setCounter)
 
 	p := &Packet{
 		Bucket:   "uniques",
@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"sync"
 	"time"
 
 	"fmt"
@@ -11,8 +12,7 @@ import (
 
 func submit(mx *metrics, deadline time.Time) error {
 
-	backend := Config.BackendType
-	var buffer bytes.Buffer
+	var out flushOutput
 	var num int64
 
 	now := time.Now().Unix()
@@ -30,17 +30,24 @@ func submit(mx *metrics, deadline time.Time) error {
 		logCtx.Debugf("%s", Stat.String(mx))
 	}
 
-	// Universal format in buffer
-	num += mx.processCounters(&buffer, now, Config.ResetCounters, backend, dbHandle)
-	num += mx.processGauges(&buffer, now, backend)
-	num += mx.processTimers(&buffer, now, Config.PercentThreshold, backend)
-	num += mx.processSets(&buffer, now, backend)
-	num += mx.processKeyValue(&buffer, now, backend)
+	// Points of all kinds, serialized per backend format in sendToBackends
+	// timed counters first: without reset they add to the running totals
+	// processCounters continues from
+	num += mx.processTimedCounters(&out, Config.ResetCounters, dbHandle)
+	num += mx.processCounters(&out, now, Config.ResetCounters, dbHandle)
+	num += mx.processGauges(&out, now)
+	num += mx.processTimedGauges(&out)
+	num += mx.processTimers(&out, now, Config.PercentThreshold)
+	num += mx.processHistograms(&out, now, Config.PercentThreshold)
+	num += mx.processDistributions(&out, now, Config.PercentThreshold)
+	num += mx.processSets(&out, now)
+	num += mx.processKeyValue(&out, now)
 
 	Stat.PointsTransmittedInc(num)
+	mx.limiter.logOffenders()
 
 	if Config.InternalLogLevel >= log.DebugLevel || Config.CfgDebugMetrics.Enabled {
-		for _, line := range bytes.Split(buffer.Bytes(), []byte("\n")) {
+		for _, line := range bytes.Split(out.render("external").Bytes(), []byte("\n")) {
 			if len(line) == 0 {
 				continue
 			}
@@ -55,20 +62,42 @@ func submit(mx *metrics, deadline time.Time) error {
 		}
 	}
 
-	// send stats to backend
-	b, err := selectBackend(Config)
-	if err != nil {
-		fmt.Printf("%s. Exiting...\n", err)
-		logCtx.Fatalf("%s. Exiting...", err)
-	}
-	if b != nil { // nil == dummy backend (no-op)
-		if err := b.Send(&buffer, deadline); err != nil {
-			logCtx.Errorf("%s", err)
-			Stat.BatchesTransmitFailInc()
-		} else {
-			Stat.BatchesTransmittedInc()
+	// send stats to all backends
+	sendToBackends(flushBackends, out, deadline)
+
+	return nil
+}
+
+// sendToBackends serializes the flush output once per backend format and
+// sends it to every backend concurrently. A failing or slow backend never
+// prevents the others from receiving the batch. Failed batches are spooled
+// for a later retry when the spool is enabled.
+func sendToBackends(backends []namedBackend, out flushOutput, deadline time.Time) {
+	logCtx := log.WithFields(log.Fields{
+		"in": "sendToBackends",
+	})
+
+	formatted := make(map[string][]byte)
+	for _, nb := range backends {
+		if _, ok := formatted[nb.Format]; !ok {
+			formatted[nb.Format] = out.render(nb.Format).Bytes()
 		}
 	}
 
-	return nil
+	var wg sync.WaitGroup
+	for _, nb := range backends {
+		wg.Add(1)
+		go func(nb namedBackend, data []byte) {
+			defer wg.Done()
+			if err := sendWithSpool(nb, data, deadline); err != nil {
+				logCtx.WithField("backend", nb.Name).Errorf("%s", err)
+				Stat.BatchesTransmitFailInc()
+				Stat.BackendBatchesTransmitFailInc(nb.Name)
+			} else {
+				Stat.BatchesTransmittedInc()
+				Stat.BackendBatchesTransmittedInc(nb.Name)
+			}
+		}(nb, formatted[nb.Format])
+	}
+	wg.Wait()
 }
@@ -14,6 +14,8 @@ const (
 	tfGraphite = iota // eg. cpu.load._t_.host.h1.env.dev
 	tfURI      = iota //eg. cpu.load?host=h1&env=dev
 	tfPretty   = iota //eg. cpu.load host=h1,env=dev
+
+	tfGraphiteNative = iota // eg. cpu.load;env=dev;host=h1
 )
 
 var (
@@ -26,6 +28,8 @@ const (
 	tfGraphiteFirstDelim = "._t_."
 	tfURIFirstDelim      = "?"
 	tfPrettyFirstDelim   = ""
+
+	tfGraphiteNativeFirstDelim = ";"
 )
 
 // delimeite between tag(key) and value
@@ -34,6 +38,8 @@ const (
 	tfGraphiteKVDelim = "."
 	tfURIKVDelim      = "="
 	tfPrettyKVDelim   = "="
+
+	tfGraphiteNativeKVDelim = "="
 )
 
 // delimiters between tags for different tag formats
@@ -42,6 +48,8 @@ const (
 	tfGraphiteTagsDelim = "."
 	tfURITagsDelim      = "&"
 	tfPrettyTagsDelim   = ","
+
+	tfGraphiteNativeTagsDelim = ";"
 )
 
 func tagsDelims(tf uint) (string, string, string) {
@@ -70,6 +78,11 @@ func tagsDelims(tf uint) (string, string, string) {
 		firstDelim = tfPrettyFirstDelim
 		kvDelim = tfPrettyKVDelim
 		tagsDelim = tfPrettyTagsDelim
+
+	case tfGraphiteNative:
+		firstDelim = tfGraphiteNativeFirstDelim
+		kvDelim = tfGraphiteNativeKVDelim
+		tagsDelim = tfGraphiteNativeTagsDelim
 	default:
 		log.Fatalf("Unknown tag format %d. Setting to default = %d", tf, tfDefault)
 
@@ -144,6 +157,35 @@ func normalizeTags(t map[string]string, tf uint) string {
 	return tagsToSortedSlice(t).StringType(tf)
 }
 
+// sanitizeGraphiteTags returns a copy of tags that Graphite's tagged series
+// accept: tag names can't contain ;!^= and values can't contain ; or start
+// with ~. Spaces would break the plaintext protocol. Offending characters are
+// replaced by '_', tags left empty are dropped.
+func sanitizeGraphiteTags(tags map[string]string) map[string]string {
+	out := make(map[string]string, len(tags))
+	for k, v := range tags {
+		k = strings.Map(func(r rune) rune {
+			switch r {
+			case ';', '!', '^', '=', ' ', '\t', '\n':
+				return '_'
+			}
+			return r
+		}, k)
+		v = strings.Map(func(r rune) rune {
+			switch r {
+			case ';', ' ', '\t', '\n':
+				return '_'
+			}
+			return r
+		}, strings.TrimLeft(v, "~"))
+		if k == "" || v == "" {
+			continue
+		}
+		out[k] = v
+	}
+	return out
+}
+
 func parseExtraTags(tagsStr string) (map[string]string, error) {
 
 	tags := make(map[string]string)
@@ -163,6 +205,29 @@ func parseExtraTags(tagsStr string) (map[string]string, error) {
 	}
 	return tags, nil
 }
+
+// parseDogStatsDTags parses the DogStatsD tags section (without "|#"), eg.
+// env:prod,host:a,canary. Tags without a value get the value "true". Keys and
+// values are sanitized like caret tags, tags left empty are dropped.
+func parseDogStatsDTags(s string) map[string]string {
+	tags := make(map[string]string)
+	for _, e := range strings.Split(s, ",") {
+		key, val, found := strings.Cut(e, ":")
+		if !found {
+			val = "true"
+		}
+		key = sanitizeBucket(key)
+		val = sanitizeBucket(val)
+		if key == "" || val == "" {
+			log.WithField("in", "parseDogStatsDTags").Errorf("Format error: Invalid tag [%s] in %s, Removing this tag", e, s)
+			Stat.PointsParseSoftFailInc()
+			continue
+		}
+		tags[key] = val
+	}
+	return tags
+}
+
 func parseBucketAndTags(name string) (string, map[string]string, error) {
 	// split name in format
 	// measure.name.^tag1=val1.^tag2=val2
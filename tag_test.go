@@ -82,6 +82,7 @@ func TestNormalizeTags(t *testing.T) {
 		{format: tfCaret, want: "env=prod.^host=web1"},
 		{format: tfGraphite, want: "env.prod.host.web1"},
 		{format: tfURI, want: "env=prod&host=web1"},
+		{format: tfGraphiteNative, want: "env=prod;host=web1"},
 	}
 	for _, tc := range tests {
 		if got := normalizeTags(tags, tc.format); got != tc.want {
@@ -92,3 +93,39 @@ func TestNormalizeTags(t *testing.T) {
 		t.Errorf("normalizeTags(empty) = %q, want empty", got)
 	}
 }
+
+func TestSanitizeGraphiteTags(t *testing.T) {
+	got := sanitizeGraphiteTags(map[string]string{
+		"ok":      "v1",
+		"bad;key": "v2",
+		"a^b=c!d": "v3",
+		"val":     "~x;y z",
+		"empty":   "~",
+	})
+	want := map[string]string{
+		"ok":      "v1",
+		"bad_key": "v2",
+		"a_b_c_d": "v3",
+		"val":     "x_y_z",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("sanitizeGraphiteTags = %v, want %v", got, want)
+	}
+}
+
+func TestParseDogStatsDTags(t *testing.T) {
+	tests := []struct {
+		in   string
+		want map[string]string
+	}{
+		{in: "env:prod,host:a", want: map[string]string{"env": "prod", "host": "a"}},
+		{in: "canary", want: map[string]string{"canary": "true"}},
+		{in: "url:http://x/y", want: map[string]string{"url": "http--x-y"}},
+		{in: "env:prod,,:v,k:", want: map[string]string{"env": "prod"}},
+	}
+	for _, tc := range tests {
+		if got := parseDogStatsDTags(tc.in); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseDogStatsDTags(%q) = %v, want %v", tc.in, got, tc.want)
+		}
+	}
+}
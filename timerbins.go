@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// ConfigTimerHistogram - bin counts written for timers whose bucket (after the
+// global prefix, without tags) starts with Prefix, eg. with bins [100, 500]:
+//
+//	api.latency.histogram.bin_100
+//	api.latency.histogram.bin_500
+//	api.latency.histogram.bin_inf
+type ConfigTimerHistogram struct {
+	Prefix string `yaml:"prefix"`
+	// Bins - upper bounds (inclusive) in ascending order, bin_inf is added
+	Bins []float64 `yaml:"bins"`
+	// Cumulative - bin_N counts all values <= N, otherwise only the values
+	// above the previous bound
+	Cumulative bool `yaml:"cumulative"`
+}
+
+// timerHistogramFor returns the first histogram config matching the timer
+// bucket.
+func timerHistogramFor(bucket string) (ConfigTimerHistogram, bool) {
+	for _, h := range Config.TimerHistograms {
+		if strings.HasPrefix(bucket, h.Prefix) {
+			return h, true
+		}
+	}
+	return ConfigTimerHistogram{}, false
+}
+
+// validateTimerHistograms checks the bounds of every histogram and sorts them.
+func validateTimerHistograms(hists []ConfigTimerHistogram) error {
+	for _, h := range hists {
+		if len(h.Bins) == 0 {
+			return fmt.Errorf("Parameter error: timer-histograms entry %q has no bins", h.Prefix)
+		}
+		sort.Float64s(h.Bins)
+		for i, b := range h.Bins {
+			if math.IsNaN(b) || math.IsInf(b, 0) {
+				return fmt.Errorf("Parameter error: timer-histograms entry %q: bins must be finite, bin_inf is always written", h.Prefix)
+			}
+			if i > 0 && b == h.Bins[i-1] {
+				return fmt.Errorf("Parameter error: timer-histograms entry %q: duplicate bin %v", h.Prefix, b)
+			}
+		}
+	}
+	return nil
+}
+
+// timer histogram statistics are named <bucket>.histogram.bin_<bound>
+const (
+	timerHistogramStat = "histogram"
+	timerBinPrefix     = "bin_"
+	timerBinInf        = "inf"
+)
+
+// timerBinName - bin_100, bin_0_5 or bin_inf
+func timerBinName(bound float64) string {
+	if math.IsInf(bound, 1) {
+		return timerBinPrefix + timerBinInf
+	}
+	return timerBinPrefix + strings.ReplaceAll(strconv.FormatFloat(bound, 'f', -1, 64), ".", "_")
+}
+
+// parseTimerBin returns the timer bucket and upper bound of a histogram bin
+// statistic, eg. api.latency.histogram.bin_100 gives api.latency and 100.
+func parseTimerBin(bucket string) (string, float64, bool) {
+	dot := strings.LastIndexByte(bucket, '.')
+	if dot < 0 {
+		return "", 0, false
+	}
+	bin, ok := strings.CutPrefix(bucket[dot+1:], timerBinPrefix)
+	base, isHist := strings.CutSuffix(bucket[:dot], "."+timerHistogramStat)
+	if !ok || !isHist {
+		return "", 0, false
+	}
+	if bin == timerBinInf {
+		return base, math.Inf(1), true
+	}
+	bound, err := strconv.ParseFloat(strings.ReplaceAll(bin, "_", "."), 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return base, bound, true
+}
+
+// writeTimerBins writes the bin counts of one timer. countAtMost returns the
+// number of values <= bound.
+func writeTimerBins(write func(string, any), h ConfigTimerHistogram, count int, countAtMost func(float64) int) {
+	prev := 0
+	for _, bound := range h.Bins {
+		n := countAtMost(bound)
+		if h.Cumulative {
+			write(timerHistogramStat+"."+timerBinName(bound), n)
+		} else {
+			write(timerHistogramStat+"."+timerBinName(bound), n-prev)
+		}
+		prev = n
+	}
+	if h.Cumulative {
+		write(timerHistogramStat+"."+timerBinName(math.Inf(1)), count)
+	} else {
+		write(timerHistogramStat+"."+timerBinName(math.Inf(1)), count-prev)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestTimerBinName(t *testing.T) {
+	tests := []struct {
+		bucket string
+		base   string
+		bound  float64
+		ok     bool
+	}{
+		{"api.latency.histogram.bin_100", "api.latency", 100, true},
+		{"api.latency.histogram.bin_0_5", "api.latency", 0.5, true},
+		{"api.latency.histogram.bin_inf", "api.latency", math.Inf(1), true},
+		{"api.latency.bin_100", "", 0, false},
+		{"api.latency.histogram.upper", "", 0, false},
+		{"api.latency.histogram.bin_x", "", 0, false},
+	}
+	for _, tt := range tests {
+		base, bound, ok := parseTimerBin(tt.bucket)
+		assert.Equal(t, tt.ok, ok, tt.bucket)
+		if ok {
+			assert.Equal(t, tt.base, base, tt.bucket)
+			assert.Equal(t, tt.bound, bound, tt.bucket)
+			assert.Equal(t, tt.bucket, tt.base+".histogram."+timerBinName(tt.bound))
+		}
+	}
+}
+
+func TestValidateTimerHistograms(t *testing.T) {
+	hists := []ConfigTimerHistogram{{Prefix: "a", Bins: []float64{500, 100}}}
+	assert.Equal(t, nil, validateTimerHistograms(hists))
+	assert.Equal(t, []float64{100, 500}, hists[0].Bins)
+
+	for _, bins := range [][]float64{nil, {100, 100}, {100, math.Inf(1)}} {
+		if err := validateTimerHistograms([]ConfigTimerHistogram{{Prefix: "a", Bins: bins}}); err == nil {
+			t.Errorf("bins %v accepted", bins)
+		}
+	}
+}
+
+func TestProcessTimersHistogram(t *testing.T) {
+	Config.ExtraTagsHash = map[string]string{}
+	Config.TimerStats = []string{"count"}
+	Config.CfgTimerSketch = ConfigTimerSketch{Prefixes: []string{"sk."}}
+	defer func() {
+		Config.TimerStats = nil
+		Config.TimerHistograms = nil
+		Config.CfgTimerSketch = ConfigTimerSketch{}
+	}()
+
+	tests := []struct {
+		cumulative bool
+		want       string
+	}{
+		{false, "api.time.count 7 1 host=h1\n" +
+			"api.time.histogram.bin_100 3 1 host=h1\n" +
+			"api.time.histogram.bin_500 2 1 host=h1\n" +
+			"api.time.histogram.bin_inf 2 1 host=h1\n"},
+		{true, "api.time.count 7 1 host=h1\n" +
+			"api.time.histogram.bin_100 3 1 host=h1\n" +
+			"api.time.histogram.bin_500 5 1 host=h1\n" +
+			"api.time.histogram.bin_inf 7 1 host=h1\n"},
+	}
+	for _, tt := range tests {
+		Config.TimerHistograms = []ConfigTimerHistogram{
+			{Prefix: "other.", Bins: []float64{1}},
+			{Prefix: "", Bins: []float64{100, 500}, Cumulative: tt.cumulative},
+		}
+		for _, prefix := range []string{"api.", "sk.api."} {
+			mx := newMetrics()
+			for _, v := range []float64{10, 99, 100, 200, 500, 520, 10000} {
+				mx.handlePacket(&Packet{Bucket: prefix + "time.^host=h1", Value: v, Modifier: "ms", Sampling: 1})
+			}
+			var buffer bytes.Buffer
+			mx.processTimers(textWriter{&buffer, "external"}, 1, Percentiles{})
+			want := tt.want
+			if prefix == "sk.api." {
+				want = string(bytes.ReplaceAll([]byte(want), []byte("api."), []byte("sk.api.")))
+			}
+			assert.Equal(t, want, buffer.String(), prefix)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	bolt "go.etcd.io/bbolt"
+)
+
+// default timestamp-max-skew, seconds
+const defaultTimestampMaxSkew = 3600
+
+var errTimestampSkew = errors.New("timestamp out of timestamp-max-skew")
+
+// parseTimestamp parses the |T<unix> section of a line (without 'T'). Points
+// older or newer than timestamp-max-skew seconds are rejected.
+func parseTimestamp(section []byte) (int64, error) {
+	ts, err := strconv.ParseInt(string(section), 10, 64)
+	if err != nil || ts <= 0 {
+		return 0, fmt.Errorf("invalid timestamp %q", section)
+	}
+	if Config.TimestampMaxSkew > 0 {
+		skew := time.Now().Unix() - ts
+		if skew > Config.TimestampMaxSkew || -skew > Config.TimestampMaxSkew {
+			return 0, errTimestampSkew
+		}
+	}
+	return ts, nil
+}
+
+// handleTimed folds a counter or gauge with a client timestamp into the
+// buckets of that timestamp.
+func (mx *metrics) handleTimed(s *Packet) {
+	switch s.Modifier {
+	case "c":
+		counters, ok := mx.timedCounters[s.Timestamp]
+		if !ok {
+			counters = make(map[string]int64)
+			mx.timedCounters[s.Timestamp] = counters
+		}
+		counters[s.Bucket] += int64(float64(s.Value.(int64)) * float64(1/s.Sampling))
+	case "g":
+		gauges, ok := mx.timedGauges[s.Timestamp]
+		if !ok {
+			gauges = make(map[string]float64)
+			mx.timedGauges[s.Timestamp] = gauges
+		}
+		gaugeData := s.Value.(GaugeData)
+		switch {
+		case !gaugeData.Relative:
+			gauges[s.Bucket] = gaugeData.Value
+		case gaugeData.Negative:
+			gauges[s.Bucket] = math.Max(gauges[s.Bucket]-gaugeData.Value, 0)
+		default:
+			gauges[s.Bucket] = math.Min(gauges[s.Bucket]+gaugeData.Value, math.MaxFloat64)
+		}
+	}
+}
+
+// processTimedCounters writes the counters with client timestamps through
+// writeCounter, so they get rates like the other counters, but without
+// inactivity zeros. In "don't reset" mode they are added to the persisted
+// running total in timestamp order and written as totals, like the other
+// points of their series; it runs before processCounters, which continues
+// from the totals it stored.
+func (mx *metrics) processTimedCounters(w pointWriter, reset bool, dbHandle *bolt.DB) int64 {
+	logCtx := log.WithFields(log.Fields{
+		"in": "processTimedCounters",
+	})
+
+	timestamps := make([]int64, 0, len(mx.timedCounters))
+	for ts := range mx.timedCounters {
+		timestamps = append(timestamps, ts)
+	}
+	sort.Slice(timestamps, func(i, j int) bool { return timestamps[i] < timestamps[j] })
+
+	var num int64
+	totals := make(map[string]MeasurePoint)
+	for _, ts := range timestamps {
+		for bucket, value := range mx.timedCounters[ts] {
+			total := value
+			if !reset {
+				mp, ok := totals[bucket]
+				if !ok {
+					var err error
+					if mp, err = readMeasurePoint(dbHandle, bucketName, bucket); err != nil {
+						logCtx.Errorf("readMeasurePoint: %s", err)
+						Stat.OtherErrorsInc()
+					}
+				}
+				mp.Value += value
+				mp.When = max(mp.When, ts)
+				totals[bucket] = mp
+				total = mp.Value
+			}
+			num += writeCounter(timedWriter{w}, bucket, total, value, ts)
+		}
+		delete(mx.timedCounters, ts)
+	}
+
+	if !reset {
+		if err := storeMeasurePoints(dbHandle, bucketName, totals); err != nil {
+			logCtx.Errorf("storeMeasurePoints: %s", err)
+			Stat.OtherErrorsInc()
+		}
+	}
+	return num
+}
+
+// timedWriter marks the points it passes on as Timed.
+type timedWriter struct {
+	w pointWriter
+}
+
+func (t timedWriter) writePoint(p outputPoint) {
+	p.Timed = true
+	t.w.writePoint(p)
+}
+
+// processTimedGauges writes the gauges with client timestamps. They do not
+// change the last value republished by gauges without timestamps.
+func (mx *metrics) processTimedGauges(w pointWriter) int64 {
+	var num int64
+	for ts, gauges := range mx.timedGauges {
+		for bucket, value := range gauges {
+			p := newPoint(kindGauge, bucket, value, ts)
+			p.Timed = true
+			w.writePoint(p)
+			num++
+		}
+		delete(mx.timedGauges, ts)
+	}
+	return num
+}
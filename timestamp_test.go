@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestParseLineTimestamp(t *testing.T) {
+	saved := Config.TimestampMaxSkew
+	defer func() { Config.TimestampMaxSkew = saved }()
+	Config.TimestampMaxSkew = 3600
+
+	ts := time.Now().Unix() - 600
+	packet := parseLine([]byte(fmt.Sprintf("replayed:3|c|@0.5|T%d", ts)))
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "replayed", packet.Bucket)
+	assert.Equal(t, int64(3), packet.Value.(int64))
+	assert.Equal(t, float32(0.5), packet.Sampling)
+	assert.Equal(t, ts, packet.Timestamp)
+
+	packet = parseLine([]byte(fmt.Sprintf("replayed.gauge:7|g|T%d|#env:prod", ts)))
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, "replayed.gauge.^env=prod", packet.Bucket)
+	assert.Equal(t, ts, packet.Timestamp)
+
+	// other types ignore timestamps
+	packet = parseLine([]byte(fmt.Sprintf("replayed.timer:7|ms|T%d", ts)))
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, int64(0), packet.Timestamp)
+
+	// lines with timestamps are not packet cached
+	line := fmt.Sprintf("replayed.cached:1|c|T%d", ts)
+	parseLine([]byte(line))
+	_, found := packetCache.Get(line)
+	assert.Equal(t, found, false)
+
+	Stat.curStat.TimestampRejected = 0
+	assert.Equal(t, parseLine([]byte(fmt.Sprintf("replayed:1|c|T%d", time.Now().Unix()-7200))), (*Packet)(nil))
+	assert.Equal(t, parseLine([]byte(fmt.Sprintf("replayed:1|c|T%d", time.Now().Unix()+7200))), (*Packet)(nil))
+	assert.Equal(t, Stat.curStat.TimestampRejected, int64(2))
+
+	assert.Equal(t, parseLine([]byte("replayed:1|c|Tnow")), (*Packet)(nil))
+
+	// 0 - no limit
+	Config.TimestampMaxSkew = 0
+	packet = parseLine([]byte("replayed:1|c|T1000000000"))
+	assert.NotEqual(t, packet, nil)
+	assert.Equal(t, int64(1000000000), packet.Timestamp)
+}
+
+func TestProcessTimed(t *testing.T) {
+	lastGaugeValue = make(map[string]float64)
+
+	mx := newMetrics()
+	mx.handlePacket(&Packet{Bucket: "timed.c", Value: int64(2), Modifier: "c", Sampling: 0.5, Timestamp: 1000})
+	mx.handlePacket(&Packet{Bucket: "timed.c", Value: int64(1), Modifier: "c", Sampling: 1, Timestamp: 1000})
+	mx.handlePacket(&Packet{Bucket: "timed.c", Value: int64(1), Modifier: "c", Sampling: 1, Timestamp: 1010})
+	mx.handlePacket(&Packet{Bucket: "timed.c", Value: int64(9), Modifier: "c", Sampling: 1})
+	mx.handlePacket(&Packet{Bucket: "timed.g", Value: GaugeData{false, false, 5}, Modifier: "g", Sampling: 1, Timestamp: 1000})
+	mx.handlePacket(&Packet{Bucket: "timed.g", Value: GaugeData{true, true, 2}, Modifier: "g", Sampling: 1, Timestamp: 1000})
+	assert.Equal(t, mx.counters["timed.c"], int64(9))
+	assert.Equal(t, len(mx.gauges), 0)
+
+	var buf bytes.Buffer
+	num := mx.processTimedCounters(textWriter{&buf, "external"}, true, nil)
+	num += mx.processTimedGauges(textWriter{&buf, "external"})
+	assert.Equal(t, num, int64(3))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	want := map[string]bool{
+		"timed.c 5 1000":        true,
+		"timed.c 1 1010":        true,
+		"timed.g 3.000000 1000": true,
+	}
+	assert.Equal(t, len(lines), len(want))
+	for _, line := range lines {
+		assert.T(t, want[line], line)
+	}
+	assert.Equal(t, len(mx.timedCounters), 0)
+	assert.Equal(t, len(mx.timedGauges), 0)
+	assert.Equal(t, len(lastGaugeValue), 0)
+}
+
+func TestProcessTimedCountersTotals(t *testing.T) {
+	db := openSpoolTestDB(t, "/tmp/timed_counters_test.db")
+	defer closeAndRemove(db, "/tmp/timed_counters_test.db")
+	Config.CfgCounterRate = ConfigCounterRate{Enabled: true, Count: true}
+	flushInterval := Config.FlushInterval
+	Config.FlushInterval = 10
+	defer func() {
+		Config.CfgCounterRate = ConfigCounterRate{}
+		Config.FlushInterval = flushInterval
+	}()
+	countInactivity = make(map[string]int64)
+	if err := storeMeasurePoint(db, bucketName, "jobs", MeasurePoint{Value: 100, When: 990}); err != nil {
+		t.Fatal(err)
+	}
+
+	mx := newMetrics()
+	mx.handlePacket(&Packet{Bucket: "jobs", Value: int64(5), Modifier: "c", Sampling: 1, Timestamp: 1010})
+	mx.handlePacket(&Packet{Bucket: "jobs", Value: int64(20), Modifier: "c", Sampling: 1, Timestamp: 1000})
+	mx.handlePacket(&Packet{Bucket: "jobs", Value: int64(3), Modifier: "c", Sampling: 1})
+
+	// running totals in timestamp order, then the points of the flush time
+	var buf bytes.Buffer
+	mx.processTimedCounters(textWriter{&buf, "external"}, false, db)
+	mx.processCounters(textWriter{&buf, "external"}, 1020, false, db)
+	assert.Equal(t, "jobs 120 1000\njobs.rate 2.000000 1000\njobs.count 120 1000\n"+
+		"jobs 125 1010\njobs.rate 0.500000 1010\njobs.count 125 1010\n"+
+		"jobs 128 1020\njobs.rate 0.300000 1020\njobs.count 128 1020\n", buf.String())
+	countInactivity = make(map[string]int64)
+}
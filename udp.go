@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// listenUDP opens the UDP sockets for the readers: one socket shared by all
+// of them or, with reuseport, one SO_REUSEPORT socket each so the kernel
+// spreads packets over them. readBuffer sets SO_RCVBUF when > 0.
+func listenUDP(address string, readers int, reuseport bool, readBuffer int) ([]*net.UDPConn, error) {
+	if readers < 1 {
+		readers = 1
+	}
+	lc := net.ListenConfig{}
+	sockets := 1
+	if reuseport {
+		sockets = readers
+		lc.Control = func(_, _ string, c syscall.RawConn) error {
+			var serr error
+			err := c.Control(func(fd uintptr) {
+				serr = unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+			})
+			if err != nil {
+				return err
+			}
+			return serr
+		}
+	}
+
+	var conns []*net.UDPConn
+	for i := 0; i < sockets; i++ {
+		// the next sockets bind to the port picked for the first one
+		if i == 1 {
+			address = conns[0].LocalAddr().String()
+		}
+		pc, err := lc.ListenPacket(context.Background(), "udp", address)
+		if err != nil {
+			for _, c := range conns {
+				c.Close()
+			}
+			return nil, err
+		}
+		conn := pc.(*net.UDPConn)
+		if readBuffer > 0 {
+			if err := conn.SetReadBuffer(readBuffer); err != nil {
+				conn.Close()
+				for _, c := range conns {
+					c.Close()
+				}
+				return nil, fmt.Errorf("SetReadBuffer: %s", err)
+			}
+		}
+		conns = append(conns, conn)
+	}
+	return conns, nil
+}
+
+// udpSocketStats sums the kernel receive queue (bytes) and drop counter of the
+// UDP sockets bound to port, from /proc/net/udp and /proc/net/udp6.
+func udpSocketStats(port int) (queue, drops int64, ok bool) {
+	for _, name := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+		f, err := os.Open(name)
+		if err != nil {
+			continue
+		}
+		q, d, found := parseProcNetUDP(f, port)
+		f.Close()
+		if found {
+			queue += q
+			drops += d
+			ok = true
+		}
+	}
+	return queue, drops, ok
+}
+
+// parseProcNetUDP reads a /proc/net/udp table:
+//
+//	sl  local_address rem_address   st tx_queue:rx_queue tr:tm->when retrnsmt   uid  timeout inode ref pointer drops
+//	1: 00000000:1FBD 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 1234 2 0000000000000000 17
+func parseProcNetUDP(r io.Reader, port int) (queue, drops int64, found bool) {
+	suffix := fmt.Sprintf(":%04X", port)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 13 || !strings.HasSuffix(fields[1], suffix) {
+			continue
+		}
+		_, rx, _ := strings.Cut(fields[4], ":")
+		q, err := strconv.ParseInt(rx, 16, 64)
+		if err != nil {
+			continue
+		}
+		d, err := strconv.ParseInt(fields[12], 10, 64)
+		if err != nil {
+			continue
+		}
+		queue += q
+		drops += d
+		found = true
+	}
+	return queue, drops, found
+}
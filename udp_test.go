@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestParseProcNetUDP(t *testing.T) {
+	table := `   sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  123: 00000000:1FBD 00000000:0000 07 00000000:00000100 00:00000000 00000000     0        0 1001 2 0000000000000000 17
+  124: 00000000:1FBD 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 1002 2 0000000000000000 3
+  125: 0100007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 1003 2 0000000000000000 99
+`
+	queue, drops, found := parseProcNetUDP(strings.NewReader(table), 8125)
+	assert.Equal(t, true, found)
+	assert.Equal(t, int64(256), queue)
+	assert.Equal(t, int64(20), drops)
+
+	_, _, found = parseProcNetUDP(strings.NewReader(table), 8126)
+	assert.Equal(t, false, found)
+}
+
+func TestListenUDPReusePort(t *testing.T) {
+	conns, err := listenUDP("127.0.0.1:0", 3, true, 1<<20)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 3, len(conns))
+	port := conns[0].LocalAddr().(*net.UDPAddr).Port
+	for _, c := range conns {
+		assert.Equal(t, port, c.LocalAddr().(*net.UDPAddr).Port)
+		defer c.Close()
+	}
+
+	// readers share one socket without reuseport
+	shared, err := listenUDP("127.0.0.1:0", 3, false, 0)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, 1, len(shared))
+	shared[0].Close()
+
+	// the port is taken by sockets without SO_REUSEPORT
+	_, err = listenUDP(conns[0].LocalAddr().String(), 1, false, 0)
+	assert.NotEqual(t, nil, err)
+
+	if _, _, ok := udpSocketStats(port); !ok {
+		t.Logf("no /proc/net/udp entry for port %d", port)
+	}
+}
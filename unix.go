@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// default permissions of unix socket files
+const defaultUnixSocketMode = "0666"
+
+// ConfigUnixSocket - permissions of the unixgram-addr and unix-addr socket
+// files.
+type ConfigUnixSocket struct {
+	// Mode - octal permissions, eg. 0660
+	Mode string `yaml:"mode"`
+	// User and Group - owner of the socket files, name or numeric id, empty -
+	// the user running statsdaemon
+	User  string `yaml:"user"`
+	Group string `yaml:"group"`
+}
+
+// parse returns the socket mode and owner, -1 for ids left unchanged.
+func (c ConfigUnixSocket) parse() (os.FileMode, int, int, error) {
+	mode, err := strconv.ParseUint(c.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, -1, -1, fmt.Errorf("invalid unix socket mode %q", c.Mode)
+	}
+	uid, gid := -1, -1
+	if c.User != "" {
+		if uid, err = strconv.Atoi(c.User); err != nil {
+			u, err := user.Lookup(c.User)
+			if err != nil {
+				return 0, -1, -1, err
+			}
+			uid, _ = strconv.Atoi(u.Uid)
+		}
+	}
+	if c.Group != "" {
+		if gid, err = strconv.Atoi(c.Group); err != nil {
+			g, err := user.LookupGroup(c.Group)
+			if err != nil {
+				return 0, -1, -1, err
+			}
+			gid, _ = strconv.Atoi(g.Gid)
+		}
+	}
+	return os.FileMode(mode), uid, gid, nil
+}
+
+// removeStaleSocket removes the socket file at path left by a previous run.
+// It fails when the path is not a socket or another process is listening on
+// it.
+func removeStaleSocket(network, path string) error {
+	fi, err := os.Lstat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	conn, err := net.Dial(network, path)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) && !errors.Is(err, syscall.ENOENT) {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+	return os.Remove(path)
+}
+
+// setSocketPermissions applies unix-socket mode and ownership to the socket
+// file.
+func setSocketPermissions(path string, cfg ConfigUnixSocket) error {
+	mode, uid, gid, err := cfg.parse()
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		return err
+	}
+	if uid != -1 || gid != -1 {
+		return os.Chown(path, uid, gid)
+	}
+	return nil
+}
+
+// listenUnixgram opens the datagram socket at path.
+func listenUnixgram(path string, cfg ConfigUnixSocket) (*net.UnixConn, error) {
+	if err := removeStaleSocket("unixgram", path); err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketPermissions(path, cfg); err != nil {
+		conn.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// listenUnix opens the stream socket at path.
+func listenUnix(path string, cfg ConfigUnixSocket) (*net.UnixListener, error) {
+	if err := removeStaleSocket("unix", path); err != nil {
+		return nil, err
+	}
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketPermissions(path, cfg); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// unixgramListener reads datagrams, each with one or more lines, as the UDP
+// listener does.
+func unixgramListener() {
+	logCtx := log.WithFields(log.Fields{
+		"in": "unixgramListener",
+	})
+
+	conn, err := listenUnixgram(Config.UnixgramServiceAddress, Config.CfgUnixSocket)
+	if err != nil {
+		fmt.Printf("Error in listenUnixgram: %v\n", err)
+		logCtx.Fatalf("%s", err)
+	}
+	logCtx.Infof("Listening on %s", Config.UnixgramServiceAddress)
+
+	parseWith(conn, false, deliverPacket)
+}
+
+// unixListener reads lines from stream connections, as the TCP listener
+// does.
+func unixListener() {
+	logCtx := log.WithFields(log.Fields{
+		"in": "unixListener",
+	})
+
+	listener, err := listenUnix(Config.UnixServiceAddress, Config.CfgUnixSocket)
+	if err != nil {
+		fmt.Printf("Error in listenUnix: %v\n", err)
+		logCtx.Fatalf("%s", err)
+	}
+	logCtx.Infof("listening on %s", Config.UnixServiceAddress)
+	defer listener.Close()
+
+	for {
+		conn, err := listener.AcceptUnix()
+		if err != nil {
+			fmt.Printf("Error in AcceptUnix: %v\n", err)
+			logCtx.Fatalf("%s", err)
+		}
+		go parseWith(conn, true, deliverPacket)
+	}
+}
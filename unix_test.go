@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/bmizerany/assert"
+)
+
+func TestRemoveStaleSocket(t *testing.T) {
+	path := "/tmp/statsdaemon_test_stale.sock"
+	os.Remove(path)
+	defer os.Remove(path)
+
+	// nothing to remove
+	assert.Equal(t, nil, removeStaleSocket("unixgram", path))
+
+	// socket file without a listener
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	assert.Equal(t, nil, err)
+	assert.NotEqual(t, nil, removeStaleSocket("unixgram", path)) // in use
+	conn.Close()
+	assert.Equal(t, nil, removeStaleSocket("unixgram", path))
+	_, err = os.Stat(path)
+	assert.Equal(t, true, os.IsNotExist(err))
+
+	// never remove other files
+	assert.Equal(t, nil, os.WriteFile(path, []byte("x"), 0644))
+	assert.NotEqual(t, nil, removeStaleSocket("unixgram", path))
+}
+
+func TestUnixSocketConfig(t *testing.T) {
+	mode, uid, gid, err := ConfigUnixSocket{Mode: "0660", User: "0", Group: "0"}.parse()
+	assert.Equal(t, nil, err)
+	assert.Equal(t, os.FileMode(0660), mode)
+	assert.Equal(t, 0, uid)
+	assert.Equal(t, 0, gid)
+
+	for _, c := range []ConfigUnixSocket{{Mode: "rw"}, {Mode: "1777"}, {Mode: "0666", User: "no-such-user-x"}} {
+		if _, _, _, err := c.parse(); err == nil {
+			t.Errorf("%+v accepted", c)
+		}
+	}
+}
+
+func TestUnixListeners(t *testing.T) {
+	Config.MaxUDPPacketSize = maxUDPPacket
+	cfg := ConfigUnixSocket{Mode: "0620"}
+	dgramPath := "/tmp/statsdaemon_test.dgram.sock"
+	streamPath := "/tmp/statsdaemon_test.stream.sock"
+	defer os.Remove(dgramPath)
+	defer os.Remove(streamPath)
+
+	dconn, err := listenUnixgram(dgramPath, cfg)
+	assert.Equal(t, nil, err)
+	listener, err := listenUnix(streamPath, cfg)
+	assert.Equal(t, nil, err)
+	defer listener.Close()
+
+	fi, err := os.Stat(dgramPath)
+	assert.Equal(t, nil, err)
+	assert.Equal(t, os.FileMode(0620), fi.Mode().Perm())
+
+	ch := make(chan *Packet, 10)
+	go parseTo(dconn, false, ch)
+	go func() {
+		conn, err := listener.AcceptUnix()
+		if err == nil {
+			parseTo(conn, true, ch)
+		}
+	}()
+
+	c, err := net.Dial("unixgram", dgramPath)
+	assert.Equal(t, nil, err)
+	c.Write([]byte("unix.dgram:1|c\nunix.gauge:2|g"))
+	c.Close()
+
+	c, err = net.Dial("unix", streamPath)
+	assert.Equal(t, nil, err)
+	c.Write([]byte("unix.stream:3|c\n"))
+	c.Close()
+
+	got := map[string]bool{}
+	for len(got) < 3 {
+		select {
+		case p := <-ch:
+			got[p.Bucket] = true
+		case <-time.After(2 * time.Second):
+			t.Fatalf("received %v", got)
+		}
+	}
+	assert.Equal(t, map[string]bool{"unix.dgram": true, "unix.gauge": true, "unix.stream": true}, got)
+	dconn.Close()
+}